@@ -1,6 +1,7 @@
 "use client";
 import { useEffect, useState } from "react";
 import Link from "next/link";
+import { authHeaders } from "../../lib/auth";
 
 export default function AdminHome() {
   const [TotalLoan, setTotalLoan] = useState<number | null>(null);
@@ -24,7 +25,8 @@ export default function AdminHome() {
 
         // Fetch total debt
         const totalDebtResponse = await fetch(
-          "http://localhost:8080/getTotalLoan"
+          "http://localhost:8080/getTotalLoan",
+          { headers: authHeaders() }
         );
         if (!totalDebtResponse.ok) {
           throw new Error("Failed to fetch total debt");
@@ -35,7 +37,8 @@ export default function AdminHome() {
 
         // Fetch user info
         const usersResponse = await fetch(
-          "http://localhost:8080/getAllUserInfoForAdmin"
+          "http://localhost:8080/getAllUserInfoForAdmin",
+          { headers: authHeaders() }
         );
         if (!usersResponse.ok) {
           throw new Error("Failed to fetch user data");
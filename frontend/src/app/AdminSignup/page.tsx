@@ -2,6 +2,7 @@
 import Link from "next/link";
 import React, { useState } from "react";
 import { useRouter } from "next/navigation";
+import { authHeaders } from "../../lib/auth";
 
 export default function AdminSignup() {
   const router = useRouter();
@@ -38,6 +39,7 @@ export default function AdminSignup() {
         method: "POST",
         headers: {
           "Content-Type": "application/json",
+          ...authHeaders(),
         },
         body: JSON.stringify({
           username: formData.username,
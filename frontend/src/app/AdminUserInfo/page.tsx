@@ -2,6 +2,7 @@
 
 import { useEffect, useState } from "react";
 import { useRouter } from "next/navigation";
+import { authHeaders } from "../../lib/auth";
 
 export default function AdminUserInfo() {
   const router = useRouter();
@@ -32,7 +33,8 @@ export default function AdminUserInfo() {
       try {
         // Fetch user information
         const userResponse = await fetch(
-          `http://localhost:8080/getUserInfo?userID=${id}`
+          `http://localhost:8080/getUserInfo?userID=${id}`,
+          { headers: authHeaders() }
         );
         if (!userResponse.ok) {
           const errorMessage = await userResponse.text();
@@ -43,7 +45,8 @@ export default function AdminUserInfo() {
 
         // Fetch user debt details
         const debtResponse = await fetch(
-          `http://localhost:8080/getUserLoans?userID=${id}`
+          `http://localhost:8080/getUserLoans?userID=${id}`,
+          { headers: authHeaders() }
         );
         if (!debtResponse.ok) {
           const errorMessage = await debtResponse.text();
@@ -100,6 +103,7 @@ export default function AdminUserInfo() {
         `http://localhost:8080/handlePaymentApproval?paymentID=${paymentID}&action=${action}`,
         {
           method: "POST",
+          headers: authHeaders(),
         }
       );
       if (!response.ok) {
@@ -116,7 +120,8 @@ export default function AdminUserInfo() {
   const fetchReceipts = async (loanID: number) => {
     try {
       const response = await fetch(
-        `http://localhost:8080/decryptReceipt?loanID=${loanID}`
+        `http://localhost:8080/decryptReceipt?loanID=${loanID}`,
+        { headers: authHeaders() }
       );
       if (!response.ok) {
         throw new Error(`Failed to fetch receipts for LoanID: ${loanID}`);
@@ -135,7 +140,8 @@ export default function AdminUserInfo() {
         const statusData = await Promise.all(
           debtDetails.map(async (debt) => {
             const res = await fetch(
-              `http://localhost:8080/getPaymentStatus?loanID=${debt.loan_id}`
+              `http://localhost:8080/getPaymentStatus?loanID=${debt.loan_id}`,
+              { headers: authHeaders() }
             );
             if (!res.ok) throw new Error("Failed to fetch payment status");
             const data = await res.json();
@@ -13,6 +13,7 @@ import {
   DialogTitle,
 } from "@headlessui/react";
 import Cookies from "js-cookie";
+import { authHeaders } from "../../lib/auth";
 
 export default function Borrow() {
   const [showOverlay1, setShowOverlay1] = useState(false);
@@ -121,6 +122,7 @@ export default function Borrow() {
         method: "POST",
         headers: {
           "Content-Type": "application/json",
+          ...authHeaders(),
         },
         body: JSON.stringify({
           user_id: requestData.userId,
@@ -161,6 +163,7 @@ export default function Borrow() {
         method: "POST",
         headers: {
           "Content-Type": "application/json",
+          ...authHeaders(),
         },
         body: JSON.stringify({
           user_id: requestData.userId,
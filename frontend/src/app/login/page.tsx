@@ -36,6 +36,13 @@ export default function LoginPage() {
         });
         console.log("user id from login: ", Cookies.get("userId"));
 
+        // Later requests send this token; it expires with the server session
+        Cookies.set("token", roleData.token, {
+          expires: 0.5,
+          secure: true,
+          sameSite: "none",
+        });
+
         if (roleData.role === "admin") {
           router.push("/AdminHome");
         } else if (roleData.role === "user") {
@@ -11,6 +11,7 @@ import {
   DialogTitle,
 } from "@headlessui/react";
 import Cookies from "js-cookie";
+import { authHeaders } from "../../lib/auth";
 
 interface Props {
   id: number;
@@ -45,7 +46,8 @@ function DebtInfo(props: Props) {
         async function fetchPaymentDetails() {
           try {
             const response = await fetch(
-              `http://localhost:8080/checkPaymentDetails?loanID=${props.id}`
+              `http://localhost:8080/checkPaymentDetails?loanID=${props.id}`,
+              { headers: authHeaders() }
             );
             if (!response.ok) {
               throw new Error("Failed to fetch payment details");
@@ -81,7 +83,8 @@ function DebtInfo(props: Props) {
   const fetchPaymentStatus = async () => {
     try {
       const response = await fetch(
-        `http://localhost:8080/getPaymentStatus?loanID=${props.id}`
+        `http://localhost:8080/getPaymentStatus?loanID=${props.id}`,
+        { headers: authHeaders() }
       );
       if (!response.ok) {
         throw new Error(`HTTP error! status: ${response.status}`);
@@ -133,7 +136,8 @@ function DebtInfo(props: Props) {
     // Make an API request to check details for the loan
     try {
       const response = await fetch(
-        `http://localhost:8080/confirmPaymentDetails?loanID=${props.id}`
+        `http://localhost:8080/confirmPaymentDetails?loanID=${props.id}`,
+        { headers: authHeaders() }
       );
       if (!response.ok) {
         throw new Error(
@@ -175,6 +179,7 @@ function DebtInfo(props: Props) {
         `http://localhost:8080/insertPayment?loanID=${props.id}`,
         {
           method: "POST", // Ensure you are sending a POST request
+          headers: authHeaders(),
           body: formData, // Send the FormData containing the file
         }
       );
@@ -434,7 +439,8 @@ export default function Debt() {
       // Fetch loan info
       try {
         const response = await fetch(
-          `http://localhost:8080/getUserLoans?userID=${userId}`
+          `http://localhost:8080/getUserLoans?userID=${userId}`,
+          { headers: authHeaders() }
         );
         if (!response.ok) {
           throw new Error(`HTTP error! status: ${response.status}`);
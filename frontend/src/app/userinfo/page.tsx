@@ -4,6 +4,7 @@ import { useEffect, useState } from "react";
 import { useRouter } from "next/navigation";
 import NavBar from "../../components/NavBar";
 import Cookies from "js-cookie";
+import { authHeaders } from "../../lib/auth";
 
 export default function UserInfo() {
   const [userData, setUserData] = useState<any | null>(null);
@@ -36,7 +37,8 @@ export default function UserInfo() {
       }
       try {
         const response = await fetch(
-          `http://localhost:8080/getUserInfo?userID=${userID}`
+          `http://localhost:8080/getUserInfo?userID=${userID}`,
+          { headers: authHeaders() }
         );
         if (!response.ok) {
           const errorText = await response.text();
@@ -126,7 +128,7 @@ export default function UserInfo() {
         `http://localhost:8080/updateUserInfo?userID=${userID}`,
         {
           method: "PUT",
-          headers: { "Content-Type": "application/json" },
+          headers: { "Content-Type": "application/json", ...authHeaders() },
           body: JSON.stringify(editData),
         }
       );
@@ -156,6 +158,7 @@ export default function UserInfo() {
   const confirmLogout = () => {
     setShowLogoutModal(false);
     Cookies.remove("userId"); // Remove userId cookie on logout
+    Cookies.remove("token");
     router.push("/home"); // Redirect to home page
   };
 
@@ -8,6 +8,7 @@ import { Menu, MenuButton, MenuItem, MenuItems } from "@headlessui/react";
 import { Dialog, DialogBackdrop, DialogPanel } from "@headlessui/react";
 import Cookies from "js-cookie";
 import { user } from "@nextui-org/theme";
+import { authHeaders } from "../lib/auth";
 
 export default function NavBar() {
   const PageName = [
@@ -51,7 +52,8 @@ export default function NavBar() {
       try {
         // Fetch user info
         const userInfoResponse = await fetch(
-          `http://localhost:8080/getUserInfo?userID=${userData.userId}`
+          `http://localhost:8080/getUserInfo?userID=${userData.userId}`,
+          { headers: authHeaders() }
         );
         if (!userInfoResponse.ok) {
           throw new Error(`HTTP error! status: ${userInfoResponse.status}`);
@@ -64,7 +66,8 @@ export default function NavBar() {
 
         // Fetch user credit
         const userCreditResponse = await fetch(
-          `http://localhost:8080/getUserCreditLevel?userID=${userData.userId}`
+          `http://localhost:8080/getUserCreditLevel?userID=${userData.userId}`,
+          { headers: authHeaders() }
         );
         if (!userCreditResponse.ok) {
           throw new Error(`HTTP error! status: ${userCreditResponse.status}`);
@@ -112,7 +115,8 @@ export default function NavBar() {
     try {
       // Fetch user total debt
       const userDebtResponse = await fetch(
-        `http://localhost:8080/getUserTotalLoan?userID=${userData.userId}`
+        `http://localhost:8080/getUserTotalLoan?userID=${userData.userId}`,
+        { headers: authHeaders() }
       );
       if (!userDebtResponse.ok) {
         throw new Error(`HTTP error! status: ${userDebtResponse.status}`);
@@ -156,6 +160,7 @@ export default function NavBar() {
           method: "DELETE",
           headers: {
             "Content-Type": "application/json",
+            ...authHeaders(),
           },
         }
       );
@@ -167,6 +172,7 @@ export default function NavBar() {
       }
 
       Cookies.remove("userId");
+      Cookies.remove("token");
 
       // Update userData to reflect a logged-out state
       setUserData({
@@ -0,0 +1,8 @@
+import Cookies from "js-cookie";
+
+// The session token issued by /login. The server needs it to tell who is
+// calling, and refuses admin endpoints without an admin token.
+export function authHeaders(): Record<string, string> {
+  const token = Cookies.get("token");
+  return token ? { Authorization: `Bearer ${token}` } : {};
+}
@@ -3,11 +3,20 @@ module server
 go 1.22.4
 
 require (
+	github.com/DATA-DOG/go-sqlmock v1.5.2
 	github.com/go-sql-driver/mysql v1.8.1
+	github.com/pdfcpu/pdfcpu v0.9.1
 	golang.org/x/crypto v0.28.0
+	golang.org/x/image v0.21.0
 )
 
 require (
 	filippo.io/edwards25519 v1.1.0 // indirect
-	github.com/gorilla/mux v1.8.1 // indirect
+	github.com/hhrutter/lzw v1.0.0 // indirect
+	github.com/hhrutter/tiff v1.0.1 // indirect
+	github.com/mattn/go-runewidth v0.0.16 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/rivo/uniseg v0.4.7 // indirect
+	golang.org/x/text v0.19.0 // indirect
+	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
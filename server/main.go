@@ -1,29 +1,53 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"database/sql"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
 	"io"
+	"io/fs"
 	"log"
 	"math"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
-	"github.com/gorilla/mux"
+	"github.com/go-sql-driver/mysql"
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/image/draw"
 )
 
 // UserAccount struct represents user account information including personal and bank details
@@ -54,6 +78,9 @@ type LoanRequest struct {
 	UserID        int     `json:"user_id"`
 	InitialAmount float64 `json:"initial_amount"`
 	DueDateTime   string  `json:"due_date_time"` // expected format: "2006-01-02 15:04"
+	GuarantorIDs  []int   `json:"guarantor_ids,omitempty"`
+	// Collateral makes the loan secured; the amount is then capped by the loan-to-value settings
+	Collateral []CollateralItem `json:"collateral,omitempty"`
 }
 
 // LoanResponse struct represents the response after applying for a loan
@@ -64,7 +91,15 @@ type LoanResponse struct {
 	InitialAmount  float64 `json:"initial_amount"`
 	InterestRate   float64 `json:"interest_rate"`
 	InterestAmount float64 `json:"interest"`
+	ExtensionFee   float64 `json:"extension_fee"`
 	Status         string  `json:"status"`
+	// CoolingOffUntil is set while the loan can still be cancelled without interest
+	CoolingOffUntil   string `json:"cooling_off_until,omitempty"`
+	GuarantorRequired bool   `json:"guarantor_required,omitempty"`
+	// DueDateAdjusted is set when the requested due date fell on a weekend or holiday and was moved
+	DueDateAdjusted bool    `json:"due_date_adjusted,omitempty"`
+	SecuredLimit    float64 `json:"secured_limit,omitempty"`
+	LoanToValue     float64 `json:"loan_to_value,omitempty"`
 }
 
 type UserInfoForAdmin struct {
@@ -72,12 +107,395 @@ type UserInfoForAdmin struct {
 	Username        string  `json:"username"`
 	TotalLoan       float64 `json:"total_loan"`
 	TotalLoanRemain float64 `json:"total_loan_remain"`
-	RiskLevel       string  `json:"risk_level"`
+	// GuarantorExposure is the outstanding total of other users' loans this user has guaranteed
+	GuarantorExposure float64  `json:"guarantor_exposure"`
+	RiskLevel         string   `json:"risk_level"`
+	CreditScore       int      `json:"credit_score"`
+	RiskBand          RiskBand `json:"risk_band"`
+	RiskFactors       []string `json:"risk_factors"`
 }
 
-// Database struct wraps the SQL database connection
+// RiskBand struct represents an admin-defined credit score range and how it is labelled
+type RiskBand struct {
+	MinScore int    `json:"min_score"`
+	MaxScore *int   `json:"max_score"` // nil for the highest band, which has no upper bound
+	Color    string `json:"color"`
+	Label    string `json:"label"`
+}
+
+// Database struct wraps the SQL database connection together with the clock and
+// location every date is interpreted in
 type Database struct {
 	*sql.DB
+	clock Clock
+	loc   *time.Location
+	blobs BlobStore
+	pii   *fieldCipher
+	// signingKey authenticates payment records; see signPayment
+	signingKey []byte
+	// auditKey chains audit log entries; see appendAudit
+	auditKey []byte
+}
+
+//TIME
+
+// Clock is where the domain logic gets the current time from
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock reads the wall clock
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+const (
+	dbTimeLayout     = "2006-01-02 15:04:05" // DATETIME columns, always stored in UTC
+	apiTimeLayout    = "2006-01-02 15:04:05" // timestamps in responses, in the business location
+	apiDueDateLayout = "2006-01-02 15:04"    // due dates entered by borrowers
+	apiDateLayout    = "2006-01-02"          // calendar days such as payoff dates
+)
+
+// defaultTimezone is used when LOANLOEY_TIMEZONE is not set
+const defaultTimezone = "Asia/Bangkok"
+
+// loadBusinessLocation returns the configured timezone borrowers and admins work in
+func loadBusinessLocation() (*time.Location, error) {
+	name := os.Getenv("LOANLOEY_TIMEZONE")
+	if name == "" {
+		name = defaultTimezone
+	}
+	return time.LoadLocation(name)
+}
+
+// now returns the current time according to the database's clock
+func (db *Database) now() time.Time {
+	return db.clock.Now()
+}
+
+// toDB formats an instant for a DATETIME column
+func toDB(t time.Time) string {
+	return t.UTC().Format(dbTimeLayout)
+}
+
+// fromDB parses a DATETIME column value, which is always UTC
+func fromDB(value string) (time.Time, error) {
+	return time.ParseInLocation(dbTimeLayout, value, time.UTC)
+}
+
+// parseAPITime parses a wall-clock time entered in the business location
+func (db *Database) parseAPITime(layout, value string) (time.Time, error) {
+	return time.ParseInLocation(layout, value, db.loc)
+}
+
+// formatAPITime renders an instant as wall-clock time in the business location
+func (db *Database) formatAPITime(t time.Time) string {
+	return t.In(db.loc).Format(apiTimeLayout)
+}
+
+// dbToAPITime converts a DATETIME column value to business-location wall-clock time
+func (db *Database) dbToAPITime(value string) (string, error) {
+	t, err := fromDB(value)
+	if err != nil {
+		return "", err
+	}
+	return db.formatAPITime(t), nil
+}
+
+//SCHEMA
+
+// schemaStatements creates the tables that are not part of the original loanloey dump.
+// Every statement must be safe to run on each startup.
+var schemaStatements = []string{
+	`CREATE TABLE IF NOT EXISTS schemamigration (
+		Name VARCHAR(64) PRIMARY KEY,
+		AppliedAt DATETIME NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS riskband (
+		BandID INT AUTO_INCREMENT PRIMARY KEY,
+		MinScore INT NOT NULL UNIQUE,
+		Color VARCHAR(20) NOT NULL,
+		Label VARCHAR(50) NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS setting (
+		Name VARCHAR(64) PRIMARY KEY,
+		Value DOUBLE NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS loanextension (
+		ExtensionID INT AUTO_INCREMENT PRIMARY KEY,
+		LoanID INT NOT NULL,
+		RequestedAt DATETIME NOT NULL,
+		OriginalDuedate DATETIME NOT NULL,
+		OriginalInterestRate DOUBLE NOT NULL,
+		OriginalInterest DOUBLE NOT NULL,
+		OriginalTotal DOUBLE NOT NULL,
+		NewDuedate DATETIME NOT NULL,
+		NewInterestRate DOUBLE NOT NULL,
+		NewInterest DOUBLE NOT NULL,
+		NewTotal DOUBLE NOT NULL,
+		ExtensionFee DOUBLE NOT NULL,
+		Status VARCHAR(20) NOT NULL,
+		DecidedAt DATETIME NULL,
+		AdminNote VARCHAR(255) NOT NULL DEFAULT '',
+		INDEX (LoanID)
+	)`,
+	`CREATE TABLE IF NOT EXISTS payoffquote (
+		QuoteID INT AUTO_INCREMENT PRIMARY KEY,
+		LoanID INT NOT NULL,
+		PayoffDate DATE NOT NULL,
+		ValidUntil DATETIME NOT NULL,
+		Interest DOUBLE NOT NULL,
+		Rebate DOUBLE NOT NULL,
+		TotalDue DOUBLE NOT NULL,
+		CreatedAt DATETIME NOT NULL,
+		PaymentID INT NULL,
+		INDEX (LoanID)
+	)`,
+	`CREATE TABLE IF NOT EXISTS session (
+		Token CHAR(64) PRIMARY KEY,
+		AccountID INT NOT NULL,
+		UserID INT NULL,
+		Role VARCHAR(10) NOT NULL,
+		ExpiresAt DATETIME NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS loanguarantor (
+		LoanID INT NOT NULL,
+		GuarantorUserID INT NOT NULL,
+		Status VARCHAR(20) NOT NULL,
+		RespondedAt DATETIME NULL,
+		PRIMARY KEY (LoanID, GuarantorUserID),
+		INDEX (GuarantorUserID)
+	)`,
+	`CREATE TABLE IF NOT EXISTS collateral (
+		CollateralID INT AUTO_INCREMENT PRIMARY KEY,
+		LoanID INT NOT NULL,
+		AssetType VARCHAR(20) NOT NULL,
+		Description VARCHAR(255) NOT NULL,
+		DeclaredValue DOUBLE NOT NULL,
+		Status VARCHAR(20) NOT NULL,
+		ResolvedAt DATETIME NULL,
+		INDEX (LoanID)
+	)`,
+	`CREATE TABLE IF NOT EXISTS collateralphoto (
+		PhotoID INT AUTO_INCREMENT PRIMARY KEY,
+		CollateralID INT NOT NULL,
+		Photo LONGBLOB NOT NULL,
+		AESKey BLOB NOT NULL,
+		UploadedAt DATETIME NOT NULL,
+		INDEX (CollateralID)
+	)`,
+	`CREATE TABLE IF NOT EXISTS idempotencykey (
+		Scope VARCHAR(50) NOT NULL,
+		IdemKey VARCHAR(100) NOT NULL,
+		RequestHash CHAR(64) NOT NULL,
+		StatusCode INT NULL,
+		ContentType VARCHAR(100) NULL,
+		ResponseBody MEDIUMBLOB NULL,
+		CreatedAt DATETIME NOT NULL,
+		PRIMARY KEY (Scope, IdemKey)
+	)`,
+	`CREATE TABLE IF NOT EXISTS rsakey (
+		KeyID VARCHAR(32) PRIMARY KEY,
+		PublicKey TEXT NOT NULL,
+		Status VARCHAR(20) NOT NULL,
+		CreatedAt DATETIME NOT NULL,
+		ActivatedAt DATETIME NULL,
+		RetiredAt DATETIME NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS datakey (
+		DataKeyID INT AUTO_INCREMENT PRIMARY KEY,
+		Purpose VARCHAR(20) NOT NULL UNIQUE,
+		AESKey BLOB NOT NULL,
+		KeyID VARCHAR(32) NOT NULL,
+		KeyWrapVersion TINYINT NOT NULL,
+		CreatedAt DATETIME NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS securityevent (
+		EventID INT AUTO_INCREMENT PRIMARY KEY,
+		Kind VARCHAR(50) NOT NULL,
+		PaymentID INT NULL,
+		Detail TEXT NOT NULL,
+		CreatedAt DATETIME NOT NULL,
+		INDEX (Kind, PaymentID, CreatedAt)
+	)`,
+	`CREATE TABLE IF NOT EXISTS holiday (
+		HolidayDate DATE PRIMARY KEY,
+		Name VARCHAR(100) NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS auditlog (
+		AuditID BIGINT AUTO_INCREMENT PRIMARY KEY,
+		OccurredAt DATETIME NOT NULL,
+		ActorAccountID INT NULL,
+		ActorRole VARCHAR(10) NOT NULL,
+		Action VARCHAR(50) NOT NULL,
+		EntityType VARCHAR(30) NOT NULL,
+		EntityID VARCHAR(50) NOT NULL,
+		BeforeValue MEDIUMTEXT NULL,
+		AfterValue MEDIUMTEXT NULL,
+		StatusCode INT NOT NULL,
+		IP VARCHAR(45) NOT NULL,
+		RequestID VARCHAR(64) NOT NULL,
+		PrevHash CHAR(64) NOT NULL,
+		EntryHash CHAR(64) NOT NULL,
+		INDEX (Action),
+		INDEX (EntityType, EntityID),
+		INDEX (ActorAccountID),
+		INDEX (OccurredAt)
+	)`,
+	`CREATE TABLE IF NOT EXISTS dataexport (
+		ExportID INT AUTO_INCREMENT PRIMARY KEY,
+		UserID INT NOT NULL,
+		RequestedBy INT NOT NULL,
+		Status VARCHAR(20) NOT NULL,
+		Token CHAR(64) NULL UNIQUE,
+		AESKey BLOB NULL,
+		KeyID VARCHAR(32) NULL,
+		KeyWrapVersion TINYINT NOT NULL DEFAULT 1,
+		Error TEXT NULL,
+		RequestedAt DATETIME NOT NULL,
+		CompletedAt DATETIME NULL,
+		ExpiresAt DATETIME NULL,
+		INDEX (UserID),
+		INDEX (Status)
+	)`,
+	`CREATE TABLE IF NOT EXISTS auditchain (
+		ChainID TINYINT PRIMARY KEY,
+		LastHash CHAR(64) NOT NULL,
+		LastAuditID BIGINT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS creditscorehistory (
+		HistoryID BIGINT AUTO_INCREMENT PRIMARY KEY,
+		UserID INT NOT NULL,
+		Score INT NOT NULL,
+		RecordedAt DATETIME NOT NULL,
+		INDEX (UserID, RecordedAt)
+	)`,
+}
+
+// schemaColumns adds columns to the original tables; each entry is table, column, definition
+var schemaColumns = [][3]string{
+	{"loan", "ExtensionFee", "DOUBLE NOT NULL DEFAULT 0"},
+	{"loan", "DisbursedAt", "DATETIME NULL"},
+	{"loan", "DefaultedAt", "DATETIME NULL"},
+	{"payment", "QuoteID", "INT NULL"},
+	{"payment", "AmountDue", "DOUBLE NULL"},
+	{"payment", "RejectReason", "VARCHAR(30) NULL"},
+	{"payment", "RejectNote", "TEXT NULL"},
+	{"payment", "ResubmissionOf", "INT NULL"},
+	{"payment", "ReceiptHash", "CHAR(64) NULL"},
+	{"payment", "ReceiptType", "VARCHAR(50) NULL"},
+	{"payment", "BlobKey", "VARCHAR(200) NULL"},
+	{"payment", "ReceiptChecksum", "CHAR(64) NULL"},
+	{"payment", "ThumbnailKey", "VARCHAR(200) NULL"},
+	{"payment", "AESKeyID", "VARCHAR(32) NULL"},
+	{"collateralphoto", "KeyID", "VARCHAR(32) NULL"},
+	{"payment", "KeyWrapVersion", "TINYINT NOT NULL DEFAULT 1"},
+	{"collateralphoto", "KeyWrapVersion", "TINYINT NOT NULL DEFAULT 1"},
+	{"user", "IDCardEnc", "BLOB NULL"},
+	{"user", "BankAccNoEnc", "BLOB NULL"},
+	{"user", "PhoneNoEnc", "BLOB NULL"},
+	{"user", "AddressEnc", "BLOB NULL"},
+	{"user", "IDCardIndex", "CHAR(64) NULL"},
+	{"payment", "RecordSignature", "CHAR(64) NULL"},
+	{"dataexport", "ClaimedAt", "DATETIME NULL"},
+}
+
+// defaultRiskBands are the bands seeded into an empty riskband table,
+// matching the thresholds that used to be hardcoded in GetUserCreditLevel
+var defaultRiskBands = []RiskBand{
+	{MinScore: 0, Color: "green", Label: "Low risk"},
+	{MinScore: 3, Color: "yellow", Label: "Medium risk"},
+	{MinScore: 5, Color: "red", Label: "High risk"},
+}
+
+// ensureSchema creates missing tables and seeds their default rows
+func (db *Database) ensureSchema() error {
+	for _, stmt := range schemaStatements {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("applying schema: %w", err)
+		}
+	}
+
+	for _, column := range schemaColumns {
+		if err := db.addColumnIfMissing(column[0], column[1], column[2]); err != nil {
+			return err
+		}
+	}
+
+	if err := db.runMigration("timestamps-to-utc", db.migrateTimestampsToUTC); err != nil {
+		return err
+	}
+
+	err := db.runMigration("payment-receipt-hash-index", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`CREATE INDEX idx_payment_receipthash ON payment (ReceiptHash)`)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = db.runMigration("user-idcard-index", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`CREATE INDEX idx_user_idcardindex ON user (IDCardIndex)`)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// A migration never changes once released, so the index is made unique by a migration of its own.
+	// The unique index is what finally stops two users registering one ID card; users without one are NULL.
+	err = db.runMigration("user-idcard-index-unique", db.makeIDCardIndexUnique)
+	if err != nil {
+		return err
+	}
+
+	// The audit log is append-only even for someone with direct database access short of dropping the triggers
+	err = db.runMigration("auditlog-append-only", func(tx *sql.Tx) error {
+		for _, event := range []string{"UPDATE", "DELETE"} {
+			trigger := fmt.Sprintf(`CREATE TRIGGER auditlog_no_%s BEFORE %s ON auditlog FOR EACH ROW
+				SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'auditlog is append-only'`, strings.ToLower(event), event)
+			if _, err := tx.Exec(trigger); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec(`INSERT IGNORE INTO auditchain (ChainID, LastHash, LastAuditID) VALUES (1, ?, 0)`, auditGenesisHash); err != nil {
+		return fmt.Errorf("seeding audit chain: %w", err)
+	}
+
+	err = db.runMigration("credit-score-history", db.startCreditScoreHistory)
+	if err != nil {
+		return err
+	}
+
+	var bandCount int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM riskband`).Scan(&bandCount); err != nil {
+		return fmt.Errorf("counting risk bands: %w", err)
+	}
+	if bandCount == 0 {
+		if err := db.ReplaceRiskBands(defaultRiskBands); err != nil {
+			return fmt.Errorf("seeding risk bands: %w", err)
+		}
+	}
+
+	var holidayCount int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM holiday`).Scan(&holidayCount); err != nil {
+		return fmt.Errorf("counting holidays: %w", err)
+	}
+	if holidayCount == 0 {
+		holidays, err := loadHolidayFile(defaultHolidayFile)
+		if err != nil {
+			log.Printf("Holiday calendar left empty: %v", err)
+		} else if err := db.ImportHolidays(holidays); err != nil {
+			return fmt.Errorf("seeding holidays: %w", err)
+		}
+	}
+
+	return nil
 }
 
 // HELPER FUNCTIONS
@@ -92,9 +510,9 @@ func calculateInterestRate(amount float64) float64 {
 	}
 }
 
-func calculateLoanDetails(amount float64, dueDate time.Time) (totalAmount float64, interestAmount float64, interestRate float64) {
+func calculateLoanDetails(amount float64, dueDate, now time.Time) (totalAmount float64, interestAmount float64, interestRate float64) {
 	interestRate = calculateInterestRate(amount)
-	durationDays := int(time.Until(dueDate).Hours() / 24)
+	durationDays := int(dueDate.Sub(now).Hours() / 24)
 	if durationDays > 365 {
 		interestRate += 0.01 // long-term loan penalty
 		interestRate = roundToTwoDecimalPlaces(interestRate)
@@ -109,6 +527,208 @@ func roundToTwoDecimalPlaces(value float64) float64 {
 	return math.Round(value*100) / 100
 }
 
+// addColumnIfMissing adds a column to an existing table unless it is already there
+func (db *Database) addColumnIfMissing(table, column, definition string) error {
+	var exists bool
+	query := `SELECT EXISTS(SELECT 1 FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?)`
+	if err := db.QueryRow(query, table, column).Scan(&exists); err != nil {
+		return fmt.Errorf("checking column %s.%s: %w", table, column, err)
+	}
+	if exists {
+		return nil
+	}
+
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("adding column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+// runMigration applies a one-off data migration inside a transaction unless it has already been recorded
+func (db *Database) runMigration(name string, migrate func(tx *sql.Tx) error) error {
+	var applied bool
+	if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM schemamigration WHERE Name = ?)`, name).Scan(&applied); err != nil {
+		return fmt.Errorf("checking migration %s: %w", name, err)
+	}
+	if applied {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("starting migration %s: %w", name, err)
+	}
+	defer tx.Rollback()
+
+	if err := migrate(tx); err != nil {
+		return fmt.Errorf("running migration %s: %w", name, err)
+	}
+	if _, err := tx.Exec(`INSERT INTO schemamigration (Name, AppliedAt) VALUES (?, ?)`, name, toDB(db.now())); err != nil {
+		return fmt.Errorf("recording migration %s: %w", name, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing migration %s: %w", name, err)
+	}
+	log.Printf("Applied migration %s", name)
+	return nil
+}
+
+// localTimestampColumns were written as business-location wall-clock time before timestamps were stored in UTC;
+// each entry is table, column, then the columns identifying a row
+var localTimestampColumns = [][]string{
+	{"loan", "Duedate", "LoanID"}, {"loan", "DOProcess", "LoanID"}, {"loan", "DisbursedAt", "LoanID"},
+	{"payment", "DOPayment", "PaymentID"},
+	{"loanextension", "OriginalDuedate", "ExtensionID"}, {"loanextension", "NewDuedate", "ExtensionID"},
+	{"payoffquote", "ValidUntil", "QuoteID"},
+}
+
+// serverTimestampColumns were written with the server's own time.Now(), in whatever zone the server ran in
+var serverTimestampColumns = [][]string{
+	{"loan", "DefaultedAt", "LoanID"},
+	{"loanextension", "RequestedAt", "ExtensionID"}, {"loanextension", "DecidedAt", "ExtensionID"},
+	{"payoffquote", "CreatedAt", "QuoteID"},
+	{"loanguarantor", "RespondedAt", "LoanID", "GuarantorUserID"},
+	{"collateral", "ResolvedAt", "CollateralID"},
+	{"collateralphoto", "UploadedAt", "PhotoID"},
+}
+
+// migrateTimestampsToUTC converts existing wall-clock timestamps to UTC. The remaining DATETIME columns
+// were always written in UTC and are left alone: session.ExpiresAt has been stored with .UTC() since
+// sessions were added, and schemamigration only starts recording with this migration.
+func (db *Database) migrateTimestampsToUTC(tx *sql.Tx) error {
+	if err := convertTimestampsToUTC(tx, localTimestampColumns, db.loc); err != nil {
+		return err
+	}
+	return convertTimestampsToUTC(tx, serverTimestampColumns, time.Local)
+}
+
+// convertTimestampsToUTC rewrites each value of the columns, read as wall-clock time in loc, as UTC.
+// Values are converted one by one with the zone's rules, so rows on either side of a daylight saving
+// change get their own offset.
+func convertTimestampsToUTC(tx *sql.Tx, columns [][]string, loc *time.Location) error {
+	for _, column := range columns {
+		table, name, keys := column[0], column[1], column[2:]
+		query := fmt.Sprintf("SELECT %s, %s FROM %s WHERE %s IS NOT NULL", name, strings.Join(keys, ", "), table, name)
+		rows, err := tx.Query(query)
+		if err != nil {
+			return fmt.Errorf("querying %s.%s: %w", table, name, err)
+		}
+
+		var updates [][]interface{}
+		for rows.Next() {
+			var value string
+			keyValues := make([]interface{}, len(keys))
+			dest := []interface{}{&value}
+			for i := range keyValues {
+				dest = append(dest, &keyValues[i])
+			}
+			if err := rows.Scan(dest...); err != nil {
+				rows.Close()
+				return fmt.Errorf("scanning %s.%s: %w", table, name, err)
+			}
+			local, err := time.ParseInLocation(dbTimeLayout, value, loc)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("parsing %s.%s: %w", table, name, err)
+			}
+			updates = append(updates, append([]interface{}{toDB(local)}, keyValues...))
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error iterating rows: %w", err)
+		}
+
+		update := fmt.Sprintf("UPDATE %s SET %s = ? WHERE %s = ?", table, name, strings.Join(keys, " = ? AND "))
+		for _, args := range updates {
+			if _, err := tx.Exec(update, args...); err != nil {
+				return fmt.Errorf("converting %s.%s: %w", table, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+//SETTINGS
+
+// settingDefaults lists every admin-tunable value with the default used until an admin changes it
+var settingDefaults = map[string]float64{
+	"extension_fee_rate":        0.01,   // fee charged on the principal for each approved due-date extension
+	"early_payoff_rebate_rate":  0.5,    // share of the unearned interest rebated when a loan is settled early
+	"cooling_off_hours":         24,     // how long after applying a borrower may cancel an undisbursed loan
+	"guarantor_required_amount": 50000,  // loans of this principal or more need at least one guarantor
+	"max_user_exposure":         500000, // cap on a user's own outstanding loans plus the loans they guarantee
+	"ltv_vehicle":               0.6,    // loan-to-value limit for vehicles pledged as collateral
+	"ltv_gold":                  0.8,    // loan-to-value limit for gold
+	"ltv_property":              0.7,    // loan-to-value limit for property
+	"idempotency_window_hours":  24,     // how long an Idempotency-Key replays its first response before it can be reused
+}
+
+// GetSetting returns the configured value of a setting, falling back to its default
+func (db *Database) GetSetting(name string) (float64, error) {
+	defaultValue, ok := settingDefaults[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown setting %s", name)
+	}
+
+	var value float64
+	err := db.QueryRow(`SELECT Value FROM setting WHERE Name = ?`, name).Scan(&value)
+	if err == sql.ErrNoRows {
+		return defaultValue, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("querying setting %s: %w", name, err)
+	}
+	return value, nil
+}
+
+// GetSettings returns every setting with its current value
+func (db *Database) GetSettings() (map[string]float64, error) {
+	settings := make(map[string]float64, len(settingDefaults))
+	for name, value := range settingDefaults {
+		settings[name] = value
+	}
+
+	rows, err := db.Query(`SELECT Name, Value FROM setting`)
+	if err != nil {
+		return nil, fmt.Errorf("querying settings: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var value float64
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, fmt.Errorf("scanning setting row: %w", err)
+		}
+		if _, ok := settingDefaults[name]; ok {
+			settings[name] = value
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return settings, nil
+}
+
+// UpdateSetting stores a new value for a known setting
+func (db *Database) UpdateSetting(name string, value float64) error {
+	if _, ok := settingDefaults[name]; !ok {
+		return fmt.Errorf("unknown setting %s", name)
+	}
+	if value < 0 {
+		return fmt.Errorf("setting %s cannot be negative", name)
+	}
+
+	query := `INSERT INTO setting (Name, Value) VALUES (?, ?) ON DUPLICATE KEY UPDATE Value = VALUES(Value)`
+	if _, err := db.Exec(query, name, value); err != nil {
+		return fmt.Errorf("updating setting %s: %w", name, err)
+	}
+	return nil
+}
+
 //ACCOUNT
 
 // Signup function to create a new account
@@ -124,6 +744,19 @@ func (db *Database) Signup(userAccount UserAccount) error {
 		return fmt.Errorf("username %s is already taken", userAccount.Username)
 	}
 
+	// Check the ID card against the blind index, as the numbers themselves are encrypted
+	taken, err := db.idCardTaken(userAccount.IDCard, 0)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return errIDCardRegistered
+	}
+	sealed, err := db.pii.sealUser(userAccount)
+	if err != nil {
+		return err
+	}
+
 	// Hash the password if it is provided
 	var hashedPassword []byte
 	if userAccount.Password != "" {
@@ -133,9 +766,16 @@ func (db *Database) Signup(userAccount UserAccount) error {
 		}
 	}
 
+	// The account and user go in together, so a user rejected by the unique ID card index leaves no account behind
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
 	// Insert account into the database
 	accountQuery := `INSERT INTO account (Username, PasswordHash) VALUES (?, ?)`
-	result, err := db.Exec(accountQuery, userAccount.Username, hashedPassword)
+	result, err := tx.Exec(accountQuery, userAccount.Username, hashedPassword)
 	if err != nil {
 		return fmt.Errorf("inserting account: %w", err)
 	}
@@ -147,13 +787,22 @@ func (db *Database) Signup(userAccount UserAccount) error {
 	}
 
 	// Insert user details into the user table
-	userQuery := `INSERT INTO user (AccountID, FirstName, LastName, IDCard, DOB, PhoneNo, Address, CreditScore, BankName, BankAccNo) 
-                  VALUES (?, ?, ?, ?, ?, ?, ?, 0, ?, ?)`
-	_, err = db.Exec(userQuery, accountID, userAccount.FirstName, userAccount.LastName, userAccount.IDCard, userAccount.DOB, userAccount.PhoneNo, userAccount.Address, userAccount.BankName, userAccount.BankAccNo)
+	userQuery := `INSERT INTO user (AccountID, FirstName, LastName, IDCard, DOB, PhoneNo, Address, CreditScore, BankName, BankAccNo,
+	                                IDCardEnc, BankAccNoEnc, PhoneNoEnc, AddressEnc, IDCardIndex) 
+                  VALUES (?, ?, ?, ?, ?, ?, ?, 0, ?, ?, ?, ?, ?, ?, ?)`
+	_, err = tx.Exec(userQuery, accountID, userAccount.FirstName, userAccount.LastName, sealed.masked[0], userAccount.DOB, sealed.masked[2], sealed.masked[3], userAccount.BankName, sealed.masked[1],
+		sealed.idCard, sealed.bankAccNo, sealed.phoneNo, sealed.address, sealed.idCardIndex)
+	// Another signup with the same ID card can slip in between the check above and this insert
+	if isDuplicateKey(err, "idx_user_idcardindex") {
+		return errIDCardRegistered
+	}
 	if err != nil {
 		return fmt.Errorf("inserting user: %w", err)
 	}
 
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing signup: %w", err)
+	}
 	return nil
 
 }
@@ -185,11 +834,66 @@ func (db *Database) DeleteAccount(userID int) error {
 		return fmt.Errorf("cannot delete account with pending loans")
 	}
 
+	// Check for pending loans the user has agreed to guarantee.
+	var guaranteedLoans int
+	query = `SELECT COUNT(*) FROM loanguarantor g JOIN loan l ON g.LoanID = l.LoanID
+	         WHERE g.GuarantorUserID = ? AND g.Status = 'accepted' AND l.Status = 'pending'`
+	err = db.QueryRow(query, userID).Scan(&guaranteedLoans)
+	if err != nil {
+		return fmt.Errorf("checking guaranteed loans: %w", err)
+	}
+
+	if guaranteedLoans > 0 {
+		return fmt.Errorf("cannot delete account while guaranteeing pending loans")
+	}
+
+	// Delete guarantees given by the user or attached to the user's loans.
+	_, err = db.Exec(`DELETE FROM loanguarantor WHERE GuarantorUserID = ? OR LoanID IN (SELECT LoanID FROM loan WHERE UserID = ?)`, userID, userID)
+	if err != nil {
+		return fmt.Errorf("deleting guarantees: %w", err)
+	}
+
+	// Collect receipt blobs before their payment rows go; they are removed once the rows are gone.
+	var blobKeys []string
+	rows, err := db.Query(`SELECT BlobKey, ThumbnailKey FROM payment WHERE BlobKey IS NOT NULL AND LoanID IN (SELECT LoanID FROM loan WHERE UserID = ?)`, userID)
+	if err != nil {
+		return fmt.Errorf("querying receipt blobs: %w", err)
+	}
+	for rows.Next() {
+		var key string
+		var thumbnailKey sql.NullString
+		if err := rows.Scan(&key, &thumbnailKey); err != nil {
+			rows.Close()
+			return fmt.Errorf("scanning receipt blob: %w", err)
+		}
+		blobKeys = append(blobKeys, key)
+		if thumbnailKey.Valid {
+			blobKeys = append(blobKeys, thumbnailKey.String)
+		}
+	}
+	rows.Close()
+
 	// Delete payments related to the user's loans.
 	_, err = db.Exec(`DELETE FROM payment WHERE LoanID IN (SELECT LoanID FROM loan WHERE UserID = ?)`, userID)
 	if err != nil {
 		return fmt.Errorf("deleting payments: %w", err)
 	}
+	for _, key := range blobKeys {
+		if err := db.blobs.Delete(key); err != nil {
+			log.Printf("Error deleting receipt blob %s: %v", key, err)
+		}
+	}
+
+	// Delete collateral pledged against the user's loans, photos first.
+	_, err = db.Exec(`DELETE FROM collateralphoto WHERE CollateralID IN
+		(SELECT CollateralID FROM collateral WHERE LoanID IN (SELECT LoanID FROM loan WHERE UserID = ?))`, userID)
+	if err != nil {
+		return fmt.Errorf("deleting collateral photos: %w", err)
+	}
+	_, err = db.Exec(`DELETE FROM collateral WHERE LoanID IN (SELECT LoanID FROM loan WHERE UserID = ?)`, userID)
+	if err != nil {
+		return fmt.Errorf("deleting collateral: %w", err)
+	}
 
 	// Delete loans related to the user.
 	_, err = db.Exec(`DELETE FROM loan WHERE UserID = ?`, userID)
@@ -197,11 +901,46 @@ func (db *Database) DeleteAccount(userID int) error {
 		return fmt.Errorf("deleting loans: %w", err)
 	}
 
-	// Delete the user from the user table.
+	// Delete the user from the user table, with their credit score history.
 	_, err = db.Exec(`DELETE FROM user WHERE UserID = ?`, userID)
 	if err != nil {
 		return fmt.Errorf("deleting user: %w", err)
 	}
+	_, err = db.Exec(`DELETE FROM creditscorehistory WHERE UserID = ?`, userID)
+	if err != nil {
+		return fmt.Errorf("deleting credit score history: %w", err)
+	}
+
+	// Delete any sessions still open for the account.
+	_, err = db.Exec(`DELETE FROM session WHERE AccountID = ?`, accountID)
+	if err != nil {
+		return fmt.Errorf("deleting sessions: %w", err)
+	}
+
+	// Delete data exports of the user, files first.
+	rows, err = db.Query(`SELECT ExportID FROM dataexport WHERE UserID = ?`, userID)
+	if err != nil {
+		return fmt.Errorf("querying data exports: %w", err)
+	}
+	var exportIDs []int
+	for rows.Next() {
+		var exportID int
+		if err := rows.Scan(&exportID); err != nil {
+			rows.Close()
+			return fmt.Errorf("scanning data export: %w", err)
+		}
+		exportIDs = append(exportIDs, exportID)
+	}
+	rows.Close()
+	for _, exportID := range exportIDs {
+		if err := db.blobs.Delete(dataExportBlobKey(exportID)); err != nil && !errors.Is(err, errBlobNotFound) {
+			log.Printf("Error deleting data export %d: %v", exportID, err)
+		}
+	}
+	_, err = db.Exec(`DELETE FROM dataexport WHERE UserID = ?`, userID)
+	if err != nil {
+		return fmt.Errorf("deleting data exports: %w", err)
+	}
 
 	// Delete the account itself from the account table.
 	_, err = db.Exec(`DELETE FROM account WHERE AccountID = ?`, accountID)
@@ -266,81 +1005,690 @@ func (db *Database) Login(username, password string) (map[string]interface{}, er
 		}
 	}
 
+	// Issue a session token so endpoints acting on the caller's behalf know who they are
+	token, err := db.createSession(accountID, userID, role)
+	if err != nil {
+		return nil, err
+	}
+	userData["token"] = token
+
 	return userData, nil
 }
 
-//USER
+//SESSION
 
-// UpdateUserInfo updates user information
-func (db *Database) UpdateUserInfo(userID int, userAccount UserAccount) error {
-	query := `UPDATE user SET FirstName = ?, LastName = ?, IDCard = ?, DOB = ?, PhoneNo = ?, Address = ?, BankName = ?, BankAccNo = ? 
-			  WHERE UserID = ?`
-	_, err := db.Exec(query, userAccount.FirstName, userAccount.LastName, userAccount.IDCard, userAccount.DOB, userAccount.PhoneNo,
-		userAccount.Address, userAccount.BankName, userAccount.BankAccNo, userID)
+// sessionLifetime is how long a login token stays valid
+const sessionLifetime = 12 * time.Hour
+
+// Session struct represents the logged-in account behind a request
+type Session struct {
+	AccountID int
+	UserID    int // 0 for admins
+	Role      string
+}
+
+// createSession issues a random bearer token for an account that just logged in
+func (db *Database) createSession(accountID int64, userID sql.NullInt64, role string) (string, error) {
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", fmt.Errorf("generating session token: %w", err)
+	}
+	token := hex.EncodeToString(tokenBytes)
+
+	expiresAt := toDB(db.now().Add(sessionLifetime))
+	_, err := db.Exec(`INSERT INTO session (Token, AccountID, UserID, Role, ExpiresAt) VALUES (?, ?, ?, ?, ?)`,
+		token, accountID, userID, role, expiresAt)
 	if err != nil {
-		return fmt.Errorf("updating user info: %w", err)
+		return "", fmt.Errorf("inserting session: %w", err)
 	}
-	return nil
+	return token, nil
 }
 
-// GetUserInfo retrieves user information by user ID, including username from the account table
-func (db *Database) GetUserInfo(userID int) (*UserAccount, error) {
-	var userAccount UserAccount
+// sessionFromRequest looks up the session for the "Authorization: Bearer <token>" header
+func (db *Database) sessionFromRequest(r *http.Request) (*Session, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil, fmt.Errorf("missing bearer token")
+	}
+	return db.sessionFromToken(token)
+}
 
-	// Query to get user information, including username from the account table
-	query := `
-		SELECT u.FirstName, u.LastName, u.IDCard, u.DOB, u.PhoneNo, u.Address, u.CreditScore, 
-		       u.BankName, u.BankAccNo, a.Username
-		FROM user u
-		JOIN account a ON u.AccountID = a.AccountID
-		WHERE u.UserID = ?`
+// sessionFromToken looks up an unexpired session by its token
+func (db *Database) sessionFromToken(token string) (*Session, error) {
+	var session Session
+	var userID sql.NullInt64
+	var expiresAtStr string
+	query := `SELECT AccountID, UserID, Role, ExpiresAt FROM session WHERE Token = ?`
+	err := db.QueryRow(query, token).Scan(&session.AccountID, &userID, &session.Role, &expiresAtStr)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("unknown session")
+		}
+		return nil, fmt.Errorf("querying session: %w", err)
+	}
 
-	err := db.QueryRow(query, userID).Scan(&userAccount.FirstName, &userAccount.LastName, &userAccount.IDCard, &userAccount.DOB,
-		&userAccount.PhoneNo, &userAccount.Address, &userAccount.CreditScore, &userAccount.BankName, &userAccount.BankAccNo, &userAccount.Username,
-	)
+	expiresAt, err := fromDB(expiresAtStr)
 	if err != nil {
-		return nil, fmt.Errorf("querying user info: %w", err)
+		return nil, fmt.Errorf("parsing session expiry: %w", err)
+	}
+	if db.now().After(expiresAt) {
+		return nil, fmt.Errorf("session expired")
 	}
 
-	return &userAccount, nil
+	if userID.Valid {
+		session.UserID = int(userID.Int64)
+	}
+	return &session, nil
 }
 
-// GetUserCreditLevel retrieves the credit level of a user based on their credit score
-func (db *Database) GetUserCreditLevel(userID int) (string, error) {
-	var creditScore int
+// adminOnly refuses requests that do not carry an admin session
+func adminOnly(db *Database, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if session, err := db.sessionFromRequest(r); err != nil || session.Role != "admin" {
+			http.Error(w, "An admin session is required", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
 
-	// Query to get the credit score of the user
-	query := `SELECT CreditScore FROM user WHERE UserID = ?`
-	err := db.QueryRow(query, userID).Scan(&creditScore)
+// userSession checks that the request comes from the user it is about or from an admin
+func (db *Database) userSession(w http.ResponseWriter, r *http.Request, userID int) (*Session, bool) {
+	session, err := db.sessionFromRequest(r)
 	if err != nil {
-		return "", fmt.Errorf("querying credit score: %w", err)
+		http.Error(w, "A session is required", http.StatusUnauthorized)
+		return nil, false
 	}
-
-	// Determine the credit level based on the credit score
-	var creditLevel string
-	fmt.Println("creditLevel: ", creditScore, creditLevel)
-	switch {
-	case creditScore >= 5:
-		creditLevel = "red"
-	case creditScore >= 3:
-		creditLevel = "yellow"
-	default:
-		creditLevel = "green"
-
-		fmt.Println("creditLevel: ", creditScore, creditLevel)
-		return creditLevel, nil
+	if session.Role != "admin" && session.UserID != userID {
+		http.Error(w, "Only the user concerned or an admin can do this", http.StatusForbidden)
+		return nil, false
 	}
-	return creditLevel, nil
+	return session, true
 }
 
-// Updated getAllUserInfoForAdmin function
-func (db *Database) getAllUserInfoForAdmin() ([]UserInfoForAdmin, error) {
-	query := `SELECT u.UserID, a.Username FROM user u JOIN account a ON u.AccountID = a.AccountID`
-	rows, err := db.Query(query)
+// loanSession checks that the request comes from the loan's borrower or from an admin
+func (db *Database) loanSession(w http.ResponseWriter, r *http.Request, loanID int) (*Session, bool) {
+	session, err := db.sessionFromRequest(r)
 	if err != nil {
-		return nil, fmt.Errorf("querying users: %w", err)
+		http.Error(w, "A session is required", http.StatusUnauthorized)
+		return nil, false
+	}
+	if session.Role == "admin" {
+		return session, true
 	}
-	defer rows.Close()
+
+	var ownerID int
+	err = db.QueryRow(`SELECT UserID FROM loan WHERE LoanID = ?`, loanID).Scan(&ownerID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Loan not found", http.StatusNotFound)
+			return nil, false
+		}
+		http.Error(w, fmt.Sprintf("Error querying loan: %v", err), http.StatusInternalServerError)
+		return nil, false
+	}
+	if ownerID != session.UserID {
+		http.Error(w, "Only the borrower or an admin can see this loan's payments", http.StatusForbidden)
+		return nil, false
+	}
+	return session, true
+}
+
+//PERSONAL DATA
+
+// Data keys are AES keys wrapped with the RSA keyring like receipt keys, one per purpose
+const (
+	dataKeyPII        = "pii"
+	dataKeyBlindIndex = "pii-index"
+)
+
+// fieldCipher encrypts the user's personal data columns. IDCard, BankAccNo, PhoneNo and Address are
+// stored in <column>Enc; the original columns only keep a masked copy for older queries.
+type fieldCipher struct {
+	key      []byte
+	indexKey []byte
+}
+
+// loadDataKey unwraps the data key for a purpose, creating it the first time it is needed
+func (db *Database) loadDataKey(keys *Keyring, purpose string) ([]byte, error) {
+	var wrappedKey []byte
+	var keyID string
+	var version int
+	query := `SELECT AESKey, KeyID, KeyWrapVersion FROM datakey WHERE Purpose = ?`
+	err := db.QueryRow(query, purpose).Scan(&wrappedKey, &keyID, &version)
+	if err == sql.ErrNoRows {
+		dataKey, err := generateAESKey()
+		if err != nil {
+			return nil, fmt.Errorf("generating %s data key: %w", purpose, err)
+		}
+		activeID, publicKey := keys.Active()
+		wrappedKey, err := wrapAESKey(publicKey, dataKey)
+		if err != nil {
+			return nil, fmt.Errorf("wrapping %s data key: %w", purpose, err)
+		}
+
+		// Another instance may have created the key first; whichever row won is the one to use
+		_, err = db.Exec(`INSERT IGNORE INTO datakey (Purpose, AESKey, KeyID, KeyWrapVersion, CreatedAt) VALUES (?, ?, ?, ?, ?)`,
+			purpose, wrappedKey, activeID, currentKeyWrap, toDB(db.now()))
+		if err != nil {
+			return nil, fmt.Errorf("storing %s data key: %w", purpose, err)
+		}
+		return db.loadDataKey(keys, purpose)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("querying %s data key: %w", purpose, err)
+	}
+
+	dataKey, err := keys.unwrap(keyID, wrappedKey, version)
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping %s data key: %w", purpose, err)
+	}
+	return dataKey, nil
+}
+
+// loadFieldCipher prepares personal data encryption and encrypts any rows still stored in plaintext
+func (db *Database) loadFieldCipher(keys *Keyring) error {
+	key, err := db.loadDataKey(keys, dataKeyPII)
+	if err != nil {
+		return err
+	}
+	indexKey, err := db.loadDataKey(keys, dataKeyBlindIndex)
+	if err != nil {
+		return err
+	}
+	db.pii = &fieldCipher{key: key, indexKey: indexKey}
+
+	return db.runMigration("encrypt-user-pii", db.encryptUserPII)
+}
+
+// seal encrypts one field; empty values stay NULL
+func (c *fieldCipher) seal(value string) ([]byte, error) {
+	if value == "" {
+		return nil, nil
+	}
+	ciphertext, err := encryptWithAES([]byte(value), c.key)
+	if err != nil {
+		return nil, fmt.Errorf("encrypting field: %w", err)
+	}
+	return ciphertext, nil
+}
+
+// open decrypts one field sealed by seal
+func (c *fieldCipher) open(ciphertext []byte) (string, error) {
+	if ciphertext == nil {
+		return "", nil
+	}
+	plaintext, err := decryptWithAES(ciphertext, c.key)
+	if err != nil {
+		return "", fmt.Errorf("decrypting field: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// blindIndex is a keyed hash of an ID card number, so duplicates can be found without decrypting
+func (c *fieldCipher) blindIndex(idCard string) string {
+	normalized := strings.NewReplacer(" ", "", "-", "").Replace(idCard)
+	mac := hmac.New(sha256.New, c.indexKey)
+	mac.Write([]byte(normalized))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// maskTail hides all but the last visible characters of a value
+func maskTail(value string, visible int) string {
+	runes := []rune(value)
+	if len(runes) <= visible {
+		return strings.Repeat("*", len(runes))
+	}
+	return strings.Repeat("*", len(runes)-visible) + string(runes[len(runes)-visible:])
+}
+
+// maskedPII returns the masked form of each personal data field, in IDCard, BankAccNo, PhoneNo, Address order
+func maskedPII(userAccount UserAccount) [4]string {
+	return [4]string{
+		maskTail(userAccount.IDCard, 4),
+		maskTail(userAccount.BankAccNo, 4),
+		maskTail(userAccount.PhoneNo, 4),
+		maskTail(userAccount.Address, 5),
+	}
+}
+
+// maskPII replaces the personal data fields with their masked form for responses to non-admins
+func (userAccount *UserAccount) maskPII() {
+	masked := maskedPII(*userAccount)
+	userAccount.IDCard, userAccount.BankAccNo, userAccount.PhoneNo, userAccount.Address = masked[0], masked[1], masked[2], masked[3]
+}
+
+// sealedPII is a user's personal data as it is written to the user table
+type sealedPII struct {
+	idCard, bankAccNo, phoneNo, address []byte
+	idCardIndex                         sql.NullString
+	masked                              [4]string
+}
+
+func (c *fieldCipher) sealUser(userAccount UserAccount) (sealedPII, error) {
+	var sealed sealedPII
+	var err error
+	if sealed.idCard, err = c.seal(userAccount.IDCard); err != nil {
+		return sealed, err
+	}
+	if sealed.bankAccNo, err = c.seal(userAccount.BankAccNo); err != nil {
+		return sealed, err
+	}
+	if sealed.phoneNo, err = c.seal(userAccount.PhoneNo); err != nil {
+		return sealed, err
+	}
+	if sealed.address, err = c.seal(userAccount.Address); err != nil {
+		return sealed, err
+	}
+	if userAccount.IDCard != "" {
+		sealed.idCardIndex = sql.NullString{String: c.blindIndex(userAccount.IDCard), Valid: true}
+	}
+	sealed.masked = maskedPII(userAccount)
+	return sealed, nil
+}
+
+// errIDCardRegistered is returned when an ID card number already belongs to another user
+var errIDCardRegistered = errors.New("ID card is already registered")
+
+// mysqlDuplicateKey is the MySQL error number for a unique index violation
+const mysqlDuplicateKey = 1062
+
+// isDuplicateKey reports whether err is a unique index violation on the named index
+func isDuplicateKey(err error, index string) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateKey && strings.Contains(mysqlErr.Message, index)
+}
+
+// makeIDCardIndexUnique replaces the plain ID card index created by earlier versions with a unique one.
+// Users already sharing an ID card have to be sorted out by hand first.
+func (db *Database) makeIDCardIndexUnique(tx *sql.Tx) error {
+	var nonUnique bool
+	err := tx.QueryRow(`SELECT NON_UNIQUE FROM information_schema.STATISTICS
+	                    WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'user' AND INDEX_NAME = 'idx_user_idcardindex' LIMIT 1`).Scan(&nonUnique)
+	if err != nil {
+		return fmt.Errorf("inspecting ID card index: %w", err)
+	}
+	if !nonUnique {
+		return nil
+	}
+
+	var shared sql.NullString
+	err = tx.QueryRow(`SELECT GROUP_CONCAT(Users SEPARATOR '; ') FROM (
+	                       SELECT GROUP_CONCAT(UserID ORDER BY UserID) AS Users FROM user
+	                       WHERE IDCardIndex IS NOT NULL GROUP BY IDCardIndex HAVING COUNT(*) > 1) AS shared`).Scan(&shared)
+	if err != nil {
+		return fmt.Errorf("checking for shared ID cards: %w", err)
+	}
+	if shared.Valid {
+		return fmt.Errorf("these groups of users share an ID card and must be resolved first: %s", shared.String)
+	}
+
+	if _, err := tx.Exec(`DROP INDEX idx_user_idcardindex ON user`); err != nil {
+		return fmt.Errorf("dropping ID card index: %w", err)
+	}
+	if _, err := tx.Exec(`CREATE UNIQUE INDEX idx_user_idcardindex ON user (IDCardIndex)`); err != nil {
+		return fmt.Errorf("creating unique ID card index: %w", err)
+	}
+	return nil
+}
+
+// startCreditScoreHistory records every credit score a user is given from now on, however it is written,
+// and starts each existing user's history with their current score. Earlier scores were never kept.
+func (db *Database) startCreditScoreHistory(tx *sql.Tx) error {
+	triggers := []string{
+		`CREATE TRIGGER user_creditscore_insert AFTER INSERT ON user FOR EACH ROW
+		 BEGIN
+			 IF NEW.CreditScore IS NOT NULL THEN
+				 INSERT INTO creditscorehistory (UserID, Score, RecordedAt) VALUES (NEW.UserID, NEW.CreditScore, UTC_TIMESTAMP());
+			 END IF;
+		 END`,
+		`CREATE TRIGGER user_creditscore_update AFTER UPDATE ON user FOR EACH ROW
+		 BEGIN
+			 IF NEW.CreditScore IS NOT NULL AND NOT (NEW.CreditScore <=> OLD.CreditScore) THEN
+				 INSERT INTO creditscorehistory (UserID, Score, RecordedAt) VALUES (NEW.UserID, NEW.CreditScore, UTC_TIMESTAMP());
+			 END IF;
+		 END`,
+	}
+	for _, trigger := range triggers {
+		if _, err := tx.Exec(trigger); err != nil {
+			return fmt.Errorf("creating credit score trigger: %w", err)
+		}
+	}
+
+	_, err := tx.Exec(`INSERT INTO creditscorehistory (UserID, Score, RecordedAt)
+	                   SELECT UserID, CreditScore, ? FROM user WHERE CreditScore IS NOT NULL`, toDB(db.now()))
+	if err != nil {
+		return fmt.Errorf("recording current credit scores: %w", err)
+	}
+	return nil
+}
+
+// idCardTaken reports whether another user has registered the same ID card number
+func (db *Database) idCardTaken(idCard string, exceptUserID int) (bool, error) {
+	if idCard == "" {
+		return false, nil
+	}
+	var taken bool
+	query := `SELECT EXISTS(SELECT 1 FROM user WHERE IDCardIndex = ? AND UserID != ?)`
+	if err := db.QueryRow(query, db.pii.blindIndex(idCard), exceptUserID).Scan(&taken); err != nil {
+		return false, fmt.Errorf("checking ID card: %w", err)
+	}
+	return taken, nil
+}
+
+// encryptUserPII moves the personal data of users created before field encryption into the encrypted columns
+func (db *Database) encryptUserPII(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT UserID, IDCard, BankAccNo, PhoneNo, Address FROM user`)
+	if err != nil {
+		return fmt.Errorf("querying users: %w", err)
+	}
+
+	type plainUser struct {
+		id      int
+		account UserAccount
+	}
+	var users []plainUser
+	for rows.Next() {
+		var user plainUser
+		var idCard, bankAccNo, phoneNo, address sql.NullString
+		if err := rows.Scan(&user.id, &idCard, &bankAccNo, &phoneNo, &address); err != nil {
+			rows.Close()
+			return fmt.Errorf("scanning user: %w", err)
+		}
+		user.account = UserAccount{IDCard: idCard.String, BankAccNo: bankAccNo.String, PhoneNo: phoneNo.String, Address: address.String}
+		users = append(users, user)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	for _, user := range users {
+		sealed, err := db.pii.sealUser(user.account)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE user SET IDCard = ?, BankAccNo = ?, PhoneNo = ?, Address = ?,
+		                         IDCardEnc = ?, BankAccNoEnc = ?, PhoneNoEnc = ?, AddressEnc = ?, IDCardIndex = ?
+		                  WHERE UserID = ?`,
+			sealed.masked[0], sealed.masked[1], sealed.masked[2], sealed.masked[3],
+			sealed.idCard, sealed.bankAccNo, sealed.phoneNo, sealed.address, sealed.idCardIndex, user.id)
+		if isDuplicateKey(err, "idx_user_idcardindex") {
+			return fmt.Errorf("user %d has the same ID card as another user, which must be resolved first", user.id)
+		}
+		if err != nil {
+			return fmt.Errorf("encrypting user %d: %w", user.id, err)
+		}
+	}
+	return nil
+}
+
+//USER
+
+// UpdateUserInfo updates user information. A personal data field sent back exactly as GetUserInfo masked
+// it keeps its stored value, so forms filled from a masked response do not overwrite the real data.
+func (db *Database) UpdateUserInfo(userID int, userAccount UserAccount) error {
+	current, err := db.GetUserInfo(userID)
+	if err != nil {
+		return err
+	}
+	masked := maskedPII(*current)
+	fields := []struct{ submitted, stored *string }{
+		{&userAccount.IDCard, &current.IDCard},
+		{&userAccount.BankAccNo, &current.BankAccNo},
+		{&userAccount.PhoneNo, &current.PhoneNo},
+		{&userAccount.Address, &current.Address},
+	}
+	for i, field := range fields {
+		if *field.submitted == masked[i] {
+			*field.submitted = *field.stored
+		}
+	}
+
+	taken, err := db.idCardTaken(userAccount.IDCard, userID)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return errIDCardRegistered
+	}
+	sealed, err := db.pii.sealUser(userAccount)
+	if err != nil {
+		return err
+	}
+
+	query := `UPDATE user SET FirstName = ?, LastName = ?, IDCard = ?, DOB = ?, PhoneNo = ?, Address = ?, BankName = ?, BankAccNo = ?,
+			         IDCardEnc = ?, BankAccNoEnc = ?, PhoneNoEnc = ?, AddressEnc = ?, IDCardIndex = ?
+			  WHERE UserID = ?`
+	_, err = db.Exec(query, userAccount.FirstName, userAccount.LastName, sealed.masked[0], userAccount.DOB, sealed.masked[2],
+		sealed.masked[3], userAccount.BankName, sealed.masked[1],
+		sealed.idCard, sealed.bankAccNo, sealed.phoneNo, sealed.address, sealed.idCardIndex, userID)
+	if isDuplicateKey(err, "idx_user_idcardindex") {
+		return errIDCardRegistered
+	}
+	if err != nil {
+		return fmt.Errorf("updating user info: %w", err)
+	}
+	return nil
+}
+
+// GetUserInfo retrieves user information by user ID, including username from the account table.
+// Personal data fields are decrypted in full; callers mask them for anyone but admins.
+func (db *Database) GetUserInfo(userID int) (*UserAccount, error) {
+	var userAccount UserAccount
+	var idCard, phoneNo, address, bankAccNo []byte
+
+	// Query to get user information, including username from the account table
+	query := `
+		SELECT u.FirstName, u.LastName, u.IDCardEnc, u.DOB, u.PhoneNoEnc, u.AddressEnc, u.CreditScore, 
+		       u.BankName, u.BankAccNoEnc, a.Username
+		FROM user u
+		JOIN account a ON u.AccountID = a.AccountID
+		WHERE u.UserID = ?`
+
+	err := db.QueryRow(query, userID).Scan(&userAccount.FirstName, &userAccount.LastName, &idCard, &userAccount.DOB,
+		&phoneNo, &address, &userAccount.CreditScore, &userAccount.BankName, &bankAccNo, &userAccount.Username,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("querying user info: %w", err)
+	}
+
+	fields := []struct {
+		ciphertext []byte
+		plaintext  *string
+	}{
+		{idCard, &userAccount.IDCard},
+		{phoneNo, &userAccount.PhoneNo},
+		{address, &userAccount.Address},
+		{bankAccNo, &userAccount.BankAccNo},
+	}
+	for _, field := range fields {
+		if *field.plaintext, err = db.pii.open(field.ciphertext); err != nil {
+			return nil, fmt.Errorf("decrypting user %d: %w", userID, err)
+		}
+	}
+
+	return &userAccount, nil
+}
+
+// GetUserCreditLevel retrieves the credit level of a user based on their credit score
+func (db *Database) GetUserCreditLevel(userID int) (string, error) {
+	band, _, err := db.GetUserRiskBand(userID)
+	if err != nil {
+		return "", err
+	}
+	return band.Color, nil
+}
+
+// GetUserRiskBand returns the risk band a user's credit score falls into, along with the score itself
+func (db *Database) GetUserRiskBand(userID int) (RiskBand, int, error) {
+	var creditScore int
+
+	// Query to get the credit score of the user
+	query := `SELECT CreditScore FROM user WHERE UserID = ?`
+	err := db.QueryRow(query, userID).Scan(&creditScore)
+	if err != nil {
+		return RiskBand{}, 0, fmt.Errorf("querying credit score: %w", err)
+	}
+
+	bands, err := db.GetRiskBands()
+	if err != nil {
+		return RiskBand{}, 0, err
+	}
+
+	return resolveRiskBand(creditScore, bands), creditScore, nil
+}
+
+//RISK BANDS
+
+// GetRiskBands returns the configured risk bands ordered by their lower bound
+func (db *Database) GetRiskBands() ([]RiskBand, error) {
+	rows, err := db.Query(`SELECT MinScore, Color, Label FROM riskband ORDER BY MinScore`)
+	if err != nil {
+		return nil, fmt.Errorf("querying risk bands: %w", err)
+	}
+	defer rows.Close()
+
+	var bands []RiskBand
+	for rows.Next() {
+		var band RiskBand
+		if err := rows.Scan(&band.MinScore, &band.Color, &band.Label); err != nil {
+			return nil, fmt.Errorf("scanning risk band row: %w", err)
+		}
+		bands = append(bands, band)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	if len(bands) == 0 {
+		return nil, fmt.Errorf("no risk bands configured")
+	}
+
+	// Each band ends one point below the start of the next one
+	for i := 0; i < len(bands)-1; i++ {
+		maxScore := bands[i+1].MinScore - 1
+		bands[i].MaxScore = &maxScore
+	}
+
+	return bands, nil
+}
+
+// ReplaceRiskBands swaps the whole risk band configuration for the given bands
+func (db *Database) ReplaceRiskBands(bands []RiskBand) error {
+	if err := validateRiskBands(bands); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM riskband`); err != nil {
+		return fmt.Errorf("deleting risk bands: %w", err)
+	}
+
+	for _, band := range bands {
+		_, err := tx.Exec(`INSERT INTO riskband (MinScore, Color, Label) VALUES (?, ?, ?)`, band.MinScore, band.Color, band.Label)
+		if err != nil {
+			return fmt.Errorf("inserting risk band: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing risk bands: %w", err)
+	}
+	return nil
+}
+
+// Credit scores start at 0 for a new account and are stored in a signed INT column
+const (
+	minCreditScore = 0
+	maxCreditScore = math.MaxInt32
+)
+
+// validateRiskBands checks that the bands cover every score from 0 upwards without overlapping
+func validateRiskBands(bands []RiskBand) error {
+	if len(bands) == 0 {
+		return fmt.Errorf("at least one risk band is required")
+	}
+
+	lowest := bands[0].MinScore
+	seen := make(map[int]bool)
+	for _, band := range bands {
+		if band.MinScore < minCreditScore || band.MinScore > maxCreditScore {
+			return fmt.Errorf("risk band start %d is outside the credit score range %d-%d", band.MinScore, minCreditScore, maxCreditScore)
+		}
+		if band.Color == "" || band.Label == "" {
+			return fmt.Errorf("risk band starting at %d needs a color and a label", band.MinScore)
+		}
+		if seen[band.MinScore] {
+			return fmt.Errorf("more than one risk band starts at %d", band.MinScore)
+		}
+		seen[band.MinScore] = true
+		if band.MinScore < lowest {
+			lowest = band.MinScore
+		}
+	}
+
+	if lowest != minCreditScore {
+		return fmt.Errorf("the lowest risk band must start at %d, got %d", minCreditScore, lowest)
+	}
+	return nil
+}
+
+// resolveRiskBand picks the band whose range contains the score; bands must be ordered by MinScore
+func resolveRiskBand(score int, bands []RiskBand) RiskBand {
+	band := bands[0]
+	for _, b := range bands {
+		if score >= b.MinScore {
+			band = b
+		}
+	}
+	return band
+}
+
+// getRiskFactors explains which band a user landed in and what their history looks like
+func (db *Database) getRiskFactors(userID, creditScore int, band RiskBand) ([]string, error) {
+	var factors []string
+
+	if band.MaxScore != nil {
+		factors = append(factors, fmt.Sprintf("credit score %d is within %d-%d (%s)", creditScore, band.MinScore, *band.MaxScore, band.Label))
+	} else {
+		factors = append(factors, fmt.Sprintf("credit score %d is %d or above (%s)", creditScore, band.MinScore, band.Label))
+	}
+
+	var latePayments int
+	query := `SELECT COUNT(*) FROM payment p JOIN loan l ON p.LoanID = l.LoanID WHERE l.UserID = ? AND p.Status = 'late'`
+	if err := db.QueryRow(query, userID).Scan(&latePayments); err != nil {
+		return nil, fmt.Errorf("counting late payments: %w", err)
+	}
+	if latePayments > 0 {
+		factors = append(factors, fmt.Sprintf("%d late payment(s)", latePayments))
+	}
+
+	var overdueLoans int
+	query = `SELECT COUNT(*) FROM loan WHERE UserID = ? AND Status = 'pending' AND Duedate < ?`
+	if err := db.QueryRow(query, userID, toDB(db.now())).Scan(&overdueLoans); err != nil {
+		return nil, fmt.Errorf("counting overdue loans: %w", err)
+	}
+	if overdueLoans > 0 {
+		factors = append(factors, fmt.Sprintf("%d overdue loan(s)", overdueLoans))
+	}
+
+	return factors, nil
+}
+
+// Updated getAllUserInfoForAdmin function
+func (db *Database) getAllUserInfoForAdmin() ([]UserInfoForAdmin, error) {
+	query := `SELECT u.UserID, a.Username FROM user u JOIN account a ON u.AccountID = a.AccountID`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("querying users: %w", err)
+	}
+	defer rows.Close()
 
 	var users []UserInfoForAdmin
 
@@ -362,18 +1710,32 @@ func (db *Database) getAllUserInfoForAdmin() ([]UserInfoForAdmin, error) {
 			return nil, fmt.Errorf("getting user total loan remain: %w", err)
 		}
 
-		creditLevel, err := db.GetUserCreditLevel(userID)
+		guarantorExposure, err := db.GetUserGuaranteedLoan(userID)
 		if err != nil {
-			return nil, fmt.Errorf("getting user credit level: %w", err)
+			return nil, fmt.Errorf("getting user guarantor exposure: %w", err)
+		}
+
+		band, creditScore, err := db.GetUserRiskBand(userID)
+		if err != nil {
+			return nil, fmt.Errorf("getting user risk band: %w", err)
+		}
+
+		factors, err := db.getRiskFactors(userID, creditScore, band)
+		if err != nil {
+			return nil, fmt.Errorf("getting user risk factors: %w", err)
 		}
 
 		// Create UserInfoForAdmin struct with ordered fields
 		userInfo := UserInfoForAdmin{
-			UserID:          userID,
-			Username:        username,
-			TotalLoan:       totalLoan,
-			TotalLoanRemain: totalLoanRemain,
-			RiskLevel:       creditLevel,
+			UserID:            userID,
+			Username:          username,
+			TotalLoan:         totalLoan,
+			TotalLoanRemain:   totalLoanRemain,
+			GuarantorExposure: guarantorExposure,
+			RiskLevel:         band.Color,
+			CreditScore:       creditScore,
+			RiskBand:          band,
+			RiskFactors:       factors,
 		}
 
 		users = append(users, userInfo)
@@ -438,7 +1800,7 @@ func (db *Database) CreateAdmin(admin Admin) error {
 
 // GetTotalLoan calculates the total loan amount including interest for all pending loans
 func (db *Database) GetTotalLoan() (float64, error) {
-	query := `SELECT Amount, Duedate FROM loan WHERE Status = 'pending'`
+	query := `SELECT Amount, Duedate, ExtensionFee FROM loan WHERE Status = 'pending'`
 	rows, err := db.Query(query)
 	if err != nil {
 		return 0, fmt.Errorf("querying loans: %w", err)
@@ -448,20 +1810,20 @@ func (db *Database) GetTotalLoan() (float64, error) {
 	var totalLoan float64
 
 	for rows.Next() {
-		var amount float64
+		var amount, extensionFee float64
 		var dueDateStr string
 
-		if err := rows.Scan(&amount, &dueDateStr); err != nil {
+		if err := rows.Scan(&amount, &dueDateStr, &extensionFee); err != nil {
 			return 0, fmt.Errorf("scanning loan row: %w", err)
 		}
 
-		dueDate, err := time.Parse("2006-01-02 15:04:05", dueDateStr)
+		dueDate, err := fromDB(dueDateStr)
 		if err != nil {
 			return 0, fmt.Errorf("parsing due date: %w", err)
 		}
 
-		totalAmount, _, _ := calculateLoanDetails(amount, dueDate)
-		totalLoan += totalAmount
+		totalAmount, _, _ := calculateLoanDetails(amount, dueDate, db.now())
+		totalLoan += totalAmount + extensionFee
 	}
 
 	if err := rows.Err(); err != nil {
@@ -473,7 +1835,7 @@ func (db *Database) GetTotalLoan() (float64, error) {
 
 // GetUserTotalLoan calculates the total loan amount for a user including interest with pending status
 func (db *Database) GetUserTotalLoan(userID int) (float64, error) {
-	query := "SELECT Amount, Duedate FROM loan WHERE UserID = ? AND Status = 'pending'"
+	query := "SELECT Amount, Duedate, ExtensionFee FROM loan WHERE UserID = ? AND Status = 'pending'"
 	rows, err := db.Query(query, userID)
 	if err != nil {
 		return 0, fmt.Errorf("querying loans: %w", err)
@@ -483,20 +1845,20 @@ func (db *Database) GetUserTotalLoan(userID int) (float64, error) {
 	var totalLoan float64
 
 	for rows.Next() {
-		var amount float64
+		var amount, extensionFee float64
 		var dueDateStr string
 
-		if err := rows.Scan(&amount, &dueDateStr); err != nil {
+		if err := rows.Scan(&amount, &dueDateStr, &extensionFee); err != nil {
 			return 0, fmt.Errorf("scanning loan row: %w", err)
 		}
 
-		dueDate, err := time.Parse("2006-01-02 15:04:05", dueDateStr)
+		dueDate, err := fromDB(dueDateStr)
 		if err != nil {
 			return 0, fmt.Errorf("parsing due date: %w", err)
 		}
 
-		totalAmount, _, _ := calculateLoanDetails(amount, dueDate)
-		totalLoan += totalAmount
+		totalAmount, _, _ := calculateLoanDetails(amount, dueDate, db.now())
+		totalLoan += totalAmount + extensionFee
 	}
 
 	if err := rows.Err(); err != nil {
@@ -506,9 +1868,9 @@ func (db *Database) GetUserTotalLoan(userID int) (float64, error) {
 	return totalLoan, nil
 }
 
-// GetUserTotalLoanHistory calculates the total loan amount for a user, including interest, across all loan statuses.
+// GetUserTotalLoanHistory calculates the total loan amount for a user, including interest, across all loan statuses except cancelled.
 func (db *Database) GetUserTotalLoanHistory(userID int) (float64, error) {
-	query := `SELECT Amount, Duedate FROM loan WHERE UserID = ?`
+	query := `SELECT Amount, Duedate, ExtensionFee FROM loan WHERE UserID = ? AND Status != 'cancelled'`
 	rows, err := db.Query(query, userID)
 	if err != nil {
 		return 0, fmt.Errorf("querying loans: %w", err)
@@ -520,20 +1882,20 @@ func (db *Database) GetUserTotalLoanHistory(userID int) (float64, error) {
 
 	for rows.Next() {
 		found = true // Set found to true if a row is processed
-		var amount float64
+		var amount, extensionFee float64
 		var dueDateStr string
 
-		if err := rows.Scan(&amount, &dueDateStr); err != nil {
+		if err := rows.Scan(&amount, &dueDateStr, &extensionFee); err != nil {
 			return 0, fmt.Errorf("scanning loan row: %w", err)
 		}
 
-		dueDate, err := time.Parse("2006-01-02 15:04:05", dueDateStr)
+		dueDate, err := fromDB(dueDateStr)
 		if err != nil {
 			return 0, fmt.Errorf("parsing due date: %w", err)
 		}
 
-		totalAmount, _, _ := calculateLoanDetails(amount, dueDate)
-		totalLoan += totalAmount
+		totalAmount, _, _ := calculateLoanDetails(amount, dueDate, db.now())
+		totalLoan += totalAmount + extensionFee
 	}
 
 	if err := rows.Err(); err != nil {
@@ -563,7 +1925,7 @@ func getUserLoans(db *Database) http.HandlerFunc {
 		}
 
 		// Updated query to include LoanID
-		query := `SELECT LoanID, Amount, Duedate, Status FROM loan WHERE UserID = ?`
+		query := `SELECT LoanID, Amount, Duedate, Status, ExtensionFee, DOProcess, DisbursedAt FROM loan WHERE UserID = ?`
 		rows, err := db.Query(query, userID)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("querying loans: %v", err), http.StatusInternalServerError)
@@ -575,30 +1937,51 @@ func getUserLoans(db *Database) http.HandlerFunc {
 
 		for rows.Next() {
 			var loanID int
-			var amount float64
-			var dueDateStr, status string
+			var amount, extensionFee float64
+			var dueDateStr, status, processedStr string
+			var disbursedAt sql.NullString
 
-			if err := rows.Scan(&loanID, &amount, &dueDateStr, &status); err != nil {
+			if err := rows.Scan(&loanID, &amount, &dueDateStr, &status, &extensionFee, &processedStr, &disbursedAt); err != nil {
 				http.Error(w, fmt.Sprintf("scanning loan row: %v", err), http.StatusInternalServerError)
 				return
 			}
 
-			dueDate, err := time.Parse("2006-01-02 15:04:05", dueDateStr)
+			// Only advertise the cooling-off deadline while the loan can still be cancelled
+			var coolingOffUntil string
+			if status == "pending" && !disbursedAt.Valid {
+				processedAt, err := fromDB(processedStr)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("parsing process date: %v", err), http.StatusInternalServerError)
+					return
+				}
+				deadline, err := db.coolingOffUntil(processedAt)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				if db.now().Before(deadline) {
+					coolingOffUntil = db.formatAPITime(deadline)
+				}
+			}
+
+			dueDate, err := fromDB(dueDateStr)
 			if err != nil {
 				http.Error(w, fmt.Sprintf("parsing due date: %v", err), http.StatusInternalServerError)
 				return
 			}
 
-			totalAmount, interestAmount, interestRate := calculateLoanDetails(amount, dueDate)
+			totalAmount, interestAmount, interestRate := calculateLoanDetails(amount, dueDate, db.now())
 
 			loans = append(loans, LoanResponse{
-				LoanID:         loanID, // Include the loan ID in the response
-				TotalAmount:    totalAmount,
-				DueDateTime:    dueDate.Format("2006-01-02 15:04:05"),
-				InitialAmount:  amount,
-				InterestRate:   interestRate,
-				InterestAmount: interestAmount,
-				Status:         status, // Include the loan status in the response
+				LoanID:          loanID, // Include the loan ID in the response
+				TotalAmount:     totalAmount + extensionFee,
+				DueDateTime:     db.formatAPITime(dueDate),
+				InitialAmount:   amount,
+				InterestRate:    interestRate,
+				InterestAmount:  interestAmount,
+				ExtensionFee:    extensionFee,
+				Status:          status, // Include the loan status in the response
+				CoolingOffUntil: coolingOffUntil,
 			})
 		}
 
@@ -608,1161 +1991,7613 @@ func getUserLoans(db *Database) http.HandlerFunc {
 }
 
 func (db *Database) checkLoanDetails(request LoanRequest) (LoanResponse, error) {
-	dueDateTime, err := time.Parse("2006-01-02 15:04", request.DueDateTime)
+	dueDateTime, adjusted, err := db.parseDueDate(request.DueDateTime)
 	if err != nil {
 		return LoanResponse{}, fmt.Errorf("parsing DueDateTime: %w", err)
 	}
 
-	totalAmount, interestAmount, interestRate := calculateLoanDetails(request.InitialAmount, dueDateTime)
+	totalAmount, interestAmount, interestRate := calculateLoanDetails(request.InitialAmount, dueDateTime, db.now())
 
-	return LoanResponse{
-		TotalAmount:    totalAmount,
-		DueDateTime:    request.DueDateTime,
-		InitialAmount:  request.InitialAmount,
-		InterestRate:   interestRate,
-		InterestAmount: interestAmount,
-		Status:         "pending",
-	}, nil
+	requiredFrom, err := db.GetSetting("guarantor_required_amount")
+	if err != nil {
+		return LoanResponse{}, err
+	}
+
+	response := LoanResponse{
+		TotalAmount:       totalAmount,
+		DueDateTime:       dueDateTime.In(db.loc).Format(apiDueDateLayout),
+		DueDateAdjusted:   adjusted,
+		InitialAmount:     request.InitialAmount,
+		InterestRate:      interestRate,
+		InterestAmount:    interestAmount,
+		Status:            "pending",
+		GuarantorRequired: request.InitialAmount >= requiredFrom,
+	}
+	if err := db.applyLoanToValue(request, &response); err != nil {
+		return LoanResponse{}, err
+	}
+
+	return response, nil
 }
 
 func (db *Database) applyForLoan(request LoanRequest) (LoanResponse, error) {
-	fmt.Println("Entering /applyForLoan handler")
-	dueDateTime, err := time.Parse("2006-01-02 15:04", request.DueDateTime)
+	dueDateTime, adjusted, err := db.parseDueDate(request.DueDateTime)
 	if err != nil {
 		return LoanResponse{}, fmt.Errorf("parsing DueDateTime: %w", err)
 	}
 
-	totalAmount, interestAmount, interestRate := calculateLoanDetails(request.InitialAmount, dueDateTime)
+	totalAmount, interestAmount, interestRate := calculateLoanDetails(request.InitialAmount, dueDateTime, db.now())
+
+	if err := db.validateGuarantors(request); err != nil {
+		return LoanResponse{}, err
+	}
+
+	var response LoanResponse
+	if err := db.applyLoanToValue(request, &response); err != nil {
+		return LoanResponse{}, err
+	}
+	if err := db.checkExposure(request.UserID, totalAmount); err != nil {
+		return LoanResponse{}, err
+	}
+
+	doProcess := db.now()
 
-	loc, err := time.LoadLocation("Asia/Bangkok")
+	coolingOffUntil, err := db.coolingOffUntil(doProcess)
 	if err != nil {
-		return LoanResponse{}, fmt.Errorf("loading location: %w", err)
+		return LoanResponse{}, err
 	}
-	doProcess := time.Now().In(loc)
-	fmt.Println("doProcess: ", doProcess)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return LoanResponse{}, fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
 
 	query := `INSERT INTO loan (UserID, Amount, Duedate, DOProcess, Status) VALUES (?, ?, ?, ?, ?)`
-	_, err = db.Exec(query, request.UserID, request.InitialAmount, dueDateTime.Format("2006-01-02 15:04:05"), doProcess.Format("2006-01-02 15:04:05"), "pending")
+	result, err := tx.Exec(query, request.UserID, request.InitialAmount, toDB(dueDateTime), toDB(doProcess), "pending")
 	if err != nil {
 		return LoanResponse{}, fmt.Errorf("inserting loan: %w", err)
 	}
 
-	return LoanResponse{
-		TotalAmount:    totalAmount,
-		DueDateTime:    request.DueDateTime,
-		InitialAmount:  request.InitialAmount,
-		InterestRate:   interestRate,
-		InterestAmount: interestAmount,
-		Status:         "pending",
-	}, nil
+	loanID, err := result.LastInsertId()
+	if err != nil {
+		return LoanResponse{}, fmt.Errorf("getting last insert ID: %w", err)
+	}
+
+	for _, item := range request.Collateral {
+		_, err := tx.Exec(`INSERT INTO collateral (LoanID, AssetType, Description, DeclaredValue, Status) VALUES (?, ?, ?, ?, 'pledged')`,
+			loanID, item.AssetType, item.Description, item.DeclaredValue)
+		if err != nil {
+			return LoanResponse{}, fmt.Errorf("inserting collateral: %w", err)
+		}
+	}
+
+	// Each guarantor has to accept through their own session before the loan can be disbursed
+	for _, guarantorID := range request.GuarantorIDs {
+		_, err := tx.Exec(`INSERT INTO loanguarantor (LoanID, GuarantorUserID, Status) VALUES (?, ?, 'invited')`, loanID, guarantorID)
+		if err != nil {
+			return LoanResponse{}, fmt.Errorf("inserting guarantor: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return LoanResponse{}, fmt.Errorf("committing loan: %w", err)
+	}
+
+	response.LoanID = int(loanID)
+	response.TotalAmount = totalAmount
+	response.DueDateTime = dueDateTime.In(db.loc).Format(apiDueDateLayout)
+	response.DueDateAdjusted = adjusted
+	response.InitialAmount = request.InitialAmount
+	response.InterestRate = interestRate
+	response.InterestAmount = interestAmount
+	response.Status = "pending"
+	response.CoolingOffUntil = db.formatAPITime(coolingOffUntil)
+	return response, nil
 }
 
-// Helper function to generate the RSA key pair
-// GenerateRSAKeys generates an RSA key pair and saves them to files
-func GenerateRSAKeys() (*rsa.PrivateKey, *rsa.PublicKey, error) {
-	// Generate a private key
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+//GUARANTOR
+
+// GuaranteeRequest struct represents a loan a user has been asked to guarantee
+type GuaranteeRequest struct {
+	LoanID         int     `json:"loan_id"`
+	BorrowerID     int     `json:"borrower_id"`
+	BorrowerName   string  `json:"borrower_username"`
+	InitialAmount  float64 `json:"initial_amount"`
+	TotalAmount    float64 `json:"total"`
+	DueDateTime    string  `json:"due_date_time"`
+	LoanStatus     string  `json:"loan_status"`
+	GuaranteeState string  `json:"guarantee_status"`
+}
+
+// validateGuarantors applies the lending policy on guarantors to a loan application
+func (db *Database) validateGuarantors(request LoanRequest) error {
+	requiredFrom, err := db.GetSetting("guarantor_required_amount")
 	if err != nil {
-		return nil, nil, fmt.Errorf("error generating private key: %w", err)
+		return err
+	}
+	if request.InitialAmount >= requiredFrom && len(request.GuarantorIDs) == 0 {
+		return fmt.Errorf("loans of %.2f or more need at least one guarantor", requiredFrom)
 	}
 
-	// Save the private key to a file
-	privateKeyFile, err := os.Create("private_key.pem")
-	if err != nil {
-		return nil, nil, fmt.Errorf("error creating private key file: %w", err)
+	seen := make(map[int]bool)
+	for _, guarantorID := range request.GuarantorIDs {
+		if guarantorID == request.UserID {
+			return fmt.Errorf("borrowers cannot guarantee their own loan")
+		}
+		if seen[guarantorID] {
+			return fmt.Errorf("guarantor %d is listed more than once", guarantorID)
+		}
+		seen[guarantorID] = true
+
+		var exists bool
+		if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM user WHERE UserID = ?)`, guarantorID).Scan(&exists); err != nil {
+			return fmt.Errorf("checking guarantor existence: %w", err)
+		}
+		if !exists {
+			return fmt.Errorf("guarantor %d does not exist", guarantorID)
+		}
 	}
-	defer privateKeyFile.Close()
 
-	privateKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
-	})
-	privateKeyFile.Write(privateKeyPEM)
+	return nil
+}
 
-	// Save the public key to a file
-	publicKey := &privateKey.PublicKey
-	publicKeyFile, err := os.Create("public_key.pem")
+// GetUserGuaranteedLoan calculates the total, including interest, of pending loans a user has accepted to guarantee
+func (db *Database) GetUserGuaranteedLoan(userID int) (float64, error) {
+	query := `SELECT l.Amount, l.Duedate, l.ExtensionFee
+	          FROM loanguarantor g
+	          JOIN loan l ON g.LoanID = l.LoanID
+	          WHERE g.GuarantorUserID = ? AND g.Status = 'accepted' AND l.Status = 'pending'`
+	rows, err := db.Query(query, userID)
 	if err != nil {
-		return nil, nil, fmt.Errorf("error creating public key file: %w", err)
+		return 0, fmt.Errorf("querying guaranteed loans: %w", err)
 	}
-	defer publicKeyFile.Close()
+	defer rows.Close()
 
-	publicKeyBytes, err := x509.MarshalPKIXPublicKey(publicKey)
-	if err != nil {
-		return nil, nil, fmt.Errorf("error marshaling public key: %w", err)
+	var totalLoan float64
+
+	for rows.Next() {
+		var amount, extensionFee float64
+		var dueDateStr string
+
+		if err := rows.Scan(&amount, &dueDateStr, &extensionFee); err != nil {
+			return 0, fmt.Errorf("scanning loan row: %w", err)
+		}
+
+		dueDate, err := fromDB(dueDateStr)
+		if err != nil {
+			return 0, fmt.Errorf("parsing due date: %w", err)
+		}
+
+		totalAmount, _, _ := calculateLoanDetails(amount, dueDate, db.now())
+		totalLoan += totalAmount + extensionFee
+	}
+
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error iterating rows: %w", err)
 	}
-	publicKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "PUBLIC KEY",
-		Bytes: publicKeyBytes,
-	})
-	publicKeyFile.Write(publicKeyPEM)
 
-	return privateKey, publicKey, nil
+	return totalLoan, nil
 }
 
-func loadPublicKey(filename string) (*rsa.PublicKey, error) {
-	// Read the public key file
-	keyBytes, err := os.ReadFile(filename)
+// checkExposure makes sure taking on additional debt, as borrower or guarantor, keeps a user under max_user_exposure
+func (db *Database) checkExposure(userID int, additional float64) error {
+	ownLoans, err := db.GetUserTotalLoan(userID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read public key file: %w", err)
+		return err
+	}
+	guaranteed, err := db.GetUserGuaranteedLoan(userID)
+	if err != nil {
+		return err
+	}
+	limit, err := db.GetSetting("max_user_exposure")
+	if err != nil {
+		return err
 	}
 
-	// Decode the PEM block
-	block, _ := pem.Decode(keyBytes)
-	if block == nil || block.Type != "PUBLIC KEY" {
-		return nil, fmt.Errorf("failed to decode PEM block containing public key")
+	if exposure := ownLoans + guaranteed + additional; exposure > limit {
+		return fmt.Errorf("user %d would owe or guarantee %.2f, above the limit of %.2f", userID, exposure, limit)
 	}
+	return nil
+}
 
-	// Parse the public key
-	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+// GetGuaranteeRequests lists every loan a user has been named as guarantor on, newest first
+func (db *Database) GetGuaranteeRequests(userID int) ([]GuaranteeRequest, error) {
+	query := `SELECT l.LoanID, l.UserID, a.Username, l.Amount, l.Duedate, l.ExtensionFee, l.Status, g.Status
+	          FROM loanguarantor g
+	          JOIN loan l ON g.LoanID = l.LoanID
+	          JOIN user u ON l.UserID = u.UserID
+	          JOIN account a ON u.AccountID = a.AccountID
+	          WHERE g.GuarantorUserID = ?
+	          ORDER BY l.LoanID DESC`
+	rows, err := db.Query(query, userID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse public key: %w", err)
+		return nil, fmt.Errorf("querying guarantee requests: %w", err)
 	}
+	defer rows.Close()
 
-	// Assert the type to *rsa.PublicKey
-	rsaPublicKey, ok := publicKey.(*rsa.PublicKey)
-	if !ok {
-		return nil, fmt.Errorf("not an RSA public key")
+	requests := []GuaranteeRequest{}
+	for rows.Next() {
+		var request GuaranteeRequest
+		var extensionFee float64
+		var dueDateStr string
+		err := rows.Scan(&request.LoanID, &request.BorrowerID, &request.BorrowerName, &request.InitialAmount, &dueDateStr,
+			&extensionFee, &request.LoanStatus, &request.GuaranteeState)
+		if err != nil {
+			return nil, fmt.Errorf("scanning guarantee row: %w", err)
+		}
+
+		dueDate, err := fromDB(dueDateStr)
+		if err != nil {
+			return nil, fmt.Errorf("parsing due date: %w", err)
+		}
+
+		totalAmount, _, _ := calculateLoanDetails(request.InitialAmount, dueDate, db.now())
+		request.TotalAmount = totalAmount + extensionFee
+		request.DueDateTime = db.formatAPITime(dueDate)
+		requests = append(requests, request)
 	}
 
-	return rsaPublicKey, nil
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return requests, nil
 }
 
-func loadPrivateKey(filename string) (*rsa.PrivateKey, error) {
-	keyBytes, err := os.ReadFile(filename)
+// RespondToGuarantee records a guarantor's answer. Declining cancels the loan, since it can no longer be disbursed.
+func (db *Database) RespondToGuarantee(loanID, guarantorID int, accept bool) error {
+	var guaranteeStatus, loanStatus string
+	var amount, extensionFee float64
+	var dueDateStr string
+	query := `SELECT g.Status, l.Status, l.Amount, l.Duedate, l.ExtensionFee
+	          FROM loanguarantor g
+	          JOIN loan l ON g.LoanID = l.LoanID
+	          WHERE g.LoanID = ? AND g.GuarantorUserID = ?`
+	err := db.QueryRow(query, loanID, guarantorID).Scan(&guaranteeStatus, &loanStatus, &amount, &dueDateStr, &extensionFee)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read private key file: %w", err)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("user %d has not been asked to guarantee loan %d", guarantorID, loanID)
+		}
+		return fmt.Errorf("querying guarantee: %w", err)
+	}
+	if guaranteeStatus != "invited" {
+		return fmt.Errorf("guarantee for loan %d has already been %s", loanID, guaranteeStatus)
+	}
+	if loanStatus != "pending" {
+		return fmt.Errorf("loan %d is %s", loanID, loanStatus)
 	}
 
-	block, _ := pem.Decode(keyBytes)
-	if block == nil || block.Type != "RSA PRIVATE KEY" {
-		return nil, fmt.Errorf("failed to decode PEM block containing private key")
+	if accept {
+		dueDate, err := fromDB(dueDateStr)
+		if err != nil {
+			return fmt.Errorf("parsing due date: %w", err)
+		}
+		totalAmount, _, _ := calculateLoanDetails(amount, dueDate, db.now())
+		if err := db.checkExposure(guarantorID, totalAmount+extensionFee); err != nil {
+			return err
+		}
 	}
 
-	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	tx, err := db.Begin()
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse private key: %w", err)
+		return fmt.Errorf("starting transaction: %w", err)
 	}
+	defer tx.Rollback()
 
-	return privateKey, nil
+	newStatus := "declined"
+	if accept {
+		newStatus = "accepted"
+	}
+	_, err = tx.Exec(`UPDATE loanguarantor SET Status = ?, RespondedAt = ? WHERE LoanID = ? AND GuarantorUserID = ?`,
+		newStatus, toDB(db.now()), loanID, guarantorID)
+	if err != nil {
+		return fmt.Errorf("updating guarantee: %w", err)
+	}
+
+	if !accept {
+		result, err := tx.Exec(`UPDATE loan SET Status = 'cancelled' WHERE LoanID = ? AND Status = 'pending' AND DisbursedAt IS NULL`, loanID)
+		if err != nil {
+			return fmt.Errorf("cancelling loan: %w", err)
+		}
+		if n, err := result.RowsAffected(); err == nil && n > 0 {
+			if err := resolveCollateral(tx, loanID, "released", db.now()); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing guarantee response: %w", err)
+	}
+	return nil
 }
 
-// Generate a random AES key
-func generateAESKey() ([]byte, error) {
-	key := make([]byte, 32) // 256-bit AES key
-	_, err := rand.Read(key)
-	if err != nil {
-		return nil, err
+//COLLATERAL
+
+// CollateralItem struct represents an asset pledged against a loan
+type CollateralItem struct {
+	CollateralID  int     `json:"collateral_id,omitempty"`
+	AssetType     string  `json:"asset_type"` // vehicle, gold or property
+	Description   string  `json:"description"`
+	DeclaredValue float64 `json:"declared_value"`
+	Status        string  `json:"status,omitempty"` // pledged, released or seized
+	ResolvedAt    *string `json:"resolved_at,omitempty"`
+	PhotoCount    int     `json:"photo_count"`
+}
+
+// securedLimit returns the most that can be lent against the collateral under the loan-to-value settings
+func (db *Database) securedLimit(items []CollateralItem) (limit float64, totalValue float64, err error) {
+	for _, item := range items {
+		ltv, err := db.GetSetting("ltv_" + item.AssetType)
+		if err != nil {
+			return 0, 0, fmt.Errorf("unsupported asset type %q", item.AssetType)
+		}
+		if item.DeclaredValue <= 0 {
+			return 0, 0, fmt.Errorf("declared value of %s collateral must be positive", item.AssetType)
+		}
+		limit += item.DeclaredValue * ltv
+		totalValue += item.DeclaredValue
 	}
-	return key, nil
+	return roundToTwoDecimalPlaces(limit), totalValue, nil
 }
 
-// Encrypt data using AES-GCM
-func encryptWithAES(data, key []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
+// applyLoanToValue checks a secured loan against its collateral and fills in the LTV figures of the quote
+func (db *Database) applyLoanToValue(request LoanRequest, response *LoanResponse) error {
+	if len(request.Collateral) == 0 {
+		return nil
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	limit, totalValue, err := db.securedLimit(request.Collateral)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if request.InitialAmount > limit {
+		return fmt.Errorf("amount %.2f exceeds the %.2f allowed against the declared collateral", request.InitialAmount, limit)
 	}
 
-	nonce := make([]byte, gcm.NonceSize())
-	_, err = io.ReadFull(rand.Reader, nonce)
+	response.SecuredLimit = limit
+	response.LoanToValue = roundToTwoDecimalPlaces(request.InitialAmount / totalValue)
+	return nil
+}
+
+// GetLoanCollateral lists the collateral pledged against a loan
+func (db *Database) GetLoanCollateral(loanID int) ([]CollateralItem, error) {
+	query := `SELECT c.CollateralID, c.AssetType, c.Description, c.DeclaredValue, c.Status, c.ResolvedAt,
+	                 (SELECT COUNT(*) FROM collateralphoto p WHERE p.CollateralID = c.CollateralID)
+	          FROM collateral c
+	          WHERE c.LoanID = ?
+	          ORDER BY c.CollateralID`
+	rows, err := db.Query(query, loanID)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("querying collateral: %w", err)
 	}
+	defer rows.Close()
 
-	ciphertext := gcm.Seal(nonce, nonce, data, nil)
-	return ciphertext, nil
+	items := []CollateralItem{}
+	for rows.Next() {
+		var item CollateralItem
+		var resolvedAt sql.NullString
+		err := rows.Scan(&item.CollateralID, &item.AssetType, &item.Description, &item.DeclaredValue, &item.Status, &resolvedAt, &item.PhotoCount)
+		if err != nil {
+			return nil, fmt.Errorf("scanning collateral row: %w", err)
+		}
+		if resolvedAt.Valid {
+			resolved, err := db.dbToAPITime(resolvedAt.String)
+			if err != nil {
+				return nil, fmt.Errorf("parsing collateral resolution date: %w", err)
+			}
+			item.ResolvedAt = &resolved
+		}
+		items = append(items, item)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return items, nil
 }
 
-// Decrypt data using AES-GCM
-func decryptWithAES(ciphertext, key []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
+// resolveCollateral moves all still-pledged collateral of a loan to released or seized
+func resolveCollateral(tx *sql.Tx, loanID int, status string, now time.Time) error {
+	_, err := tx.Exec(`UPDATE collateral SET Status = ?, ResolvedAt = ? WHERE LoanID = ? AND Status = 'pledged'`,
+		status, toDB(now), loanID)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("marking collateral %s: %w", status, err)
 	}
+	return nil
+}
 
-	gcm, err := cipher.NewGCM(block)
+// MarkLoanDefaulted records that an overdue loan has defaulted and seizes its collateral.
+// The loan stays pending, since the balance is still owed after the seizure.
+func (db *Database) MarkLoanDefaulted(loanID int) error {
+	var dueDateStr, status string
+	var defaultedAt sql.NullString
+	err := db.QueryRow(`SELECT Duedate, Status, DefaultedAt FROM loan WHERE LoanID = ?`, loanID).Scan(&dueDateStr, &status, &defaultedAt)
 	if err != nil {
-		return nil, err
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("no loan found for LoanID %d", loanID)
+		}
+		return fmt.Errorf("querying loan: %w", err)
+	}
+	if status != "pending" || defaultedAt.Valid {
+		return fmt.Errorf("loan %d is not an open loan", loanID)
 	}
 
-	nonceSize := gcm.NonceSize()
-	if len(ciphertext) < nonceSize {
-		return nil, errors.New("ciphertext too short")
+	dueDate, err := fromDB(dueDateStr)
+	if err != nil {
+		return fmt.Errorf("parsing due date: %w", err)
+	}
+	if db.now().Before(dueDate) {
+		return fmt.Errorf("loan %d is not overdue yet", loanID)
 	}
 
-	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	tx, err := db.Begin()
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("starting transaction: %w", err)
 	}
+	defer tx.Rollback()
 
-	return plaintext, nil
+	_, err = tx.Exec(`UPDATE loan SET DefaultedAt = ? WHERE LoanID = ?`, toDB(db.now()), loanID)
+	if err != nil {
+		return fmt.Errorf("marking loan defaulted: %w", err)
+	}
+	if err := resolveCollateral(tx, loanID, "seized", db.now()); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing default: %w", err)
+	}
+	return nil
 }
 
-func decryptReceiptHandler(db *Database, privateKey *rsa.PrivateKey) http.HandlerFunc {
+func addCollateralPhoto(db *Database, keys *Keyring) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Received request to decrypt receipts for LoanID: %s", r.URL.Query().Get("loanID"))
-
-		// Check if the request method is GET
-		if r.Method != http.MethodGet {
+		if r.Method != http.MethodPost {
 			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		// Retrieve LoanID from query parameters
-		loanIDStr := r.URL.Query().Get("loanID")
-		if loanIDStr == "" {
-			http.Error(w, "LoanID is required", http.StatusBadRequest)
+		session, err := db.sessionFromRequest(r)
+		if err != nil || session.UserID == 0 {
+			http.Error(w, "A user session is required", http.StatusUnauthorized)
 			return
 		}
 
-		// Convert LoanID to integer
-		loanID, err := strconv.Atoi(loanIDStr)
+		collateralID, err := strconv.Atoi(r.URL.Query().Get("collateralID"))
 		if err != nil {
-			http.Error(w, "Invalid LoanID format", http.StatusBadRequest)
+			http.Error(w, "Invalid CollateralID format", http.StatusBadRequest)
 			return
 		}
 
-		// Query to retrieve all encrypted receipts and AES keys for the given LoanID
-		query := `SELECT Receipt, AESKey FROM payment WHERE LoanID = ?`
-		rows, err := db.Query(query, loanID)
+		var status string
+		var ownerID int
+		query := `SELECT c.Status, l.UserID FROM collateral c JOIN loan l ON l.LoanID = c.LoanID WHERE c.CollateralID = ?`
+		err = db.QueryRow(query, collateralID).Scan(&status, &ownerID)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Error querying receipts: %v", err), http.StatusInternalServerError)
+			if err == sql.ErrNoRows {
+				http.Error(w, "Collateral not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, fmt.Sprintf("Error querying collateral: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if ownerID != session.UserID {
+			http.Error(w, "Photos can only be added by the borrower who pledged the collateral", http.StatusForbidden)
+			return
+		}
+		if status != "pledged" {
+			http.Error(w, "Photos can only be added to pledged collateral", http.StatusBadRequest)
 			return
 		}
-		defer rows.Close()
 
-		var receipts []string
-		for rows.Next() {
-			var encryptedReceipt, encryptedAESKey []byte
-			if err := rows.Scan(&encryptedReceipt, &encryptedAESKey); err != nil {
-				http.Error(w, fmt.Sprintf("Error scanning receipt row: %v", err), http.StatusInternalServerError)
-				return
-			}
+		err = r.ParseMultipartForm(20 << 20) // Limit photo size to 20 MB
+		if err != nil {
+			http.Error(w, "Error parsing form data", http.StatusBadRequest)
+			return
+		}
 
-			// Skip if Receipt or AESKey is NULL
-			if encryptedReceipt == nil || encryptedAESKey == nil {
-				log.Printf("Skipping record with NULL Receipt or AESKey for LoanID: %d", loanID)
-				continue
-			}
+		file, _, err := r.FormFile("photo")
+		if err != nil {
+			http.Error(w, "Error retrieving the file", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
 
-			// Decrypt the AES key using the private key
-			aesKey, err := rsa.DecryptPKCS1v15(rand.Reader, privateKey, encryptedAESKey)
-			if err != nil {
-				log.Printf("Error decrypting AES key for LoanID %d: %v", loanID, err)
-				continue // Skip this record instead of returning an error
-			}
+		photoBytes, err := io.ReadAll(file)
+		if err != nil {
+			http.Error(w, "Error reading the file", http.StatusInternalServerError)
+			return
+		}
 
-			// Decrypt the receipt using the AES key
-			decryptedReceipt, err := decryptWithAES(encryptedReceipt, aesKey)
-			if err != nil {
+		// Photos get the same checks as receipts, which also drops the EXIF and GPS data phones embed
+		normalized, photoType, err := normalizeReceipt(photoBytes)
+		if err == nil && photoType == "application/pdf" {
+			err = fmt.Errorf("collateral photos must be JPEG or PNG")
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid photo: %v", err), http.StatusUnsupportedMediaType)
+			return
+		}
+
+		encrypted, encryptedAESKey, keyID, err := keys.seal(normalized)
+		if err != nil {
+			log.Printf("Error encrypting collateral photo: %v", err)
+			http.Error(w, "Error encrypting photo", http.StatusInternalServerError)
+			return
+		}
+
+		_, err = db.Exec(`INSERT INTO collateralphoto (CollateralID, Photo, AESKey, KeyID, KeyWrapVersion, UploadedAt) VALUES (?, ?, ?, ?, ?, ?)`,
+			collateralID, encrypted[0], encryptedAESKey, keyID, currentKeyWrap, toDB(db.now()))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error inserting collateral photo: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		response := map[string]string{"message": "Collateral photo encrypted and stored successfully"}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func decryptCollateralPhotos(db *Database, keys *Keyring) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		collateralID, err := strconv.Atoi(r.URL.Query().Get("collateralID"))
+		if err != nil {
+			http.Error(w, "Invalid CollateralID format", http.StatusBadRequest)
+			return
+		}
+
+		rows, err := db.Query(`SELECT Photo, AESKey, KeyID, KeyWrapVersion FROM collateralphoto WHERE CollateralID = ? ORDER BY PhotoID`, collateralID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying photos: %v", err), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		photos := []string{}
+		for rows.Next() {
+			var encryptedPhoto, encryptedAESKey []byte
+			var keyID sql.NullString
+			var version int
+			if err := rows.Scan(&encryptedPhoto, &encryptedAESKey, &keyID, &version); err != nil {
+				http.Error(w, fmt.Sprintf("Error scanning photo row: %v", err), http.StatusInternalServerError)
+				return
+			}
+
+			photo, err := keys.open(encryptedPhoto, encryptedAESKey, keyID.String, version)
+			if err != nil {
+				log.Printf("Error decrypting photo for CollateralID %d: %v", collateralID, err)
+				continue
+			}
+			photos = append(photos, base64.StdEncoding.EncodeToString(photo))
+		}
+
+		response := map[string]interface{}{
+			"collateralID": collateralID,
+			"photos":       photos,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+//HOLIDAYS
+
+// Holiday struct represents a public holiday on which no payments are due
+type Holiday struct {
+	Date string `json:"date"` // expected format: "2006-01-02"
+	Name string `json:"name"`
+}
+
+// defaultHolidayFile seeds an empty holiday table on startup
+const defaultHolidayFile = "holidays_th.json"
+
+// loadHolidayFile reads a JSON array of holidays
+func loadHolidayFile(filename string) ([]Holiday, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("reading holiday file: %w", err)
+	}
+
+	var holidays []Holiday
+	if err := json.Unmarshal(data, &holidays); err != nil {
+		return nil, fmt.Errorf("decoding holiday file: %w", err)
+	}
+	return holidays, nil
+}
+
+// ImportHolidays adds or renames the given holidays
+func (db *Database) ImportHolidays(holidays []Holiday) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, holiday := range holidays {
+		if _, err := time.Parse(apiDateLayout, holiday.Date); err != nil {
+			return fmt.Errorf("invalid holiday date %q: %w", holiday.Date, err)
+		}
+		if holiday.Name == "" {
+			return fmt.Errorf("holiday on %s needs a name", holiday.Date)
+		}
+
+		query := `INSERT INTO holiday (HolidayDate, Name) VALUES (?, ?) ON DUPLICATE KEY UPDATE Name = VALUES(Name)`
+		if _, err := tx.Exec(query, holiday.Date, holiday.Name); err != nil {
+			return fmt.Errorf("inserting holiday: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing holidays: %w", err)
+	}
+	return nil
+}
+
+// DeleteHoliday removes a holiday from the calendar
+func (db *Database) DeleteHoliday(date string) error {
+	result, err := db.Exec(`DELETE FROM holiday WHERE HolidayDate = ?`, date)
+	if err != nil {
+		return fmt.Errorf("deleting holiday: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return fmt.Errorf("no holiday on %s", date)
+	}
+	return nil
+}
+
+// GetHolidays lists the holidays of a year, or every holiday when year is 0
+func (db *Database) GetHolidays(year int) ([]Holiday, error) {
+	query := `SELECT DATE_FORMAT(HolidayDate, '%Y-%m-%d'), Name FROM holiday ORDER BY HolidayDate`
+	args := []interface{}{}
+	if year != 0 {
+		query = `SELECT DATE_FORMAT(HolidayDate, '%Y-%m-%d'), Name FROM holiday WHERE YEAR(HolidayDate) = ? ORDER BY HolidayDate`
+		args = append(args, year)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying holidays: %w", err)
+	}
+	defer rows.Close()
+
+	holidays := []Holiday{}
+	for rows.Next() {
+		var holiday Holiday
+		if err := rows.Scan(&holiday.Date, &holiday.Name); err != nil {
+			return nil, fmt.Errorf("scanning holiday row: %w", err)
+		}
+		holidays = append(holidays, holiday)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return holidays, nil
+}
+
+// nextBusinessDay rolls t forward, keeping its wall-clock time, until it lands on a weekday that is not a holiday
+func (db *Database) nextBusinessDay(t time.Time) (time.Time, error) {
+	local := t.In(db.loc)
+
+	// A run of weekends and holidays never gets close to a month, so that window is enough to look at
+	holidays := make(map[string]bool)
+	rows, err := db.Query(`SELECT DATE_FORMAT(HolidayDate, '%Y-%m-%d') FROM holiday WHERE HolidayDate BETWEEN ? AND ?`,
+		local.Format(apiDateLayout), local.AddDate(0, 1, 0).Format(apiDateLayout))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("querying holidays: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var date string
+		if err := rows.Scan(&date); err != nil {
+			return time.Time{}, fmt.Errorf("scanning holiday row: %w", err)
+		}
+		holidays[date] = true
+	}
+	if err := rows.Err(); err != nil {
+		return time.Time{}, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	for local.Weekday() == time.Saturday || local.Weekday() == time.Sunday || holidays[local.Format(apiDateLayout)] {
+		local = local.AddDate(0, 0, 1)
+	}
+	return local, nil
+}
+
+// parseDueDate parses a due date entered by a borrower and moves it to the next business day if needed
+func (db *Database) parseDueDate(value string) (dueDate time.Time, adjusted bool, err error) {
+	requested, err := db.parseAPITime(apiDueDateLayout, value)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	dueDate, err = db.nextBusinessDay(requested)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return dueDate, !dueDate.Equal(requested), nil
+}
+
+//COOLING-OFF
+
+// coolingOffUntil returns when the right to cancel a loan processed at processedAt runs out
+func (db *Database) coolingOffUntil(processedAt time.Time) (time.Time, error) {
+	hours, err := db.GetSetting("cooling_off_hours")
+	if err != nil {
+		return time.Time{}, err
+	}
+	return processedAt.Add(time.Duration(hours * float64(time.Hour))), nil
+}
+
+// CancelLoan cancels a loan without interest while it is inside its cooling-off window and not yet disbursed.
+// The right expires on its own once the window has passed or the loan has been disbursed.
+func (db *Database) CancelLoan(loanID, userID int) error {
+	var ownerID int
+	var processedStr, status string
+	var disbursedAt sql.NullString
+	query := `SELECT UserID, DOProcess, Status, DisbursedAt FROM loan WHERE LoanID = ?`
+	err := db.QueryRow(query, loanID).Scan(&ownerID, &processedStr, &status, &disbursedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("no loan found for LoanID %d", loanID)
+		}
+		return fmt.Errorf("querying loan: %w", err)
+	}
+
+	if ownerID != userID {
+		return fmt.Errorf("loan %d does not belong to user %d", loanID, userID)
+	}
+	if status != "pending" {
+		return fmt.Errorf("loan %d is %s and cannot be cancelled", loanID, status)
+	}
+	if disbursedAt.Valid {
+		return fmt.Errorf("loan %d has already been disbursed", loanID)
+	}
+
+	processedAt, err := fromDB(processedStr)
+	if err != nil {
+		return fmt.Errorf("parsing process date: %w", err)
+	}
+	deadline, err := db.coolingOffUntil(processedAt)
+	if err != nil {
+		return err
+	}
+	if db.now().After(deadline) {
+		return fmt.Errorf("the cooling-off period for loan %d ended at %s", loanID, db.formatAPITime(deadline))
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Guard against a disbursement that landed between the checks above and this update
+	result, err := tx.Exec(`UPDATE loan SET Status = 'cancelled' WHERE LoanID = ? AND Status = 'pending' AND DisbursedAt IS NULL`, loanID)
+	if err != nil {
+		return fmt.Errorf("cancelling loan: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return fmt.Errorf("loan %d can no longer be cancelled", loanID)
+	}
+
+	_, err = tx.Exec(`UPDATE loanextension SET Status = 'rejected', DecidedAt = ?, AdminNote = 'loan cancelled' WHERE LoanID = ? AND Status = 'pending'`,
+		toDB(db.now()), loanID)
+	if err != nil {
+		return fmt.Errorf("closing pending extensions: %w", err)
+	}
+	if err := resolveCollateral(tx, loanID, "released", db.now()); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing cancellation: %w", err)
+	}
+	return nil
+}
+
+// DisburseLoan records that the money has been paid out, which ends the borrower's right to cancel.
+// Loans with guarantors are only disbursed once every guarantor has accepted.
+func (db *Database) DisburseLoan(loanID int) error {
+	var unaccepted int
+	query := `SELECT COUNT(*) FROM loanguarantor WHERE LoanID = ? AND Status != 'accepted'`
+	if err := db.QueryRow(query, loanID).Scan(&unaccepted); err != nil {
+		return fmt.Errorf("checking guarantors: %w", err)
+	}
+	if unaccepted > 0 {
+		return fmt.Errorf("loan %d still has %d guarantor(s) who have not accepted", loanID, unaccepted)
+	}
+
+	result, err := db.Exec(`UPDATE loan SET DisbursedAt = ? WHERE LoanID = ? AND Status = 'pending' AND DisbursedAt IS NULL`,
+		toDB(db.now()), loanID)
+	if err != nil {
+		return fmt.Errorf("disbursing loan: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return fmt.Errorf("loan %d is not a pending loan awaiting disbursement", loanID)
+	}
+	return nil
+}
+
+//LOAN EXTENSION
+
+// ExtensionRequest struct represents a borrower's request to push back a loan's due date
+type ExtensionRequest struct {
+	LoanID         int    `json:"loan_id"`
+	UserID         int    `json:"-"`                 // the borrower's session, never the request body
+	NewDueDateTime string `json:"new_due_date_time"` // expected format: "2006-01-02 15:04"
+}
+
+// LoanExtension struct keeps the loan terms before and after an extension side by side
+type LoanExtension struct {
+	ExtensionID  int          `json:"extension_id"`
+	LoanID       int          `json:"loan_id"`
+	Status       string       `json:"status"`
+	RequestedAt  string       `json:"requested_at"`
+	DecidedAt    *string      `json:"decided_at"`
+	AdminNote    string       `json:"admin_note"`
+	ExtensionFee float64      `json:"extension_fee"`
+	Original     LoanResponse `json:"original_terms"`
+	Amended      LoanResponse `json:"amended_terms"`
+
+	originalDueDate time.Time
+	newDueDate      time.Time
+}
+
+// quoteLoanExtension prices an extension with the same calculation checkLoanDetails uses
+func (db *Database) quoteLoanExtension(request ExtensionRequest) (LoanExtension, error) {
+	newDueDate, _, err := db.parseDueDate(request.NewDueDateTime)
+	if err != nil {
+		return LoanExtension{}, fmt.Errorf("parsing NewDueDateTime: %w", err)
+	}
+
+	var userID int
+	var amount, extensionFee float64
+	var dueDateStr, status string
+	query := `SELECT UserID, Amount, Duedate, Status, ExtensionFee FROM loan WHERE LoanID = ?`
+	err = db.QueryRow(query, request.LoanID).Scan(&userID, &amount, &dueDateStr, &status, &extensionFee)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return LoanExtension{}, fmt.Errorf("no loan found for LoanID %d", request.LoanID)
+		}
+		return LoanExtension{}, fmt.Errorf("querying loan: %w", err)
+	}
+
+	if userID != request.UserID {
+		return LoanExtension{}, fmt.Errorf("loan %d does not belong to user %d", request.LoanID, request.UserID)
+	}
+	if status != "pending" {
+		return LoanExtension{}, fmt.Errorf("only pending loans can be extended, loan %d is %s", request.LoanID, status)
+	}
+
+	dueDate, err := fromDB(dueDateStr)
+	if err != nil {
+		return LoanExtension{}, fmt.Errorf("parsing due date: %w", err)
+	}
+	if !newDueDate.After(dueDate) || !newDueDate.After(db.now()) {
+		return LoanExtension{}, fmt.Errorf("new due date must be later than both now and the current due date")
+	}
+
+	feeRate, err := db.GetSetting("extension_fee_rate")
+	if err != nil {
+		return LoanExtension{}, err
+	}
+	fee := roundToTwoDecimalPlaces(amount * feeRate)
+
+	originalTotal, originalInterest, originalRate := calculateLoanDetails(amount, dueDate, db.now())
+	newTotal, newInterest, newRate := calculateLoanDetails(amount, newDueDate, db.now())
+
+	return LoanExtension{
+		LoanID:          request.LoanID,
+		Status:          "quote",
+		ExtensionFee:    fee,
+		originalDueDate: dueDate,
+		newDueDate:      newDueDate,
+		Original: LoanResponse{
+			LoanID:         request.LoanID,
+			TotalAmount:    originalTotal + extensionFee,
+			DueDateTime:    db.formatAPITime(dueDate),
+			InitialAmount:  amount,
+			InterestRate:   originalRate,
+			InterestAmount: originalInterest,
+			ExtensionFee:   extensionFee,
+			Status:         status,
+		},
+		Amended: LoanResponse{
+			LoanID:         request.LoanID,
+			TotalAmount:    newTotal + extensionFee + fee,
+			DueDateTime:    db.formatAPITime(newDueDate),
+			InitialAmount:  amount,
+			InterestRate:   newRate,
+			InterestAmount: newInterest,
+			ExtensionFee:   extensionFee + fee,
+			Status:         status,
+		},
+	}, nil
+}
+
+// RequestLoanExtension stores a quoted extension so an admin can approve or reject it
+func (db *Database) RequestLoanExtension(request ExtensionRequest) (LoanExtension, error) {
+	var pending int
+	query := `SELECT COUNT(*) FROM loanextension WHERE LoanID = ? AND Status = 'pending'`
+	if err := db.QueryRow(query, request.LoanID).Scan(&pending); err != nil {
+		return LoanExtension{}, fmt.Errorf("checking pending extensions: %w", err)
+	}
+	if pending > 0 {
+		return LoanExtension{}, fmt.Errorf("loan %d already has an extension waiting for approval", request.LoanID)
+	}
+
+	extension, err := db.quoteLoanExtension(request)
+	if err != nil {
+		return LoanExtension{}, err
+	}
+
+	requestedAt := db.now()
+	query = `INSERT INTO loanextension (LoanID, RequestedAt, OriginalDuedate, OriginalInterestRate, OriginalInterest, OriginalTotal,
+	          NewDuedate, NewInterestRate, NewInterest, NewTotal, ExtensionFee, Status)
+	          VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 'pending')`
+	result, err := db.Exec(query, extension.LoanID, toDB(requestedAt),
+		toDB(extension.originalDueDate), extension.Original.InterestRate, extension.Original.InterestAmount, extension.Original.TotalAmount,
+		toDB(extension.newDueDate), extension.Amended.InterestRate, extension.Amended.InterestAmount, extension.Amended.TotalAmount,
+		extension.ExtensionFee)
+	if err != nil {
+		return LoanExtension{}, fmt.Errorf("inserting loan extension: %w", err)
+	}
+
+	extensionID, err := result.LastInsertId()
+	if err != nil {
+		return LoanExtension{}, fmt.Errorf("getting last insert ID: %w", err)
+	}
+
+	extension.ExtensionID = int(extensionID)
+	extension.Status = "pending"
+	extension.RequestedAt = db.formatAPITime(requestedAt)
+	return extension, nil
+}
+
+// DecideLoanExtension approves or rejects a pending extension; approval moves the loan's due date and adds the fee
+func (db *Database) DecideLoanExtension(extensionID int, approve bool, note string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var loanID int
+	var status, originalDueDate, newDueDate string
+	var fee float64
+	query := `SELECT LoanID, Status, OriginalDuedate, NewDuedate, ExtensionFee FROM loanextension WHERE ExtensionID = ? FOR UPDATE`
+	err = tx.QueryRow(query, extensionID).Scan(&loanID, &status, &originalDueDate, &newDueDate, &fee)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("no extension found for ExtensionID %d", extensionID)
+		}
+		return fmt.Errorf("querying extension: %w", err)
+	}
+	if status != "pending" {
+		return fmt.Errorf("extension %d has already been %s", extensionID, status)
+	}
+
+	newStatus := "rejected"
+	if approve {
+		newStatus = "approved"
+
+		// Only apply the extension if the loan still has the terms it was quoted against
+		result, err := tx.Exec(`UPDATE loan SET Duedate = ?, ExtensionFee = ExtensionFee + ? WHERE LoanID = ? AND Status = 'pending' AND Duedate = ?`,
+			newDueDate, fee, loanID, originalDueDate)
+		if err != nil {
+			return fmt.Errorf("updating loan due date: %w", err)
+		}
+		updated, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("checking updated loan: %w", err)
+		}
+		if updated == 0 {
+			return fmt.Errorf("loan %d is no longer pending with the quoted due date", loanID)
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE loanextension SET Status = ?, DecidedAt = ?, AdminNote = ? WHERE ExtensionID = ?`,
+		newStatus, toDB(db.now()), note, extensionID)
+	if err != nil {
+		return fmt.Errorf("updating extension status: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing extension decision: %w", err)
+	}
+	return nil
+}
+
+// GetLoanExtensions returns every extension requested for a loan, oldest first
+func (db *Database) GetLoanExtensions(loanID int) ([]LoanExtension, error) {
+	query := `SELECT e.ExtensionID, e.Status, e.RequestedAt, e.DecidedAt, e.AdminNote, e.ExtensionFee,
+	                 e.OriginalDuedate, e.OriginalInterestRate, e.OriginalInterest, e.OriginalTotal,
+	                 e.NewDuedate, e.NewInterestRate, e.NewInterest, e.NewTotal, l.Amount
+	          FROM loanextension e
+	          JOIN loan l ON e.LoanID = l.LoanID
+	          WHERE e.LoanID = ?
+	          ORDER BY e.ExtensionID`
+	rows, err := db.Query(query, loanID)
+	if err != nil {
+		return nil, fmt.Errorf("querying loan extensions: %w", err)
+	}
+	defer rows.Close()
+
+	extensions := []LoanExtension{}
+	for rows.Next() {
+		var extension LoanExtension
+		var decidedAt sql.NullString
+		var amount float64
+		err := rows.Scan(&extension.ExtensionID, &extension.Status, &extension.RequestedAt, &decidedAt, &extension.AdminNote, &extension.ExtensionFee,
+			&extension.Original.DueDateTime, &extension.Original.InterestRate, &extension.Original.InterestAmount, &extension.Original.TotalAmount,
+			&extension.Amended.DueDateTime, &extension.Amended.InterestRate, &extension.Amended.InterestAmount, &extension.Amended.TotalAmount,
+			&amount)
+		if err != nil {
+			return nil, fmt.Errorf("scanning loan extension row: %w", err)
+		}
+
+		extension.LoanID = loanID
+		if decidedAt.Valid {
+			decided, err := db.dbToAPITime(decidedAt.String)
+			if err != nil {
+				return nil, fmt.Errorf("parsing decision date: %w", err)
+			}
+			extension.DecidedAt = &decided
+		}
+		for _, value := range []*string{&extension.RequestedAt, &extension.Original.DueDateTime, &extension.Amended.DueDateTime} {
+			if *value, err = db.dbToAPITime(*value); err != nil {
+				return nil, fmt.Errorf("parsing extension dates: %w", err)
+			}
+		}
+		extension.Original.LoanID = loanID
+		extension.Original.InitialAmount = amount
+		extension.Original.ExtensionFee = roundToTwoDecimalPlaces(extension.Original.TotalAmount - amount - extension.Original.InterestAmount)
+		extension.Amended.LoanID = loanID
+		extension.Amended.InitialAmount = amount
+		extension.Amended.ExtensionFee = extension.Original.ExtensionFee + extension.ExtensionFee
+		extensions = append(extensions, extension)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return extensions, nil
+}
+
+// Helper function to generate the RSA key pair
+// GenerateRSAKeys generates an RSA key pair for the keyring
+func GenerateRSAKeys() (*rsa.PrivateKey, *rsa.PublicKey, error) {
+	// Generate a private key; storing it is up to the key provider
+	privateKey, err := rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error generating private key: %w", err)
+	}
+
+	return privateKey, &privateKey.PublicKey, nil
+}
+
+func loadPublicKey(filename string) (*rsa.PublicKey, error) {
+	// Read the public key file
+	keyBytes, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key file: %w", err)
+	}
+	return parsePublicKeyPEM(keyBytes)
+}
+
+func parsePublicKeyPEM(keyBytes []byte) (*rsa.PublicKey, error) {
+	// Decode the PEM block
+	block, _ := pem.Decode(keyBytes)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("failed to decode PEM block containing public key")
+	}
+
+	// Parse the public key
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+
+	// Assert the type to *rsa.PublicKey
+	rsaPublicKey, ok := publicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("not an RSA public key")
+	}
+
+	return rsaPublicKey, nil
+}
+
+func loadPrivateKey(filename string) (*rsa.PrivateKey, error) {
+	keyBytes, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key file: %w", err)
+	}
+	return parsePrivateKeyPEM(keyBytes, os.Getenv("LOANLOEY_KEY_PASSPHRASE"))
+}
+
+//KEYRING
+
+// Keyring holds the RSA keys that wrap receipt and photo AES keys. Each key is identified by a
+// fingerprint of its public key, which is stored next to every wrapped AES key. Only the active key wraps
+// new keys; the others are kept until the re-wrap job has moved every wrapped key off them.
+// The keyring itself only ever sees public keys: unwrapping is delegated to a KeyProvider, so the
+// private keys can live encrypted on disk, in the environment or behind a KMS.
+type Keyring struct {
+	provider KeyProvider
+
+	mu         sync.RWMutex
+	publicKeys map[string]*rsa.PublicKey
+	activeID   string
+}
+
+// RSAKeyInfo is the public record of a keyring key
+type RSAKeyInfo struct {
+	KeyID       string  `json:"key_id"`
+	Fingerprint string  `json:"fingerprint"` // SHA-256 of the PKIX public key; the key ID is its first 16 hex digits
+	Bits        int     `json:"bits"`
+	Status      string  `json:"status"` // active, inactive or retired
+	CreatedAt   string  `json:"created_at"`
+	ActivatedAt *string `json:"activated_at,omitempty"`
+	RetiredAt   *string `json:"retired_at,omitempty"`
+}
+
+// rsaKeyBits is the size of keys made by `keys generate`
+const rsaKeyBits = 3072
+
+// legacyPrivateKeyFile is the single key pair the server used before it had a keyring
+const legacyPrivateKeyFile = "private_key.pem"
+
+// keyringDir is where the file key provider keeps private keys, one <keyID>.pem per key
+func keyringDir() string {
+	if dir := os.Getenv("LOANLOEY_KEY_DIR"); dir != "" {
+		return dir
+	}
+	return "keys"
+}
+
+// rsaKeyID fingerprints a public key: the first 16 hex digits of the SHA-256 of its PKIX encoding
+func rsaKeyID(publicKey *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", fmt.Errorf("marshaling public key: %w", err)
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// loadKeyring reads the keyring. Keys are only ever added with the `keys` command, so an empty keyring
+// stops startup instead of picking up a private key file lying next to the binary.
+func loadKeyring(db *Database, provider KeyProvider) (*Keyring, error) {
+	var keyCount int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM rsakey`).Scan(&keyCount); err != nil {
+		return nil, fmt.Errorf("counting keyring keys: %w", err)
+	}
+	if keyCount == 0 {
+		return nil, fmt.Errorf("keyring is empty: import the legacy key with `keys import %s`, or create a key with `keys generate`",
+			legacyPrivateKeyFile)
+	}
+
+	keyring := &Keyring{provider: provider}
+	if err := keyring.refresh(db); err != nil {
+		return nil, err
+	}
+
+	// Rows from before the keyring stay unreadable, and are never re-wrapped, until the legacy key is imported
+	untagged, err := db.countUntaggedKeys()
+	if err != nil {
+		return nil, err
+	}
+	if untagged > 0 {
+		log.Printf("%d receipt and photo keys were wrapped before the keyring existed; import the legacy key with `keys import %s` to read them",
+			untagged, legacyPrivateKeyFile)
+	}
+
+	// Fail at startup, not on the first receipt, if the provider cannot use the active key
+	activeID, publicKey := keyring.Active()
+	probe := make([]byte, 32)
+	if _, err := rand.Read(probe); err != nil {
+		return nil, fmt.Errorf("generating probe key: %w", err)
+	}
+	wrapped, err := wrapAESKey(publicKey, probe)
+	if err != nil {
+		return nil, fmt.Errorf("wrapping probe key: %w", err)
+	}
+	unwrapped, err := keyring.unwrap(activeID, wrapped, currentKeyWrap)
+	if err != nil || !bytes.Equal(unwrapped, probe) {
+		return nil, fmt.Errorf("key provider cannot unwrap with active key %s: %v", activeID, err)
+	}
+	return keyring, nil
+}
+
+// legacyKeyTargets are the rows that were wrapped with the single legacy key before the keyring existed;
+// they are the ones whose key ID column is still NULL
+var legacyKeyTargets = []struct {
+	table, keyIDColumn string
+}{
+	{"payment", "AESKeyID"},
+	{"collateralphoto", "KeyID"},
+}
+
+// countUntaggedKeys counts rows still wrapped with a legacy key that is not in the keyring
+func (db *Database) countUntaggedKeys() (int, error) {
+	total := 0
+	for _, target := range legacyKeyTargets {
+		var n int
+		query := fmt.Sprintf(`SELECT COUNT(*) FROM %s WHERE %s IS NULL AND AESKey IS NOT NULL`, target.table, target.keyIDColumn)
+		if err := db.QueryRow(query).Scan(&n); err != nil {
+			return 0, fmt.Errorf("counting untagged %s keys: %w", target.table, err)
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// tagLegacyKeys records keyID on the rows wrapped before the keyring existed, provided the key really is
+// the legacy one: a sample row of each table has to unwrap with it first. This runs on every import, so the
+// legacy key can be imported after other keys have been generated.
+func (db *Database) tagLegacyKeys(provider KeyProvider, keyID string) (int64, error) {
+	var tagged int64
+	for _, target := range legacyKeyTargets {
+		var wrappedKey []byte
+		var version int
+		query := fmt.Sprintf(`SELECT AESKey, KeyWrapVersion FROM %s WHERE %s IS NULL AND AESKey IS NOT NULL LIMIT 1`, target.table, target.keyIDColumn)
+		err := db.QueryRow(query).Scan(&wrappedKey, &version)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return tagged, fmt.Errorf("reading an untagged %s key: %w", target.table, err)
+		}
+		if _, err := provider.Unwrap(keyID, wrappedKey, version); err != nil {
+			continue
+		}
+
+		update := fmt.Sprintf(`UPDATE %s SET %s = ? WHERE %s IS NULL AND AESKey IS NOT NULL`, target.table, target.keyIDColumn, target.keyIDColumn)
+		result, err := db.Exec(update, keyID)
+		if err != nil {
+			return tagged, fmt.Errorf("tagging %s keys with the legacy key: %w", target.table, err)
+		}
+		n, _ := result.RowsAffected()
+		tagged += n
+	}
+	return tagged, nil
+}
+
+// refresh picks up keys added or activated since the keyring was loaded, e.g. by another instance
+func (k *Keyring) refresh(db *Database) error {
+	rows, err := db.Query(`SELECT KeyID, Status, PublicKey FROM rsakey WHERE Status != 'retired'`)
+	if err != nil {
+		return fmt.Errorf("querying keyring: %w", err)
+	}
+	defer rows.Close()
+
+	publicKeys := make(map[string]*rsa.PublicKey)
+	activeID := ""
+	for rows.Next() {
+		var keyID, status, publicKeyPEM string
+		if err := rows.Scan(&keyID, &status, &publicKeyPEM); err != nil {
+			return fmt.Errorf("scanning keyring row: %w", err)
+		}
+
+		publicKey, err := parsePublicKeyPEM([]byte(publicKeyPEM))
+		if err != nil {
+			return fmt.Errorf("parsing key %s: %w", keyID, err)
+		}
+		publicKeys[keyID] = publicKey
+		if status == "active" {
+			activeID = keyID
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows: %w", err)
+	}
+	if activeID == "" {
+		return fmt.Errorf("keyring has no active key")
+	}
+
+	k.mu.Lock()
+	k.publicKeys, k.activeID = publicKeys, activeID
+	k.mu.Unlock()
+	return nil
+}
+
+// Active returns the key new AES keys are wrapped with
+func (k *Keyring) Active() (string, *rsa.PublicKey) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.activeID, k.publicKeys[k.activeID]
+}
+
+// PublicKey returns a key that is still in the keyring
+func (k *Keyring) PublicKey(keyID string) (*rsa.PublicKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	publicKey, ok := k.publicKeys[keyID]
+	return publicKey, ok
+}
+
+// unwrap recovers an AES key wrapped with keyID, refusing keys that are retired or unknown
+func (k *Keyring) unwrap(keyID string, wrappedKey []byte, version int) ([]byte, error) {
+	k.mu.RLock()
+	_, ok := k.publicKeys[keyID]
+	k.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("key %q is not in the keyring", keyID)
+	}
+
+	aesKey, err := k.provider.Unwrap(keyID, wrappedKey, version)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting AES key: %w", err)
+	}
+	return aesKey, nil
+}
+
+// seal encrypts payloads under a fresh AES key wrapped with the active key in the currentKeyWrap format
+func (k *Keyring) seal(parts ...[]byte) (ciphertexts [][]byte, wrappedKey []byte, keyID string, err error) {
+	keyID, publicKey := k.Active()
+	ciphertexts, wrappedKey, err = encryptEnvelopeParts(publicKey, parts...)
+	return ciphertexts, wrappedKey, keyID, err
+}
+
+// open decrypts a payload whose AES key was wrapped with keyID in the given format
+func (k *Keyring) open(ciphertext, wrappedKey []byte, keyID string, version int) ([]byte, error) {
+	aesKey, err := k.unwrap(keyID, wrappedKey, version)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := decryptWithAES(ciphertext, aesKey)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting with AES: %w", err)
+	}
+	return plaintext, nil
+}
+
+// AddRSAKey hands a private key to the key provider and records its public half as inactive
+func (db *Database) AddRSAKey(provider KeyProvider, privateKey *rsa.PrivateKey) (string, error) {
+	keyID, err := rsaKeyID(&privateKey.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return "", fmt.Errorf("marshaling public key: %w", err)
+	}
+	publicKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyBytes})
+
+	if err := provider.Import(keyID, privateKey); err != nil {
+		return "", fmt.Errorf("storing key %s: %w", keyID, err)
+	}
+
+	_, err = db.Exec(`INSERT INTO rsakey (KeyID, PublicKey, Status, CreatedAt) VALUES (?, ?, 'inactive', ?)`,
+		keyID, string(publicKeyPEM), toDB(db.now()))
+	if err != nil {
+		return "", fmt.Errorf("recording key %s: %w", keyID, err)
+	}
+	return keyID, nil
+}
+
+//KEY PROVIDERS
+
+// KeyProvider holds the RSA private keys and performs the one operation that needs them
+type KeyProvider interface {
+	// Unwrap decrypts an AES key wrapped with the key named keyID in the given wrap format
+	Unwrap(keyID string, wrappedKey []byte, version int) ([]byte, error)
+	// Import takes custody of a new private key
+	Import(keyID string, privateKey *rsa.PrivateKey) error
+}
+
+// newKeyProviderFromEnv picks the key provider named by LOANLOEY_KEY_PROVIDER, defaulting to files
+func newKeyProviderFromEnv() (KeyProvider, error) {
+	switch kind := os.Getenv("LOANLOEY_KEY_PROVIDER"); kind {
+	case "", "file":
+		return newFileKeyProvider(keyringDir(), os.Getenv("LOANLOEY_KEY_PASSPHRASE")), nil
+
+	case "env":
+		return newEnvKeyProvider(os.Getenv("LOANLOEY_PRIVATE_KEYS"))
+
+	case "kms":
+		endpoint := strings.TrimRight(os.Getenv("LOANLOEY_KMS_URL"), "/")
+		token := os.Getenv("LOANLOEY_KMS_TOKEN")
+		if endpoint == "" || token == "" {
+			return nil, fmt.Errorf("kms key provider needs LOANLOEY_KMS_URL and LOANLOEY_KMS_TOKEN")
+		}
+		return &kmsKeyProvider{endpoint: endpoint, token: token, client: &http.Client{Timeout: 10 * time.Second}}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown key provider %q, must be file, env or kms", kind)
+	}
+}
+
+// validKeyID accepts only key IDs in the form rsaKeyID produces, so they are safe in paths and URLs
+func validKeyID(keyID string) bool {
+	if len(keyID) != 16 {
+		return false
+	}
+	_, err := hex.DecodeString(keyID)
+	return err == nil
+}
+
+// Passphrase-encrypted private keys use scrypt to derive an AES-GCM key from the passphrase
+const (
+	encryptedKeyPEMType = "ENCRYPTED RSA PRIVATE KEY"
+	scryptN             = 1 << 15
+	scryptR             = 8
+	scryptP             = 1
+)
+
+// encryptPrivateKeyPEM encodes a private key as PEM, encrypted under the passphrase
+func encryptPrivateKeyPEM(privateKey *rsa.PrivateKey, passphrase string) ([]byte, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("generating salt: %w", err)
+	}
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, fmt.Errorf("deriving key: %w", err)
+	}
+	ciphertext, err := encryptWithAES(x509.MarshalPKCS1PrivateKey(privateKey), key)
+	if err != nil {
+		return nil, fmt.Errorf("encrypting private key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:    encryptedKeyPEMType,
+		Headers: map[string]string{"KDF": "scrypt", "Salt": hex.EncodeToString(salt)},
+		Bytes:   ciphertext,
+	}), nil
+}
+
+// parsePrivateKeyPEM reads a plain or passphrase-encrypted RSA private key
+func parsePrivateKeyPEM(data []byte, passphrase string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode PEM block containing private key")
+	}
+
+	der := block.Bytes
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+	case encryptedKeyPEMType:
+		if passphrase == "" {
+			return nil, fmt.Errorf("private key is encrypted and no passphrase is configured")
+		}
+		salt, err := hex.DecodeString(block.Headers["Salt"])
+		if err != nil || block.Headers["KDF"] != "scrypt" {
+			return nil, fmt.Errorf("unsupported encrypted key header")
+		}
+		key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, 32)
+		if err != nil {
+			return nil, fmt.Errorf("deriving key: %w", err)
+		}
+		if der, err = decryptWithAES(block.Bytes, key); err != nil {
+			return nil, fmt.Errorf("wrong passphrase or corrupted key")
+		}
+	default:
+		return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+	}
+
+	privateKey, err := x509.ParsePKCS1PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	return privateKey, nil
+}
+
+// fileKeyProvider keeps private keys as <keyID>.pem files, encrypted with a passphrase when one is set
+type fileKeyProvider struct {
+	dir        string
+	passphrase string
+
+	mu   sync.Mutex
+	keys map[string]*rsa.PrivateKey
+}
+
+func newFileKeyProvider(dir, passphrase string) *fileKeyProvider {
+	return &fileKeyProvider{dir: dir, passphrase: passphrase, keys: make(map[string]*rsa.PrivateKey)}
+}
+
+// privateKey loads a key on first use and keeps it in memory
+func (p *fileKeyProvider) privateKey(keyID string) (*rsa.PrivateKey, error) {
+	if !validKeyID(keyID) {
+		return nil, fmt.Errorf("invalid key ID %q", keyID)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if privateKey, ok := p.keys[keyID]; ok {
+		return privateKey, nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(p.dir, keyID+".pem"))
+	if err != nil {
+		return nil, fmt.Errorf("reading key %s: %w", keyID, err)
+	}
+	privateKey, err := parsePrivateKeyPEM(data, p.passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("loading key %s: %w", keyID, err)
+	}
+	if actualID, err := rsaKeyID(&privateKey.PublicKey); err != nil || actualID != keyID {
+		return nil, fmt.Errorf("key file for %s holds a different key", keyID)
+	}
+
+	p.keys[keyID] = privateKey
+	return privateKey, nil
+}
+
+func (p *fileKeyProvider) Unwrap(keyID string, wrappedKey []byte, version int) ([]byte, error) {
+	privateKey, err := p.privateKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return unwrapAESKey(privateKey, wrappedKey, version)
+}
+
+func (p *fileKeyProvider) Import(keyID string, privateKey *rsa.PrivateKey) error {
+	var data []byte
+	if p.passphrase != "" {
+		var err error
+		if data, err = encryptPrivateKeyPEM(privateKey, p.passphrase); err != nil {
+			return err
+		}
+	} else {
+		log.Printf("LOANLOEY_KEY_PASSPHRASE is not set; key %s is stored unencrypted", keyID)
+		data = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+	}
+
+	if err := os.MkdirAll(p.dir, 0o700); err != nil {
+		return fmt.Errorf("creating key directory: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(p.dir, keyID+".pem"), data, 0o600); err != nil {
+		return fmt.Errorf("writing key: %w", err)
+	}
+
+	p.mu.Lock()
+	p.keys[keyID] = privateKey
+	p.mu.Unlock()
+	return nil
+}
+
+// envKeyProvider reads PEM-encoded private keys from an environment variable, so they are only ever
+// held by the process and whatever secret store injects the variable
+type envKeyProvider struct {
+	keys map[string]*rsa.PrivateKey
+}
+
+func newEnvKeyProvider(value string) (*envKeyProvider, error) {
+	provider := &envKeyProvider{keys: make(map[string]*rsa.PrivateKey)}
+	rest := []byte(value)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		privateKey, err := parsePrivateKeyPEM(pem.EncodeToMemory(block), os.Getenv("LOANLOEY_KEY_PASSPHRASE"))
+		if err != nil {
+			return nil, fmt.Errorf("parsing LOANLOEY_PRIVATE_KEYS: %w", err)
+		}
+		keyID, err := rsaKeyID(&privateKey.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		provider.keys[keyID] = privateKey
+	}
+	if len(provider.keys) == 0 {
+		return nil, fmt.Errorf("LOANLOEY_PRIVATE_KEYS holds no private keys")
+	}
+	return provider, nil
+}
+
+func (p *envKeyProvider) Unwrap(keyID string, wrappedKey []byte, version int) ([]byte, error) {
+	privateKey, ok := p.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("key %s is not in LOANLOEY_PRIVATE_KEYS", keyID)
+	}
+	return unwrapAESKey(privateKey, wrappedKey, version)
+}
+
+// Import only succeeds for keys already supplied through the environment
+func (p *envKeyProvider) Import(keyID string, privateKey *rsa.PrivateKey) error {
+	if _, ok := p.keys[keyID]; !ok {
+		return fmt.Errorf("add key %s to LOANLOEY_PRIVATE_KEYS before importing it", keyID)
+	}
+	return nil
+}
+
+// kmsKeyProvider asks a KMS-style HTTP service to unwrap AES keys; the private keys never leave it.
+// The API is the one served by `go run main.go kms-serve`:
+//
+//	POST /v1/keys/{keyID}         {"private_key": base64 PKCS#1}         imports a key
+//	POST /v1/keys/{keyID}/unwrap  {"wrapped_key": base64, "version": n}  returns {"aes_key": base64}
+type kmsKeyProvider struct {
+	endpoint string
+	token    string
+	client   *http.Client
+}
+
+func (p *kmsKeyProvider) call(path string, request, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("encoding kms request: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, p.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("building kms request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("calling kms: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("kms returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	if response == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return fmt.Errorf("decoding kms response: %w", err)
+	}
+	return nil
+}
+
+func (p *kmsKeyProvider) Unwrap(keyID string, wrappedKey []byte, version int) ([]byte, error) {
+	if !validKeyID(keyID) {
+		return nil, fmt.Errorf("invalid key ID %q", keyID)
+	}
+	var response struct {
+		AESKey []byte `json:"aes_key"`
+	}
+	request := map[string]interface{}{"wrapped_key": wrappedKey, "version": version}
+	if err := p.call("/v1/keys/"+keyID+"/unwrap", request, &response); err != nil {
+		return nil, err
+	}
+	return response.AESKey, nil
+}
+
+func (p *kmsKeyProvider) Import(keyID string, privateKey *rsa.PrivateKey) error {
+	request := map[string]interface{}{"private_key": x509.MarshalPKCS1PrivateKey(privateKey)}
+	return p.call("/v1/keys/"+keyID, request, nil)
+}
+
+// runKMSStandIn serves the kmsKeyProvider API from a file key provider, standing in for a real KMS on
+// a separate host or container. It needs LOANLOEY_KMS_TOKEN; keys live in LOANLOEY_KMS_KEY_DIR
+// (default kms-keys), encrypted with LOANLOEY_KEY_PASSPHRASE when set.
+func runKMSStandIn() error {
+	token := os.Getenv("LOANLOEY_KMS_TOKEN")
+	if token == "" {
+		return fmt.Errorf("LOANLOEY_KMS_TOKEN is required")
+	}
+	dir := os.Getenv("LOANLOEY_KMS_KEY_DIR")
+	if dir == "" {
+		dir = "kms-keys"
+	}
+	addr := os.Getenv("LOANLOEY_KMS_ADDR")
+	if addr == "" {
+		addr = "127.0.0.1:8200"
+	}
+	store := newFileKeyProvider(dir, os.Getenv("LOANLOEY_KEY_PASSPHRASE"))
+
+	log.Printf("KMS stand-in listening on %s with keys in %s", addr, dir)
+	return http.ListenAndServe(addr, kmsStandInHandler(token, store))
+}
+
+// kmsStandInHandler serves the kmsKeyProvider API for the keys in store to callers presenting token
+func kmsStandInHandler(token string, store KeyProvider) http.Handler {
+	authorized := func(r *http.Request) bool {
+		return hmac.Equal([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token))
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/keys/{keyID}", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var request struct {
+			PrivateKey []byte `json:"private_key"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		privateKey, err := x509.ParsePKCS1PrivateKey(request.PrivateKey)
+		if err != nil {
+			http.Error(w, "Invalid private key", http.StatusBadRequest)
+			return
+		}
+		keyID := r.PathValue("keyID")
+		if actualID, err := rsaKeyID(&privateKey.PublicKey); err != nil || actualID != keyID {
+			http.Error(w, "Key ID does not match the key", http.StatusBadRequest)
+			return
+		}
+		if err := store.Import(keyID, privateKey); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	mux.HandleFunc("POST /v1/keys/{keyID}/unwrap", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var request struct {
+			WrappedKey []byte `json:"wrapped_key"`
+			Version    int    `json:"version"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		aesKey, err := store.Unwrap(r.PathValue("keyID"), request.WrappedKey, request.Version)
+		if err != nil {
+			// One generic message, so the service cannot be used as a padding oracle
+			log.Printf("Unwrap with key %s failed: %v", r.PathValue("keyID"), err)
+			http.Error(w, "Unwrap failed", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]byte{"aes_key": aesKey})
+	})
+	return mux
+}
+
+// ActivateRSAKey makes a key the one new AES keys are wrapped with; the previous active key stays
+// available for decryption until the re-wrap job has moved everything off it
+func (db *Database) ActivateRSAKey(keyID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var status string
+	if err := tx.QueryRow(`SELECT Status FROM rsakey WHERE KeyID = ? FOR UPDATE`, keyID).Scan(&status); err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("key %s not found", keyID)
+		}
+		return fmt.Errorf("querying key: %w", err)
+	}
+	if status == "retired" {
+		return fmt.Errorf("key %s is retired", keyID)
+	}
+
+	if _, err := tx.Exec(`UPDATE rsakey SET Status = 'inactive' WHERE Status = 'active'`); err != nil {
+		return fmt.Errorf("deactivating current key: %w", err)
+	}
+	if _, err := tx.Exec(`UPDATE rsakey SET Status = 'active', ActivatedAt = ? WHERE KeyID = ?`, toDB(db.now()), keyID); err != nil {
+		return fmt.Errorf("activating key: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing key activation: %w", err)
+	}
+	return nil
+}
+
+// GetRSAKeys lists the keyring, newest first
+func (db *Database) GetRSAKeys() ([]RSAKeyInfo, error) {
+	rows, err := db.Query(`SELECT KeyID, PublicKey, Status, CreatedAt, ActivatedAt, RetiredAt FROM rsakey ORDER BY CreatedAt DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("querying keyring: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []RSAKeyInfo{}
+	for rows.Next() {
+		var key RSAKeyInfo
+		var publicKeyPEM string
+		var activatedAt, retiredAt sql.NullString
+		if err := rows.Scan(&key.KeyID, &publicKeyPEM, &key.Status, &key.CreatedAt, &activatedAt, &retiredAt); err != nil {
+			return nil, fmt.Errorf("scanning keyring row: %w", err)
+		}
+
+		publicKey, err := parsePublicKeyPEM([]byte(publicKeyPEM))
+		if err != nil {
+			return nil, fmt.Errorf("parsing key %s: %w", key.KeyID, err)
+		}
+		der, err := x509.MarshalPKIXPublicKey(publicKey)
+		if err != nil {
+			return nil, fmt.Errorf("marshaling key %s: %w", key.KeyID, err)
+		}
+		fingerprint := sha256.Sum256(der)
+		key.Fingerprint = hex.EncodeToString(fingerprint[:])
+		key.Bits = publicKey.N.BitLen()
+
+		if key.CreatedAt, err = db.dbToAPITime(key.CreatedAt); err != nil {
+			return nil, fmt.Errorf("parsing key dates: %w", err)
+		}
+		if activatedAt.Valid {
+			activated, err := db.dbToAPITime(activatedAt.String)
+			if err != nil {
+				return nil, fmt.Errorf("parsing activation date: %w", err)
+			}
+			key.ActivatedAt = &activated
+		}
+		if retiredAt.Valid {
+			retired, err := db.dbToAPITime(retiredAt.String)
+			if err != nil {
+				return nil, fmt.Errorf("parsing retirement date: %w", err)
+			}
+			key.RetiredAt = &retired
+		}
+		keys = append(keys, key)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return keys, nil
+}
+
+// GetRSAKey returns a single keyring key
+func (db *Database) GetRSAKey(keyID string) (*RSAKeyInfo, error) {
+	keys, err := db.GetRSAKeys()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if key.KeyID == keyID {
+			return &key, nil
+		}
+	}
+	return nil, fmt.Errorf("key %s not found", keyID)
+}
+
+// RetireRSAKey takes a key out of the keyring for good. The active key and keys that still wrap AES keys
+// cannot be retired; activate another key and let the re-wrap job finish first.
+func (db *Database) RetireRSAKey(keyID string) error {
+	var status string
+	if err := db.QueryRow(`SELECT Status FROM rsakey WHERE KeyID = ?`, keyID).Scan(&status); err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("key %s not found", keyID)
+		}
+		return fmt.Errorf("querying key: %w", err)
+	}
+	switch status {
+	case "active":
+		return fmt.Errorf("key %s is active; activate another key first", keyID)
+	case "retired":
+		return fmt.Errorf("key %s is already retired", keyID)
+	}
+
+	usage, err := db.rsaKeyUsage(keyID)
+	if err != nil {
+		return err
+	}
+	if usage > 0 {
+		return fmt.Errorf("key %s still wraps %d AES keys; run `keys rewrap` first", keyID, usage)
+	}
+
+	_, err = db.Exec(`UPDATE rsakey SET Status = 'retired', RetiredAt = ? WHERE KeyID = ? AND Status = 'inactive'`, toDB(db.now()), keyID)
+	if err != nil {
+		return fmt.Errorf("retiring key: %w", err)
+	}
+	return nil
+}
+
+// rsaKeyUsage counts the wrapped AES keys that can only be unwrapped with keyID
+func (db *Database) rsaKeyUsage(keyID string) (int, error) {
+	var usage int
+	query := `SELECT (SELECT COUNT(*) FROM payment WHERE AESKeyID = ?)
+	               + (SELECT COUNT(*) FROM collateralphoto WHERE KeyID = ?)
+	               + (SELECT COUNT(*) FROM datakey WHERE KeyID = ?)`
+	if err := db.QueryRow(query, keyID, keyID, keyID).Scan(&usage); err != nil {
+		return 0, fmt.Errorf("counting uses of key %s: %w", keyID, err)
+	}
+	return usage, nil
+}
+
+// rsaPublicKeyPEM returns the recorded public key of a keyring key
+func (db *Database) rsaPublicKeyPEM(keyID string) (string, error) {
+	var publicKeyPEM string
+	if err := db.QueryRow(`SELECT PublicKey FROM rsakey WHERE KeyID = ?`, keyID).Scan(&publicKeyPEM); err != nil {
+		if err == sql.ErrNoRows {
+			return "", fmt.Errorf("key %s not found", keyID)
+		}
+		return "", fmt.Errorf("querying key: %w", err)
+	}
+	return publicKeyPEM, nil
+}
+
+// verifyRSAKey checks that the key provider's private key belongs to the recorded public key by
+// wrapping a random AES key with the public key and unwrapping it through the provider
+func (db *Database) verifyRSAKey(provider KeyProvider, keyID string) error {
+	publicKeyPEM, err := db.rsaPublicKeyPEM(keyID)
+	if err != nil {
+		return err
+	}
+	publicKey, err := parsePublicKeyPEM([]byte(publicKeyPEM))
+	if err != nil {
+		return err
+	}
+	if actualID, err := rsaKeyID(publicKey); err != nil || actualID != keyID {
+		return fmt.Errorf("recorded public key does not match key ID")
+	}
+
+	aesKey, err := generateAESKey()
+	if err != nil {
+		return fmt.Errorf("generating AES key: %w", err)
+	}
+	wrappedKey, err := wrapAESKey(publicKey, aesKey)
+	if err != nil {
+		return fmt.Errorf("wrapping AES key: %w", err)
+	}
+	unwrapped, err := provider.Unwrap(keyID, wrappedKey, currentKeyWrap)
+	if err != nil {
+		return fmt.Errorf("unwrapping AES key: %w", err)
+	}
+	if !bytes.Equal(unwrapped, aesKey) {
+		return fmt.Errorf("unwrapped AES key does not match the original")
+	}
+	return nil
+}
+
+// publicKeyJWK describes a keyring public key as a JSON Web Key for RSA-OAEP-256, the form WebCrypto imports
+func publicKeyJWK(keyID string, publicKey *rsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": keyID,
+		"alg": "RSA-OAEP-256",
+		"use": "enc",
+		"n":   base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+	}
+}
+
+// rewrapKeys moves up to batchSize wrapped AES keys from older keys or older wrap formats onto the active
+// key in the current format. The encrypted receipts and photos themselves are untouched; only the small
+// wrapped key changes. A row that cannot be unwrapped is logged and skipped, so one bad row does not hold
+// up the rest.
+func (db *Database) rewrapKeys(keys *Keyring, batchSize int) (int, error) {
+	activeID, publicKey := keys.Active()
+	rewrapped := 0
+
+	targets := []struct {
+		table, idColumn, keyIDColumn string
+	}{
+		{"payment", "PaymentID", "AESKeyID"},
+		{"collateralphoto", "PhotoID", "KeyID"},
+		{"datakey", "DataKeyID", "KeyID"},
+		{"dataexport", "ExportID", "KeyID"},
+	}
+	for _, target := range targets {
+		query := fmt.Sprintf(`SELECT %s, AESKey, %s, KeyWrapVersion FROM %s
+		                      WHERE %s > ? AND (%s != ? OR KeyWrapVersion != ?) AND AESKey IS NOT NULL ORDER BY %s LIMIT ?`,
+			target.idColumn, target.keyIDColumn, target.table, target.idColumn, target.keyIDColumn, target.idColumn)
+		// Skip rows that changed since they were read
+		update := fmt.Sprintf(`UPDATE %s SET AESKey = ?, %s = ?, KeyWrapVersion = ? WHERE %s = ? AND %s = ? AND KeyWrapVersion = ?`,
+			target.table, target.keyIDColumn, target.idColumn, target.keyIDColumn)
+
+		for lastID := 0; rewrapped < batchSize; {
+			rows, err := db.Query(query, lastID, activeID, currentKeyWrap, batchSize-rewrapped)
+			if err != nil {
+				return rewrapped, fmt.Errorf("querying %s keys: %w", target.table, err)
+			}
+
+			type wrapped struct {
+				id      int
+				key     []byte
+				keyID   string
+				version int
+			}
+			var batch []wrapped
+			for rows.Next() {
+				var item wrapped
+				if err := rows.Scan(&item.id, &item.key, &item.keyID, &item.version); err != nil {
+					rows.Close()
+					return rewrapped, fmt.Errorf("scanning %s key: %w", target.table, err)
+				}
+				batch = append(batch, item)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return rewrapped, fmt.Errorf("error iterating rows: %w", err)
+			}
+			if len(batch) == 0 {
+				break
+			}
+
+			for _, item := range batch {
+				lastID = item.id
+				aesKey, err := keys.unwrap(item.keyID, item.key, item.version)
+				if err != nil {
+					log.Printf("Skipping key of %s %d, which cannot be unwrapped with key %q: %v", target.table, item.id, item.keyID, err)
+					continue
+				}
+				newKey, err := wrapAESKey(publicKey, aesKey)
+				if err != nil {
+					return rewrapped, fmt.Errorf("wrapping key of %s %d: %w", target.table, item.id, err)
+				}
+				if _, err := db.Exec(update, newKey, activeID, currentKeyWrap, item.id, item.keyID, item.version); err != nil {
+					return rewrapped, fmt.Errorf("updating %s %d: %w", target.table, item.id, err)
+				}
+				rewrapped++
+			}
+		}
+	}
+	return rewrapped, nil
+}
+
+// keyRewrapInterval is how often the background job looks for keys to re-wrap
+const keyRewrapInterval = 10 * time.Minute
+
+// startKeyRewrapJob keeps the keyring in sync with the database and moves wrapped keys onto the active
+// key in the background, a batch per tick, so rotating keys never needs downtime
+func startKeyRewrapJob(db *Database, keys *Keyring) {
+	go func() {
+		ticker := time.NewTicker(keyRewrapInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := keys.refresh(db); err != nil {
+				log.Printf("Error refreshing keyring: %v", err)
+				continue
+			}
+			for {
+				rewrapped, err := db.rewrapKeys(keys, 100)
+				if err != nil {
+					log.Printf("Error re-wrapping keys: %v", err)
+					break
+				}
+				if rewrapped == 0 {
+					break
+				}
+				log.Printf("Re-wrapped %d keys onto the active key", rewrapped)
+			}
+		}
+	}()
+}
+
+// Generate a random AES key
+func generateAESKey() ([]byte, error) {
+	key := make([]byte, 32) // 256-bit AES key
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Encrypt data using AES-GCM
+func encryptWithAES(data, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext := gcm.Seal(nonce, nonce, data, nil)
+	return ciphertext, nil
+}
+
+// Decrypt data using AES-GCM
+func decryptWithAES(ciphertext, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := gcm.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return plaintext, nil
+}
+
+// Key wrap formats, stored per row so old and new wraps can be told apart
+const (
+	keyWrapPKCS1v15 = 1 // legacy, open to padding-oracle attacks
+	keyWrapOAEP     = 2 // RSA-OAEP with SHA-256
+
+	currentKeyWrap = keyWrapOAEP
+)
+
+// wrapAESKey encrypts an AES key with an RSA public key in the current format
+func wrapAESKey(publicKey *rsa.PublicKey, aesKey []byte) ([]byte, error) {
+	return rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, aesKey, nil)
+}
+
+// unwrapAESKey decrypts an AES key wrapped in the given format
+func unwrapAESKey(privateKey *rsa.PrivateKey, wrappedKey []byte, version int) ([]byte, error) {
+	switch version {
+	case keyWrapPKCS1v15:
+		return rsa.DecryptPKCS1v15(rand.Reader, privateKey, wrappedKey)
+	case keyWrapOAEP:
+		return rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, wrappedKey, nil)
+	default:
+		return nil, fmt.Errorf("unknown key wrap version %d", version)
+	}
+}
+
+// encryptEnvelopeParts encrypts several related payloads, such as a receipt and its thumbnail, under
+// one fresh AES key so a single wrapped key opens all of them
+func encryptEnvelopeParts(publicKey *rsa.PublicKey, parts ...[]byte) (ciphertexts [][]byte, wrappedKey []byte, err error) {
+	aesKey, err := generateAESKey()
+	if err != nil {
+		return nil, nil, fmt.Errorf("generating AES key: %w", err)
+	}
+
+	for _, part := range parts {
+		ciphertext, err := encryptWithAES(part, aesKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("encrypting with AES: %w", err)
+		}
+		ciphertexts = append(ciphertexts, ciphertext)
+	}
+
+	wrappedKey, err = wrapAESKey(publicKey, aesKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("encrypting AES key with RSA: %w", err)
+	}
+
+	return ciphertexts, wrappedKey, nil
+}
+
+func decryptReceiptHandler(db *Database, keys *Keyring) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Received request to decrypt receipts for LoanID: %s", r.URL.Query().Get("loanID"))
+
+		// Check if the request method is GET
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Retrieve LoanID from query parameters
+		loanIDStr := r.URL.Query().Get("loanID")
+		if loanIDStr == "" {
+			http.Error(w, "LoanID is required", http.StatusBadRequest)
+			return
+		}
+
+		// Convert LoanID to integer
+		loanID, err := strconv.Atoi(loanIDStr)
+		if err != nil {
+			http.Error(w, "Invalid LoanID format", http.StatusBadRequest)
+			return
+		}
+
+		// Query to retrieve all encrypted receipts and AES keys for the given LoanID
+		query := `SELECT PaymentID, Receipt, AESKey, AESKeyID, KeyWrapVersion, ReceiptType, BlobKey, ReceiptChecksum FROM payment WHERE LoanID = ?`
+		rows, err := db.Query(query, loanID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying receipts: %v", err), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		var receipts, contentTypes []string
+		tampered := []int{}
+		for rows.Next() {
+			var paymentID int
+			var encryptedReceipt, encryptedAESKey []byte
+			var keyID, receiptType, blobKey, checksum sql.NullString
+			var version int
+			if err := rows.Scan(&paymentID, &encryptedReceipt, &encryptedAESKey, &keyID, &version, &receiptType, &blobKey, &checksum); err != nil {
+				http.Error(w, fmt.Sprintf("Error scanning receipt row: %v", err), http.StatusInternalServerError)
+				return
+			}
+
+			// Receipts whose payment record fails its signature are withheld and reported instead
+			if err := db.verifyPayment(db, paymentID, "receipt decryption"); err != nil {
+				if err == errPaymentTampered {
+					tampered = append(tampered, paymentID)
+				} else {
+					log.Printf("Error verifying payment %d: %v", paymentID, err)
+				}
+				continue
+			}
+
+			encryptedReceipt, err = db.loadReceiptCiphertext(encryptedReceipt, blobKey, checksum)
+			if err != nil && err != sql.ErrNoRows {
+				log.Printf("Error loading receipt for LoanID %d: %v", loanID, err)
+				continue
+			}
+
+			// Skip if Receipt or AESKey is NULL
+			if encryptedReceipt == nil || encryptedAESKey == nil {
+				log.Printf("Skipping record with NULL Receipt or AESKey for LoanID: %d", loanID)
+				continue
+			}
+
+			// Unwrap the AES key with the private key it was wrapped for and decrypt the receipt
+			decryptedReceipt, err := keys.open(encryptedReceipt, encryptedAESKey, keyID.String, version)
+			if err != nil {
 				log.Printf("Error decrypting receipt for LoanID %d: %v", loanID, err)
 				continue // Skip this record instead of returning an error
 			}
 
-			// Encode the decrypted receipt as a Base64 string
-			receipts = append(receipts, base64.StdEncoding.EncodeToString(decryptedReceipt))
+			// Receipts uploaded before types were recorded are sniffed instead
+			if !receiptType.Valid {
+				receiptType.String = http.DetectContentType(decryptedReceipt)
+			}
+
+			// Encode the decrypted receipt as a Base64 string
+			receipts = append(receipts, base64.StdEncoding.EncodeToString(decryptedReceipt))
+			contentTypes = append(contentTypes, receiptType.String)
+		}
+
+		// Return the receipts as a JSON response
+		response := map[string]interface{}{
+			"loanID":             loanID,
+			"receipts":           receipts,
+			"contentTypes":       contentTypes,
+			"tamperedPaymentIDs": tampered,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// ReceiptInfo describes a stored receipt without its content
+type ReceiptInfo struct {
+	PaymentID     int    `json:"payment_id"`
+	DOPayment     string `json:"do_payment"`
+	CheckedStatus string `json:"checked_status"`
+	ContentType   string `json:"content_type"`
+	DownloadURL   string `json:"download_url"`
+	ThumbnailURL  string `json:"thumbnail_url"`
+}
+
+// receiptExtensions maps stored receipt types to download file extensions. HEIC is no longer accepted
+// but receipts uploaded before then are still served.
+var receiptExtensions = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/heic":      ".heic",
+	"application/pdf": ".pdf",
+}
+
+// GetLoanReceipts lists the receipts uploaded for a loan, oldest first
+func (db *Database) GetLoanReceipts(loanID int) ([]ReceiptInfo, error) {
+	query := `SELECT PaymentID, DOPayment, CheckedStatus, ReceiptType FROM payment
+	          WHERE LoanID = ? AND (Receipt IS NOT NULL OR BlobKey IS NOT NULL) ORDER BY PaymentID`
+	rows, err := db.Query(query, loanID)
+	if err != nil {
+		return nil, fmt.Errorf("querying receipts: %w", err)
+	}
+	defer rows.Close()
+
+	receipts := []ReceiptInfo{}
+	for rows.Next() {
+		var receipt ReceiptInfo
+		var receiptType sql.NullString
+		if err := rows.Scan(&receipt.PaymentID, &receipt.DOPayment, &receipt.CheckedStatus, &receiptType); err != nil {
+			return nil, fmt.Errorf("scanning receipt row: %w", err)
+		}
+
+		if receipt.DOPayment, err = db.dbToAPITime(receipt.DOPayment); err != nil {
+			return nil, fmt.Errorf("parsing payment date: %w", err)
+		}
+		receipt.ContentType = receiptType.String
+		if !receiptType.Valid {
+			receipt.ContentType = "application/octet-stream" // uploaded before types were recorded
+		}
+		receipt.DownloadURL = fmt.Sprintf("/receipt?paymentID=%d", receipt.PaymentID)
+		receipt.ThumbnailURL = fmt.Sprintf("/receiptThumbnail?paymentID=%d", receipt.PaymentID)
+		receipts = append(receipts, receipt)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return receipts, nil
+}
+
+// getReceipt decrypts the receipt of a single payment
+func (db *Database) getReceipt(paymentID int, keys *Keyring) (receipt []byte, contentType string, paidAt time.Time, err error) {
+	var encryptedReceipt, encryptedAESKey []byte
+	var keyID, receiptType, blobKey, checksum sql.NullString
+	var doPayment string
+	var version int
+	query := `SELECT Receipt, AESKey, AESKeyID, KeyWrapVersion, ReceiptType, DOPayment, BlobKey, ReceiptChecksum FROM payment WHERE PaymentID = ?`
+	if err := db.QueryRow(query, paymentID).Scan(&encryptedReceipt, &encryptedAESKey, &keyID, &version, &receiptType, &doPayment, &blobKey, &checksum); err != nil {
+		return nil, "", time.Time{}, err
+	}
+	if encryptedAESKey == nil {
+		return nil, "", time.Time{}, sql.ErrNoRows
+	}
+	if err := db.verifyPayment(db, paymentID, "receipt access"); err != nil {
+		return nil, "", time.Time{}, err
+	}
+	if encryptedReceipt, err = db.loadReceiptCiphertext(encryptedReceipt, blobKey, checksum); err != nil {
+		return nil, "", time.Time{}, err
+	}
+
+	if paidAt, err = fromDB(doPayment); err != nil {
+		return nil, "", time.Time{}, fmt.Errorf("parsing payment date: %w", err)
+	}
+
+	receipt, err = keys.open(encryptedReceipt, encryptedAESKey, keyID.String, version)
+	if err != nil {
+		return nil, "", time.Time{}, fmt.Errorf("decrypting receipt: %w", err)
+	}
+
+	contentType = receiptType.String
+	if !receiptType.Valid {
+		contentType = http.DetectContentType(receipt)
+	}
+	return receipt, contentType, paidAt, nil
+}
+
+// receiptDownloadHandler serves one decrypted receipt as a file. AES-GCM has to authenticate the whole
+// ciphertext before any plaintext can be trusted, so the receipt is decrypted in memory and then served
+// with http.ServeContent, which handles Range and conditional requests.
+func receiptDownloadHandler(db *Database, keys *Keyring) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		paymentID, err := strconv.Atoi(r.URL.Query().Get("paymentID"))
+		if err != nil {
+			http.Error(w, "Invalid PaymentID format", http.StatusBadRequest)
+			return
+		}
+
+		receipt, contentType, paidAt, err := db.getReceipt(paymentID, keys)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Receipt not found", http.StatusNotFound)
+				return
+			}
+			if err == errPaymentTampered {
+				http.Error(w, "Payment record failed its integrity check; see /getSecurityEvents", http.StatusConflict)
+				return
+			}
+			log.Printf("Error loading receipt for PaymentID %d: %v", paymentID, err)
+			http.Error(w, "Error loading receipt", http.StatusInternalServerError)
+			return
+		}
+
+		extension, ok := receiptExtensions[contentType]
+		if !ok {
+			extension = ".bin"
+		}
+		filename := fmt.Sprintf("receipt-%d%s", paymentID, extension)
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="%s"`, filename))
+		w.Header().Set("Cache-Control", "private, no-store")
+		http.ServeContent(w, r, filename, paidAt, bytes.NewReader(receipt))
+	}
+}
+
+//EVIDENCE EXPORT
+
+// EvidenceReceipt describes one decrypted receipt in an evidence export
+type EvidenceReceipt struct {
+	PaymentID     int      `json:"payment_id"`
+	LoanID        int      `json:"loan_id"`
+	UserID        int      `json:"user_id"`
+	PaidAt        string   `json:"paid_at"`
+	Status        string   `json:"status"`
+	CheckedStatus string   `json:"checked_status"`
+	AmountDue     *float64 `json:"amount_due,omitempty"`
+	RejectReason  string   `json:"reject_reason,omitempty"`
+	KeyID         string   `json:"key_id"`
+	File          string   `json:"file"`
+	ContentType   string   `json:"content_type"`
+	Size          int      `json:"size"`
+	SHA256        string   `json:"sha256"`
+	// UploadSHA256 is the hash of the file as the borrower uploaded it, before image metadata was stripped
+	UploadSHA256 string `json:"upload_sha256,omitempty"`
+}
+
+// EvidenceManifest lists every file in an evidence export with its hash
+type EvidenceManifest struct {
+	Scope       string            `json:"scope"`
+	GeneratedAt string            `json:"generated_at"`
+	Receipts    []EvidenceReceipt `json:"receipts"`
+}
+
+// Evidence bundle file names
+const (
+	evidenceManifestFile  = "manifest.json"
+	evidenceSignatureFile = "manifest.sig"
+	evidenceSignerFile    = "signer.pub"
+)
+
+// evidenceKeyFile is the Ed25519 key that signs evidence manifests, created on first use
+func evidenceKeyFile() string {
+	if path := os.Getenv("LOANLOEY_EVIDENCE_KEY"); path != "" {
+		return path
+	}
+	return filepath.Join(keyringDir(), "evidence_ed25519.pem")
+}
+
+// loadEvidenceKey reads the evidence signing key, generating it if it does not exist yet
+func loadEvidenceKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("generating evidence key: %w", err)
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+		if err != nil {
+			return nil, fmt.Errorf("marshaling evidence key: %w", err)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return nil, fmt.Errorf("creating evidence key directory: %w", err)
+		}
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+			return nil, fmt.Errorf("writing evidence key: %w", err)
+		}
+		log.Printf("Generated evidence signing key %s", path)
+		return privateKey, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading evidence key: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("failed to decode PEM block containing evidence key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse evidence key: %w", err)
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("evidence key is not an Ed25519 key")
+	}
+	return privateKey, nil
+}
+
+// exportReceipts decrypts the receipts of a loan or of a single payment into dir, which must not exist yet,
+// and writes a manifest. With a signing key it also signs the manifest and packs everything into dir.zip.
+func (db *Database) exportReceipts(keys *Keyring, scope string, id int, dir string, signingKey ed25519.PrivateKey) (*EvidenceManifest, error) {
+	var where string
+	switch scope {
+	case "loan":
+		where = `p.LoanID = ?`
+	case "payment":
+		where = `p.PaymentID = ?`
+	default:
+		return nil, fmt.Errorf("scope must be loan or payment, got %q", scope)
+	}
+
+	query := `SELECT p.PaymentID, p.LoanID, l.UserID, p.Status, p.CheckedStatus, p.AmountDue, p.RejectReason, p.ReceiptHash, p.AESKeyID
+	          FROM payment p
+	          JOIN loan l ON p.LoanID = l.LoanID
+	          WHERE ` + where + ` AND (p.Receipt IS NOT NULL OR p.BlobKey IS NOT NULL)
+	          ORDER BY p.PaymentID`
+	rows, err := db.Query(query, id)
+	if err != nil {
+		return nil, fmt.Errorf("querying receipts: %w", err)
+	}
+	var receipts []EvidenceReceipt
+	for rows.Next() {
+		var receipt EvidenceReceipt
+		var amountDue sql.NullFloat64
+		var rejectReason, uploadHash, keyID sql.NullString
+		err := rows.Scan(&receipt.PaymentID, &receipt.LoanID, &receipt.UserID, &receipt.Status, &receipt.CheckedStatus,
+			&amountDue, &rejectReason, &uploadHash, &keyID)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scanning receipt row: %w", err)
+		}
+		if amountDue.Valid {
+			receipt.AmountDue = &amountDue.Float64
+		}
+		receipt.RejectReason, receipt.UploadSHA256, receipt.KeyID = rejectReason.String, uploadHash.String, keyID.String
+		receipts = append(receipts, receipt)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	if len(receipts) == 0 {
+		return nil, fmt.Errorf("no receipts found for %s %d", scope, id)
+	}
+
+	// Decrypted receipts are personal data: keep them readable by the operator only
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating export directory: %w", err)
+	}
+
+	manifest := &EvidenceManifest{Scope: fmt.Sprintf("%s %d", scope, id), GeneratedAt: db.formatAPITime(db.now())}
+	for _, receipt := range receipts {
+		plaintext, contentType, paidAt, err := db.getReceipt(receipt.PaymentID, keys)
+		if err != nil {
+			return nil, fmt.Errorf("decrypting receipt of payment %d: %w", receipt.PaymentID, err)
+		}
+		extension, ok := receiptExtensions[contentType]
+		if !ok {
+			extension = ".bin"
+		}
+		sum := sha256.Sum256(plaintext)
+
+		receipt.PaidAt = db.formatAPITime(paidAt)
+		receipt.ContentType = contentType
+		receipt.File = fmt.Sprintf("receipt-%d%s", receipt.PaymentID, extension)
+		receipt.Size = len(plaintext)
+		receipt.SHA256 = hex.EncodeToString(sum[:])
+		if err := os.WriteFile(filepath.Join(dir, receipt.File), plaintext, 0o600); err != nil {
+			return nil, fmt.Errorf("writing receipt of payment %d: %w", receipt.PaymentID, err)
+		}
+		manifest.Receipts = append(manifest.Receipts, receipt)
+	}
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("encoding manifest: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, evidenceManifestFile), manifestJSON, 0o600); err != nil {
+		return nil, fmt.Errorf("writing manifest: %w", err)
+	}
+	if signingKey == nil {
+		return manifest, nil
+	}
+
+	// The signature covers the manifest, and the manifest covers every receipt through its hash
+	signature := ed25519.Sign(signingKey, manifestJSON)
+	publicKeyDER, err := x509.MarshalPKIXPublicKey(signingKey.Public())
+	if err != nil {
+		return nil, fmt.Errorf("marshaling evidence public key: %w", err)
+	}
+	files := map[string][]byte{
+		evidenceSignatureFile: []byte(base64.StdEncoding.EncodeToString(signature) + "\n"),
+		evidenceSignerFile:    pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyDER}),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+			return nil, fmt.Errorf("writing %s: %w", name, err)
+		}
+	}
+
+	names := []string{evidenceManifestFile, evidenceSignatureFile, evidenceSignerFile}
+	for _, receipt := range manifest.Receipts {
+		names = append(names, receipt.File)
+	}
+	if err := writeZip(filepath.Clean(dir)+".zip", dir, names); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// writeZip packs the named files from dir into a new zip archive
+func writeZip(path, dir string, names []string) (err error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("creating %s: %w", path, err)
+	}
+	defer func() {
+		if closeErr := file.Close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("closing %s: %w", path, closeErr)
+		}
+	}()
+
+	archive := zip.NewWriter(file)
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", name, err)
+		}
+		entry, err := archive.Create(name)
+		if err != nil {
+			return fmt.Errorf("adding %s: %w", name, err)
+		}
+		if _, err := entry.Write(data); err != nil {
+			return fmt.Errorf("writing %s: %w", name, err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return fmt.Errorf("finishing %s: %w", path, err)
+	}
+	return nil
+}
+
+// verifyEvidence checks a signed evidence bundle, given as its directory or zip file: the manifest
+// signature, then the hash of every receipt. It returns the SHA-256 fingerprint of the signing key,
+// which the recipient compares against the one LoanLoey published.
+func verifyEvidence(path string) (string, *EvidenceManifest, error) {
+	var bundle fs.FS
+	if info, err := os.Stat(path); err != nil {
+		return "", nil, err
+	} else if info.IsDir() {
+		bundle = os.DirFS(path)
+	} else {
+		archive, err := zip.OpenReader(path)
+		if err != nil {
+			return "", nil, fmt.Errorf("opening bundle: %w", err)
+		}
+		defer archive.Close()
+		bundle = archive
+	}
+
+	manifestJSON, err := fs.ReadFile(bundle, evidenceManifestFile)
+	if err != nil {
+		return "", nil, fmt.Errorf("reading manifest: %w", err)
+	}
+	signatureB64, err := fs.ReadFile(bundle, evidenceSignatureFile)
+	if err != nil {
+		return "", nil, fmt.Errorf("reading signature: %w", err)
+	}
+	signerPEM, err := fs.ReadFile(bundle, evidenceSignerFile)
+	if err != nil {
+		return "", nil, fmt.Errorf("reading signer key: %w", err)
+	}
+
+	block, _ := pem.Decode(signerPEM)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return "", nil, fmt.Errorf("failed to decode PEM block containing signer key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to parse signer key: %w", err)
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return "", nil, fmt.Errorf("signer key is not an Ed25519 key")
+	}
+	fingerprint := sha256.Sum256(block.Bytes)
+
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signatureB64)))
+	if err != nil {
+		return "", nil, fmt.Errorf("decoding signature: %w", err)
+	}
+	if !ed25519.Verify(publicKey, manifestJSON, signature) {
+		return "", nil, fmt.Errorf("manifest signature is invalid")
+	}
+
+	var manifest EvidenceManifest
+	if err := json.Unmarshal(manifestJSON, &manifest); err != nil {
+		return "", nil, fmt.Errorf("decoding manifest: %w", err)
+	}
+	for _, receipt := range manifest.Receipts {
+		data, err := fs.ReadFile(bundle, receipt.File)
+		if err != nil {
+			return "", nil, fmt.Errorf("reading %s: %w", receipt.File, err)
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != receipt.SHA256 {
+			return "", nil, fmt.Errorf("%s does not match its hash in the manifest", receipt.File)
+		}
+	}
+	return hex.EncodeToString(fingerprint[:]), &manifest, nil
+}
+
+//DATA SUBJECT EXPORT
+
+// dataExportLinkLifetime is how long the download link of a finished export stays valid
+const dataExportLinkLifetime = 72 * time.Hour
+
+// dataExportPollInterval is how often the export job looks for queued exports and expired links
+const dataExportPollInterval = time.Minute
+
+// dataExportClaimTimeout is how long an export can stay claimed before it is taken to have been abandoned
+// by an instance that stopped, and is built again. It is far longer than any export takes to build.
+const dataExportClaimTimeout = time.Hour
+
+// dataExportManifestFile is the JSON index at the root of every data export ZIP
+const dataExportManifestFile = "manifest.json"
+
+// DataExportManifest is everything held about a borrower. Decrypted receipts and collateral photos are
+// separate files in the ZIP, named by the records that refer to them. Record timestamps are as stored, in UTC.
+type DataExportManifest struct {
+	UserID       int                      `json:"user_id"`
+	GeneratedAt  string                   `json:"generated_at"`
+	Profile      *UserAccount             `json:"profile"`
+	Credit       DataExportCredit         `json:"credit"`
+	Loans        []map[string]interface{} `json:"loans"`
+	Extensions   []map[string]interface{} `json:"loan_extensions"`
+	PayoffQuotes []map[string]interface{} `json:"payoff_quotes"`
+	// GuaranteesGiven are the user's guarantees of other borrowers' loans; LoanGuarantors are the
+	// guarantees on the user's own loans, without the guarantors' identities
+	GuaranteesGiven []map[string]interface{} `json:"guarantees_given"`
+	LoanGuarantors  []map[string]interface{} `json:"loan_guarantors"`
+	Collateral      []map[string]interface{} `json:"collateral"`
+	Photos          []map[string]interface{} `json:"collateral_photos"`
+	Payments        []map[string]interface{} `json:"payments"`
+	AuditLog        []AuditEntry             `json:"audit_log"`
+}
+
+// DataExportCredit is the borrower's credit assessment. History holds every score recorded since the
+// credit-score-history migration; scores from before it were never kept.
+type DataExportCredit struct {
+	Score   int                      `json:"score"`
+	Band    string                   `json:"band"`
+	Factors []string                 `json:"factors"`
+	History []map[string]interface{} `json:"history"`
+}
+
+// DataExport is one data subject access request and where it stands
+type DataExport struct {
+	ExportID    int    `json:"export_id"`
+	UserID      int    `json:"user_id"`
+	Status      string `json:"status"` // pending, running, ready, failed or expired
+	RequestedAt string `json:"requested_at"`
+	CompletedAt string `json:"completed_at,omitempty"`
+	ExpiresAt   string `json:"expires_at,omitempty"`
+	DownloadURL string `json:"download_url,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// buildDataExport assembles everything held about a user into a ZIP
+func (db *Database) buildDataExport(keys *Keyring, userID int) ([]byte, *DataExportManifest, error) {
+	profile, err := db.GetUserInfo(userID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("getting user info: %w", err)
+	}
+	var accountID int
+	if err := db.QueryRow(`SELECT AccountID FROM user WHERE UserID = ?`, userID).Scan(&accountID); err != nil {
+		return nil, nil, fmt.Errorf("getting account of user %d: %w", userID, err)
+	}
+
+	manifest := &DataExportManifest{UserID: userID, GeneratedAt: db.formatAPITime(db.now()), Profile: profile}
+	band, score, err := db.GetUserRiskBand(userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	factors, err := db.getRiskFactors(userID, score, band)
+	if err != nil {
+		return nil, nil, err
+	}
+	manifest.Credit = DataExportCredit{Score: score, Band: band.Label, Factors: factors}
+
+	const userLoans = `(SELECT LoanID FROM loan WHERE UserID = ?)`
+	records := []struct {
+		name   string
+		target *[]map[string]interface{}
+		query  string
+		args   []interface{}
+	}{
+		{"loans", &manifest.Loans, `SELECT LoanID, Amount, Duedate, DOProcess, Status, ExtensionFee, DisbursedAt, DefaultedAt
+		                            FROM loan WHERE UserID = ? ORDER BY LoanID`, []interface{}{userID}},
+		{"loan extensions", &manifest.Extensions, `SELECT * FROM loanextension WHERE LoanID IN ` + userLoans + ` ORDER BY ExtensionID`, []interface{}{userID}},
+		{"payoff quotes", &manifest.PayoffQuotes, `SELECT * FROM payoffquote WHERE LoanID IN ` + userLoans + ` ORDER BY QuoteID`, []interface{}{userID}},
+		{"guarantees given", &manifest.GuaranteesGiven, `SELECT LoanID, Status, RespondedAt FROM loanguarantor
+		                                                 WHERE GuarantorUserID = ? ORDER BY LoanID`, []interface{}{userID}},
+		{"loan guarantors", &manifest.LoanGuarantors, `SELECT LoanID, Status, RespondedAt FROM loanguarantor
+		                                               WHERE LoanID IN ` + userLoans + ` ORDER BY LoanID`, []interface{}{userID}},
+		{"collateral", &manifest.Collateral, `SELECT * FROM collateral WHERE LoanID IN ` + userLoans + ` ORDER BY CollateralID`, []interface{}{userID}},
+		{"collateral photos", &manifest.Photos, `SELECT p.PhotoID, p.CollateralID, p.UploadedAt FROM collateralphoto p
+		                                         JOIN collateral c ON p.CollateralID = c.CollateralID
+		                                         WHERE c.LoanID IN ` + userLoans + ` ORDER BY p.PhotoID`, []interface{}{userID}},
+		{"credit score history", &manifest.Credit.History, `SELECT Score, RecordedAt FROM creditscorehistory
+		                                                   WHERE UserID = ? ORDER BY RecordedAt, HistoryID`, []interface{}{userID}},
+		{"payments", &manifest.Payments, `SELECT PaymentID, LoanID, DOPayment, Status, CheckedStatus, AmountDue, RejectReason, RejectNote,
+		                                         ResubmissionOf, QuoteID, ReceiptType, ReceiptHash
+		                                  FROM payment WHERE LoanID IN ` + userLoans + ` ORDER BY PaymentID`, []interface{}{userID}},
+	}
+	for _, record := range records {
+		if *record.target, err = db.queryRowMaps(record.query, record.args...); err != nil {
+			return nil, nil, fmt.Errorf("querying %s: %w", record.name, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	addFile := func(name string, data []byte) error {
+		f, err := zw.Create(name)
+		if err != nil {
+			return fmt.Errorf("adding %s: %w", name, err)
+		}
+		_, err = f.Write(data)
+		return err
+	}
+
+	// A receipt that cannot be read is reported in its record rather than failing the whole export
+	for _, payment := range manifest.Payments {
+		paymentID, _ := strconv.Atoi(payment["PaymentID"].(string))
+		receipt, contentType, _, err := db.getReceipt(paymentID, keys)
+		if err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				payment["receipt_error"] = err.Error()
+			}
+			continue
+		}
+		extension, ok := receiptExtensions[contentType]
+		if !ok {
+			extension = ".bin"
+		}
+		sum := sha256.Sum256(receipt)
+		payment["receipt_file"] = fmt.Sprintf("receipts/receipt-%d%s", paymentID, extension)
+		payment["receipt_sha256"] = hex.EncodeToString(sum[:])
+		if err := addFile(payment["receipt_file"].(string), receipt); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, photo := range manifest.Photos {
+		var encryptedPhoto, encryptedAESKey []byte
+		var keyID sql.NullString
+		var version int
+		err := db.QueryRow(`SELECT Photo, AESKey, KeyID, KeyWrapVersion FROM collateralphoto WHERE PhotoID = ?`, photo["PhotoID"]).
+			Scan(&encryptedPhoto, &encryptedAESKey, &keyID, &version)
+		if err != nil {
+			return nil, nil, fmt.Errorf("querying collateral photo %v: %w", photo["PhotoID"], err)
+		}
+		plaintext, err := keys.open(encryptedPhoto, encryptedAESKey, keyID.String, version)
+		if err != nil {
+			photo["photo_error"] = err.Error()
+			continue
+		}
+		extension := ".bin"
+		switch http.DetectContentType(plaintext) {
+		case "image/jpeg":
+			extension = ".jpg"
+		case "image/png":
+			extension = ".png"
+		}
+		photo["photo_file"] = fmt.Sprintf("collateral/photo-%v%s", photo["PhotoID"], extension)
+		if err := addFile(photo["photo_file"].(string), plaintext); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if manifest.AuditLog, err = db.subjectAuditLog(userID, accountID); err != nil {
+		return nil, nil, err
+	}
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, nil, fmt.Errorf("encoding manifest: %w", err)
+	}
+	if err := addFile(dataExportManifestFile, manifestJSON); err != nil {
+		return nil, nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, nil, fmt.Errorf("closing zip: %w", err)
+	}
+	return buf.Bytes(), manifest, nil
+}
+
+// subjectAuditLog returns the audit entries about a user: actions they took, and actions on their account,
+// loans and payments. The account and IP of anyone else who acted are left out, as those are not the
+// user's data.
+func (db *Database) subjectAuditLog(userID, accountID int) ([]AuditEntry, error) {
+	userIDStr := strconv.Itoa(userID)
+	rows, err := db.Query(`SELECT `+auditColumns+` FROM auditlog
+	                       WHERE ActorAccountID = ?
+	                          OR (EntityType = 'user' AND EntityID = ?)
+	                          OR (EntityType = 'loan' AND EntityID IN (SELECT CAST(LoanID AS CHAR) FROM loan WHERE UserID = ?))
+	                          OR (EntityType = 'payment' AND EntityID IN
+	                              (SELECT CAST(PaymentID AS CHAR) FROM payment WHERE LoanID IN (SELECT LoanID FROM loan WHERE UserID = ?)))
+	                       ORDER BY AuditID`, accountID, userIDStr, userID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("querying audit log: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		entry, occurredAt, err := scanAuditEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		if entry.OccurredAt, err = db.dbToAPITime(occurredAt); err != nil {
+			return nil, fmt.Errorf("parsing audit time: %w", err)
+		}
+		if entry.ActorAccountID == nil || *entry.ActorAccountID != accountID {
+			entry.ActorAccountID, entry.IP, entry.RequestID = nil, "", ""
+		}
+		entry.PrevHash, entry.EntryHash = "", ""
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return entries, nil
+}
+
+// dataExportBlobKey is where the encrypted ZIP of an export is kept until its link expires
+func dataExportBlobKey(exportID int) string {
+	return fmt.Sprintf("exports/%d.zip", exportID)
+}
+
+// RequestDataExport queues an export of everything held about a user
+func (db *Database) RequestDataExport(userID, requestedBy int) (int, error) {
+	var exists bool
+	if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM user WHERE UserID = ?)`, userID).Scan(&exists); err != nil {
+		return 0, fmt.Errorf("checking user: %w", err)
+	}
+	if !exists {
+		return 0, sql.ErrNoRows
+	}
+
+	result, err := db.Exec(`INSERT INTO dataexport (UserID, RequestedBy, Status, RequestedAt) VALUES (?, ?, 'pending', ?)`,
+		userID, requestedBy, toDB(db.now()))
+	if err != nil {
+		return 0, fmt.Errorf("inserting data export: %w", err)
+	}
+	exportID, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("getting export ID: %w", err)
+	}
+	return int(exportID), nil
+}
+
+// GetDataExport returns an export request. The download URL is included only while the link is valid.
+func (db *Database) GetDataExport(exportID int) (*DataExport, error) {
+	export := DataExport{ExportID: exportID}
+	var requestedAt string
+	var completedAt, expiresAt, token, exportErr sql.NullString
+	err := db.QueryRow(`SELECT UserID, Status, RequestedAt, CompletedAt, ExpiresAt, Token, Error FROM dataexport WHERE ExportID = ?`, exportID).
+		Scan(&export.UserID, &export.Status, &requestedAt, &completedAt, &expiresAt, &token, &exportErr)
+	if err != nil {
+		return nil, err
+	}
+
+	if export.RequestedAt, err = db.dbToAPITime(requestedAt); err != nil {
+		return nil, fmt.Errorf("parsing request time: %w", err)
+	}
+	if completedAt.Valid {
+		if export.CompletedAt, err = db.dbToAPITime(completedAt.String); err != nil {
+			return nil, fmt.Errorf("parsing completion time: %w", err)
+		}
+	}
+	if expiresAt.Valid {
+		expires, err := fromDB(expiresAt.String)
+		if err != nil {
+			return nil, fmt.Errorf("parsing expiry: %w", err)
+		}
+		export.ExpiresAt = db.formatAPITime(expires)
+		if export.Status == "ready" && db.now().After(expires) {
+			export.Status = "expired"
+		}
+	}
+	if export.Status == "ready" && token.Valid {
+		export.DownloadURL = "/downloadDataExport?token=" + token.String
+	}
+	export.Error = exportErr.String
+	return &export, nil
+}
+
+// runDataExport builds one claimed export and stores it encrypted under the keyring until its link expires.
+// The export is only marked ready if the claim made at claimedAt still holds.
+func (db *Database) runDataExport(keys *Keyring, exportID, userID int, claimedAt string) error {
+	archive, _, err := db.buildDataExport(keys, userID)
+	if err != nil {
+		return err
+	}
+	ciphertexts, wrappedKey, keyID, err := keys.seal(archive)
+	if err != nil {
+		return fmt.Errorf("encrypting export: %w", err)
+	}
+	if err := db.blobs.Put(dataExportBlobKey(exportID), ciphertexts[0]); err != nil {
+		return fmt.Errorf("storing export: %w", err)
+	}
+
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return fmt.Errorf("generating download token: %w", err)
+	}
+	now := db.now()
+	result, err := db.Exec(`UPDATE dataexport SET Status = 'ready', Token = ?, AESKey = ?, KeyID = ?, KeyWrapVersion = ?, CompletedAt = ?, ExpiresAt = ?
+	                        WHERE ExportID = ? AND Status = 'running' AND ClaimedAt = ?`,
+		hex.EncodeToString(tokenBytes), wrappedKey, keyID, currentKeyWrap, toDB(now), toDB(now.Add(dataExportLinkLifetime)), exportID, claimedAt)
+	if err != nil {
+		return fmt.Errorf("recording finished export: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("export %d was claimed again before it finished", exportID)
+	}
+	return nil
+}
+
+// processDataExports builds every queued export, oldest first, and removes the files of expired ones
+func (db *Database) processDataExports(keys *Keyring) {
+	// Claims older than the timeout belong to an instance that stopped mid-build; those exports start again.
+	// Claims with no time were made before claims were timed.
+	_, err := db.Exec(`UPDATE dataexport SET Status = 'pending', ClaimedAt = NULL WHERE Status = 'running' AND (ClaimedAt IS NULL OR ClaimedAt < ?)`,
+		toDB(db.now().Add(-dataExportClaimTimeout)))
+	if err != nil {
+		log.Printf("Error requeuing abandoned data exports: %v", err)
+	}
+
+	for {
+		var exportID, userID int
+		err := db.QueryRow(`SELECT ExportID, UserID FROM dataexport WHERE Status = 'pending' ORDER BY ExportID LIMIT 1`).Scan(&exportID, &userID)
+		if err == sql.ErrNoRows {
+			break
+		}
+		if err != nil {
+			log.Printf("Error querying data exports: %v", err)
+			return
+		}
+
+		// Claim the export so another server instance does not build it too
+		claimedAt := toDB(db.now())
+		result, err := db.Exec(`UPDATE dataexport SET Status = 'running', ClaimedAt = ? WHERE ExportID = ? AND Status = 'pending'`, claimedAt, exportID)
+		if err != nil {
+			log.Printf("Error claiming data export %d: %v", exportID, err)
+			return
+		}
+		if claimed, _ := result.RowsAffected(); claimed == 0 {
+			continue
+		}
+
+		if err := db.runDataExport(keys, exportID, userID, claimedAt); err != nil {
+			log.Printf("Data export %d for user %d failed: %v", exportID, userID, err)
+			_, err = db.Exec(`UPDATE dataexport SET Status = 'failed', Error = ?, CompletedAt = ? WHERE ExportID = ? AND Status = 'running' AND ClaimedAt = ?`,
+				err.Error(), toDB(db.now()), exportID, claimedAt)
+			if err != nil {
+				log.Printf("Error recording failed data export %d: %v", exportID, err)
+			}
+			continue
+		}
+		log.Printf("Data export %d for user %d is ready", exportID, userID)
+	}
+
+	rows, err := db.Query(`SELECT ExportID FROM dataexport WHERE Status = 'ready' AND ExpiresAt <= ?`, toDB(db.now()))
+	if err != nil {
+		log.Printf("Error querying expired data exports: %v", err)
+		return
+	}
+	var expired []int
+	for rows.Next() {
+		var exportID int
+		if err := rows.Scan(&exportID); err != nil {
+			log.Printf("Error scanning expired data export: %v", err)
+			break
+		}
+		expired = append(expired, exportID)
+	}
+	rows.Close()
+
+	for _, exportID := range expired {
+		if err := db.blobs.Delete(dataExportBlobKey(exportID)); err != nil && !errors.Is(err, errBlobNotFound) {
+			log.Printf("Error deleting data export %d: %v", exportID, err)
+			continue
+		}
+		_, err := db.Exec(`UPDATE dataexport SET Status = 'expired', Token = NULL, AESKey = NULL WHERE ExportID = ?`, exportID)
+		if err != nil {
+			log.Printf("Error expiring data export %d: %v", exportID, err)
+		}
+	}
+}
+
+// startDataExportJob builds queued exports in the background and returns a function that wakes it early,
+// so an export usually starts as soon as it is requested
+func startDataExportJob(db *Database, keys *Keyring) func() {
+	wake := make(chan struct{}, 1)
+	go func() {
+		ticker := time.NewTicker(dataExportPollInterval)
+		defer ticker.Stop()
+		for {
+			db.processDataExports(keys)
+			select {
+			case <-ticker.C:
+			case <-wake:
+			}
+		}
+	}()
+
+	return func() {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// requestDataExport queues an export for the signed-in user, or for any user when called by an admin
+func requestDataExport(db *Database, wakeExports func()) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID, err := strconv.Atoi(r.URL.Query().Get("userID"))
+		if err != nil {
+			http.Error(w, "Invalid UserID format", http.StatusBadRequest)
+			return
+		}
+		session, ok := db.userSession(w, r, userID)
+		if !ok {
+			return
+		}
+
+		exportID, err := db.RequestDataExport(userID, session.AccountID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "User not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, fmt.Sprintf("Failed to request data export: %v", err), http.StatusInternalServerError)
+			return
+		}
+		wakeExports()
+
+		export, err := db.GetDataExport(exportID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to get data export: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(export)
+	}
+}
+
+// getDataExport reports the progress of an export and, once it is ready, its download link
+func getDataExport(db *Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		exportID, err := strconv.Atoi(r.URL.Query().Get("exportID"))
+		if err != nil {
+			http.Error(w, "Invalid ExportID format", http.StatusBadRequest)
+			return
+		}
+		export, err := db.GetDataExport(exportID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Data export not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, fmt.Sprintf("Failed to get data export: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if _, ok := db.userSession(w, r, export.UserID); !ok {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(export)
+	}
+}
+
+// downloadDataExport serves a finished export to anyone holding its link until the link expires
+func downloadDataExport(db *Database, keys *Keyring) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		token := r.URL.Query().Get("token")
+		if len(token) != 64 {
+			http.Error(w, "Invalid download link", http.StatusNotFound)
+			return
+		}
+
+		var exportID, userID, version int
+		var expiresAt, keyID string
+		var wrappedKey []byte
+		err := db.QueryRow(`SELECT ExportID, UserID, ExpiresAt, AESKey, KeyID, KeyWrapVersion FROM dataexport WHERE Token = ? AND Status = 'ready'`, token).
+			Scan(&exportID, &userID, &expiresAt, &wrappedKey, &keyID, &version)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Invalid download link", http.StatusNotFound)
+				return
+			}
+			http.Error(w, fmt.Sprintf("Error querying data export: %v", err), http.StatusInternalServerError)
+			return
+		}
+		expires, err := fromDB(expiresAt)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error parsing expiry: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if db.now().After(expires) {
+			http.Error(w, "Download link has expired; request a new export", http.StatusGone)
+			return
+		}
+
+		encrypted, err := db.blobs.Get(dataExportBlobKey(exportID))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error reading data export: %v", err), http.StatusInternalServerError)
+			return
+		}
+		archive, err := keys.open(encrypted, wrappedKey, keyID, version)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error decrypting data export: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="loanloey-data-user-%d.zip"`, userID))
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(archive)
+	}
+}
+
+//PAYOFF QUOTE
+
+// PayoffQuote struct represents the locked-in amount for settling a loan on a given date
+type PayoffQuote struct {
+	QuoteID       int     `json:"quote_id"`
+	LoanID        int     `json:"loan_id"`
+	PayoffDate    string  `json:"payoff_date"`
+	ValidUntil    string  `json:"valid_until"`
+	InitialAmount float64 `json:"initial_amount"`
+	Interest      float64 `json:"interest"`
+	ExtensionFee  float64 `json:"extension_fee"`
+	Rebate        float64 `json:"rebate"`
+	TotalDue      float64 `json:"total_due"`
+}
+
+// calculatePayoffRebate returns the share of interest given back for settling before the due date.
+// The rebate is the unearned, pro-rata part of the interest scaled by rebateRate.
+func calculatePayoffRebate(interest float64, processedAt, dueDate, payoffAt time.Time, rebateRate float64) float64 {
+	term := dueDate.Sub(processedAt)
+	if term <= 0 || !payoffAt.Before(dueDate) {
+		return 0
+	}
+
+	unearned := float64(dueDate.Sub(payoffAt)) / float64(term)
+	if unearned > 1 {
+		unearned = 1
+	}
+	return roundToTwoDecimalPlaces(interest * unearned * rebateRate)
+}
+
+// CreatePayoffQuote prices settling a pending loan on payoffDate ("2006-01-02") and stores the quote
+func (db *Database) CreatePayoffQuote(loanID int, payoffDateStr string) (PayoffQuote, error) {
+	payoffDate, err := db.parseAPITime(apiDateLayout, payoffDateStr)
+	if err != nil {
+		return PayoffQuote{}, fmt.Errorf("parsing payoffDate: %w", err)
+	}
+	// The quote holds until the end of the payoff day
+	validUntil := payoffDate.AddDate(0, 0, 1).Add(-time.Second)
+	if validUntil.Before(db.now()) {
+		return PayoffQuote{}, fmt.Errorf("payoff date %s is in the past", payoffDateStr)
+	}
+
+	var amount, extensionFee float64
+	var dueDateStr, processedStr, status string
+	query := `SELECT Amount, Duedate, DOProcess, Status, ExtensionFee FROM loan WHERE LoanID = ?`
+	err = db.QueryRow(query, loanID).Scan(&amount, &dueDateStr, &processedStr, &status, &extensionFee)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return PayoffQuote{}, fmt.Errorf("no loan found for LoanID %d", loanID)
+		}
+		return PayoffQuote{}, fmt.Errorf("querying loan: %w", err)
+	}
+	if status != "pending" {
+		return PayoffQuote{}, fmt.Errorf("loan %d is %s and cannot be paid off", loanID, status)
+	}
+
+	dueDate, err := fromDB(dueDateStr)
+	if err != nil {
+		return PayoffQuote{}, fmt.Errorf("parsing due date: %w", err)
+	}
+	processedAt, err := fromDB(processedStr)
+	if err != nil {
+		return PayoffQuote{}, fmt.Errorf("parsing process date: %w", err)
+	}
+
+	rebateRate, err := db.GetSetting("early_payoff_rebate_rate")
+	if err != nil {
+		return PayoffQuote{}, err
+	}
+
+	_, interest, _ := calculateLoanDetails(amount, dueDate, db.now())
+	rebate := calculatePayoffRebate(interest, processedAt, dueDate, validUntil, rebateRate)
+
+	quote := PayoffQuote{
+		LoanID:        loanID,
+		PayoffDate:    payoffDateStr,
+		ValidUntil:    db.formatAPITime(validUntil),
+		InitialAmount: amount,
+		Interest:      interest,
+		ExtensionFee:  extensionFee,
+		Rebate:        rebate,
+		TotalDue:      roundToTwoDecimalPlaces(amount + interest + extensionFee - rebate),
+	}
+
+	result, err := db.Exec(`INSERT INTO payoffquote (LoanID, PayoffDate, ValidUntil, Interest, Rebate, TotalDue, CreatedAt) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		loanID, quote.PayoffDate, toDB(validUntil), quote.Interest, quote.Rebate, quote.TotalDue, toDB(db.now()))
+	if err != nil {
+		return PayoffQuote{}, fmt.Errorf("inserting payoff quote: %w", err)
+	}
+
+	quoteID, err := result.LastInsertId()
+	if err != nil {
+		return PayoffQuote{}, fmt.Errorf("getting last insert ID: %w", err)
+	}
+	quote.QuoteID = int(quoteID)
+
+	return quote, nil
+}
+
+// getUsablePayoffQuote returns the amount locked in by a quote that is still valid and unused for the loan
+func (db *Database) getUsablePayoffQuote(quoteID, loanID int) (float64, error) {
+	var quoteLoanID int
+	var totalDue float64
+	var validUntilStr string
+	var paymentID sql.NullInt64
+	query := `SELECT LoanID, TotalDue, ValidUntil, PaymentID FROM payoffquote WHERE QuoteID = ?`
+	err := db.QueryRow(query, quoteID).Scan(&quoteLoanID, &totalDue, &validUntilStr, &paymentID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, fmt.Errorf("no payoff quote found for QuoteID %d", quoteID)
+		}
+		return 0, fmt.Errorf("querying payoff quote: %w", err)
+	}
+
+	if quoteLoanID != loanID {
+		return 0, fmt.Errorf("payoff quote %d is for a different loan", quoteID)
+	}
+	if paymentID.Valid {
+		return 0, fmt.Errorf("payoff quote %d has already been used", quoteID)
+	}
+
+	validUntil, err := fromDB(validUntilStr)
+	if err != nil {
+		return 0, fmt.Errorf("parsing quote expiry: %w", err)
+	}
+	if db.now().After(validUntil) {
+		return 0, fmt.Errorf("payoff quote %d expired at %s", quoteID, db.formatAPITime(validUntil))
+	}
+
+	return totalDue, nil
+}
+
+// PAYMENT
+func confirmPaymentDetails(db *Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Received request: %s %s", r.Method, r.URL.Path)
+
+		// Check if the request method is GET
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Retrieve LoanID from query parameters
+		loanIDStr := r.URL.Query().Get("loanID")
+		if loanIDStr == "" {
+			http.Error(w, "LoanID is required", http.StatusBadRequest)
+			return
+		}
+
+		// Convert LoanID to integer
+		loanID, err := strconv.Atoi(loanIDStr)
+		if err != nil {
+			http.Error(w, "Invalid LoanID format", http.StatusBadRequest)
+			return
+		}
+
+		// Query to retrieve loan details
+		query := `SELECT Amount, Duedate, ExtensionFee FROM loan WHERE LoanID = ?`
+		var amount, extensionFee float64
+		var dueDateStr string
+		err = db.QueryRow(query, loanID).Scan(&amount, &dueDateStr, &extensionFee)
+
+		// Check for errors in the query
+		if err == sql.ErrNoRows {
+			http.Error(w, "Loan not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("Error querying loan: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		// Parse the due date
+		dueDate, err := fromDB(dueDateStr)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Parsing due date: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		// Calculate total amount using your helper functions
+		totalAmount, _, _ := calculateLoanDetails(amount, dueDate, db.now())
+
+		// Prepare the JSON response with only the total amount
+		response := map[string]float64{
+			"totalAmount": totalAmount + extensionFee,
+		}
+
+		// Set response headers and encode the response as JSON
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// RECEIPT FILES
+
+const (
+	// maxReceiptDimension bounds the longest edge of a stored receipt image
+	maxReceiptDimension = 2000
+	// maxReceiptPixels rejects images that would take too much memory to decode
+	maxReceiptPixels = 50_000_000
+)
+
+// heicBrands are the ISO base media file brands used by HEIC/HEIF images
+var heicBrands = map[string]bool{
+	"heic": true, "heix": true, "hevc": true, "hevx": true,
+	"heim": true, "heis": true, "mif1": true, "msf1": true,
+}
+
+// sniffReceiptType identifies a receipt by its content, ignoring whatever the client claimed it was
+func sniffReceiptType(data []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF}):
+		return "image/jpeg", nil
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return "image/png", nil
+	case bytes.HasPrefix(data, []byte("%PDF-")):
+		return "application/pdf", nil
+	case len(data) >= 12 && string(data[4:8]) == "ftyp" && heicBrands[string(data[8:12])]:
+		return "image/heic", nil
+	}
+	return "", fmt.Errorf("unsupported receipt type %s, must be JPEG, PNG or PDF", http.DetectContentType(data))
+}
+
+// acceptedReceiptTypes are the receipt types new uploads may have. HEIC is refused: there is no HEIC
+// decoder here to validate it or strip its EXIF and GPS metadata, so clients convert it to JPEG first.
+var acceptedReceiptTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"application/pdf": true,
+}
+
+// normalizeReceipt validates an uploaded receipt and returns the bytes to store with their MIME type.
+// JPEG and PNG images are decoded, turned upright, scaled down and re-encoded, which drops EXIF and any
+// other embedded metadata. PDFs are parsed, validated and rewritten without their metadata.
+func normalizeReceipt(data []byte) ([]byte, string, error) {
+	contentType, err := sniffReceiptType(data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch contentType {
+	case "application/pdf":
+		stripped, err := stripPDFMetadata(data)
+		if err != nil {
+			return nil, "", err
+		}
+		return stripped, contentType, nil
+
+	case "image/heic":
+		return nil, "", fmt.Errorf("HEIC receipts are not accepted, convert the photo to JPEG")
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("receipt image is corrupt: %w", err)
+	}
+	if config.Width*config.Height > maxReceiptPixels {
+		return nil, "", fmt.Errorf("receipt image is too large (%dx%d)", config.Width, config.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("receipt image is corrupt: %w", err)
+	}
+
+	orientation := 1
+	if contentType == "image/jpeg" {
+		orientation = jpegOrientation(data)
+	}
+	img = orientImage(scaleDownImage(img, maxReceiptDimension), orientation)
+
+	var out bytes.Buffer
+	if contentType == "image/jpeg" {
+		err = jpeg.Encode(&out, img, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&out, img)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("re-encoding receipt image: %w", err)
+	}
+	return out.Bytes(), contentType, nil
+}
+
+// scaleDownImage shrinks an image so its longest edge is at most maxDim
+func scaleDownImage(src image.Image, maxDim int) image.Image {
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= maxDim && h <= maxDim {
+		return src
+	}
+
+	dw, dh := maxDim, max(1, h*maxDim/w)
+	if h > w {
+		dw, dh = max(1, w*maxDim/h), maxDim
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+	return dst
+}
+
+// pdfMetadataKeys are the dictionary entries that carry document metadata: XMP streams and
+// application-private data
+var pdfMetadataKeys = []string{"Metadata", "PieceInfo"}
+
+// stripPDFMetadata parses a PDF, which rejects malformed and password-protected files, and writes it
+// out again without its document information dictionary (author, creator application, device) or any
+// XMP metadata. The PDF is rewritten rather than updated in place, so the old values are not left behind.
+func stripPDFMetadata(data []byte) ([]byte, error) {
+	conf := model.NewDefaultConfiguration()
+	conf.ValidationMode = model.ValidationRelaxed
+	ctx, err := api.ReadAndValidate(bytes.NewReader(data), conf)
+	if err != nil {
+		return nil, fmt.Errorf("PDF receipt is invalid: %w", err)
+	}
+	if ctx.Encrypt != nil {
+		return nil, fmt.Errorf("PDF receipt is password-protected")
+	}
+
+	if ctx.Info != nil {
+		if err := ctx.DeleteObject(*ctx.Info); err != nil {
+			return nil, fmt.Errorf("removing PDF document info: %w", err)
+		}
+		ctx.Info = nil
+	}
+	for _, entry := range ctx.Table {
+		if entry == nil || entry.Free {
+			continue
+		}
+		var dict types.Dict
+		switch obj := entry.Object.(type) {
+		case types.Dict:
+			dict = obj
+		case types.StreamDict:
+			dict = obj.Dict
+		default:
+			continue
+		}
+		for _, key := range pdfMetadataKeys {
+			if value, ok := dict.Find(key); ok {
+				if err := ctx.DeleteObject(value); err != nil {
+					return nil, fmt.Errorf("removing PDF %s: %w", key, err)
+				}
+				dict.Delete(key)
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	if err := api.WriteContext(ctx, &out); err != nil {
+		return nil, fmt.Errorf("rewriting PDF receipt: %w", err)
+	}
+	return out.Bytes(), nil
+}
+
+// orientImage applies an EXIF orientation so the image displays upright once the EXIF data is gone
+func orientImage(src image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		dstW, dstH = h, w
+	}
+
+	dst := image.NewRGBA64(image.Rect(0, 0, dstW, dstH))
+	for sy := 0; sy < h; sy++ {
+		for sx := 0; sx < w; sx++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored horizontally
+				dx, dy = w-1-sx, sy
+			case 3: // rotated 180°
+				dx, dy = w-1-sx, h-1-sy
+			case 4: // mirrored vertically
+				dx, dy = sx, h-1-sy
+			case 5: // transposed
+				dx, dy = sy, sx
+			case 6: // rotated 90° clockwise
+				dx, dy = h-1-sy, sx
+			case 7: // transversed
+				dx, dy = h-1-sy, w-1-sx
+			case 8: // rotated 90° counter-clockwise
+				dx, dy = sy, w-1-sx
+			}
+			dst.Set(dx, dy, src.At(bounds.Min.X+sx, bounds.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+// jpegOrientation reads the EXIF orientation tag of a JPEG, returning 1 (upright) when there is none
+func jpegOrientation(data []byte) int {
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 { // image data starts, no more metadata
+			return 1
+		}
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		if size < 2 || i+2+size > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+size]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		i += 2 + size
+	}
+	return 1
+}
+
+// tiffOrientation finds tag 0x0112 in the first IFD of an EXIF TIFF block
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for k := 0; k < entries; k++ {
+		entry := ifd + 2 + k*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	return 1
+}
+
+// THUMBNAILS
+
+const (
+	// thumbnailDimension bounds the longest edge of a receipt thumbnail
+	thumbnailDimension = 256
+	thumbnailQuality   = 75
+)
+
+// makeThumbnail renders a small JPEG preview of a normalized receipt. It returns nil for receipts
+// that cannot be decoded here (PDF, and HEIC from before it was refused); those are shown with a placeholder instead.
+func makeThumbnail(receipt []byte, contentType string) ([]byte, error) {
+	if contentType != "image/jpeg" && contentType != "image/png" {
+		return nil, nil
+	}
+
+	// Client-encrypted receipts reach here without having been through normalizeReceipt, so check the size first
+	config, _, err := image.DecodeConfig(bytes.NewReader(receipt))
+	if err != nil {
+		return nil, fmt.Errorf("decoding receipt for thumbnail: %w", err)
+	}
+	if config.Width*config.Height > maxReceiptPixels {
+		return nil, fmt.Errorf("receipt image is too large for a thumbnail (%dx%d)", config.Width, config.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(receipt))
+	if err != nil {
+		return nil, fmt.Errorf("decoding receipt for thumbnail: %w", err)
+	}
+	img = scaleDownImage(img, thumbnailDimension)
+
+	// JPEG has no alpha channel, so transparent PNG areas are laid on white
+	bounds := img.Bounds()
+	flat := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(flat, flat.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, bounds.Min, draw.Over)
+
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, flat, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		return nil, fmt.Errorf("encoding thumbnail: %w", err)
+	}
+	return out.Bytes(), nil
+}
+
+// placeholderGlyphs is a 5x7 bitmap font for the letters used on placeholder labels
+var placeholderGlyphs = map[rune][7]string{
+	'P': {"####.", "#...#", "#...#", "####.", "#....", "#....", "#...."},
+	'D': {"####.", "#...#", "#...#", "#...#", "#...#", "#...#", "####."},
+	'F': {"#####", "#....", "#....", "####.", "#....", "#....", "#...."},
+	'H': {"#...#", "#...#", "#...#", "#####", "#...#", "#...#", "#...#"},
+	'E': {"#####", "#....", "#....", "####.", "#....", "#....", "#####"},
+	'I': {"#####", "..#..", "..#..", "..#..", "..#..", "..#..", "#####"},
+	'C': {".####", "#....", "#....", "#....", "#....", "#....", ".####"},
+}
+
+// placeholderThumbnail draws a blank page with a folded corner and a coloured label band,
+// standing in for the first page of receipts the server cannot render
+func placeholderThumbnail(label string) []byte {
+	const width, height, fold = 192, 256, 40
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{color.RGBA{0xEE, 0xEE, 0xEE, 0xFF}}, image.Point{}, draw.Src)
+
+	// The page, with its top-right corner folded over
+	page := image.Rect(16, 12, width-16, height-12)
+	for y := page.Min.Y; y < page.Max.Y; y++ {
+		for x := page.Min.X; x < page.Max.X; x++ {
+			dx, dy := x-(page.Max.X-fold), y-page.Min.Y
+			switch {
+			case dx >= 0 && dy < fold && dx > dy:
+				continue // cut away corner
+			case dx >= 0 && dy < fold:
+				img.Set(x, y, color.RGBA{0xCC, 0xCC, 0xCC, 0xFF})
+			default:
+				img.Set(x, y, color.White)
+			}
+		}
+	}
+
+	// Grey lines suggesting text
+	for line := 0; line < 6; line++ {
+		y := page.Min.Y + fold + 16 + line*14
+		draw.Draw(img, image.Rect(page.Min.X+16, y, page.Max.X-16-(line%3)*20, y+4), &image.Uniform{color.RGBA{0xD0, 0xD0, 0xD0, 0xFF}}, image.Point{}, draw.Src)
+	}
+
+	// Label band with the file type in block letters
+	band := image.Rect(page.Min.X, page.Max.Y-72, page.Max.X, page.Max.Y-24)
+	draw.Draw(img, band, &image.Uniform{color.RGBA{0xC6, 0x28, 0x28, 0xFF}}, image.Point{}, draw.Src)
+	const scale = 4
+	textWidth := len(label)*6*scale - scale
+	x0, y0 := band.Min.X+(band.Dx()-textWidth)/2, band.Min.Y+(band.Dy()-7*scale)/2
+	for i, letter := range label {
+		for row, bits := range placeholderGlyphs[letter] {
+			for col, bit := range bits {
+				if bit == '#' {
+					x, y := x0+i*6*scale+col*scale, y0+row*scale
+					draw.Draw(img, image.Rect(x, y, x+scale, y+scale), image.White, image.Point{}, draw.Src)
+				}
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	png.Encode(&out, img)
+	return out.Bytes()
+}
+
+// placeholderLabels names the placeholder shown for receipt types without a thumbnail
+var placeholderLabels = map[string]string{
+	"application/pdf": "PDF",
+	"image/heic":      "HEIC",
+}
+
+// getReceiptThumbnail returns a payment's thumbnail and its content type. Receipts uploaded before
+// thumbnails existed get one rendered from the full receipt on the fly.
+func (db *Database) getReceiptThumbnail(paymentID int, keys *Keyring) ([]byte, string, error) {
+	var wrappedKey []byte
+	var keyID, thumbnailKey, receiptType sql.NullString
+	var version int
+	query := `SELECT AESKey, AESKeyID, KeyWrapVersion, ThumbnailKey, ReceiptType FROM payment WHERE PaymentID = ?`
+	if err := db.QueryRow(query, paymentID).Scan(&wrappedKey, &keyID, &version, &thumbnailKey, &receiptType); err != nil {
+		return nil, "", err
+	}
+	if err := db.verifyPayment(db, paymentID, "thumbnail access"); err != nil {
+		return nil, "", err
+	}
+
+	if thumbnailKey.Valid {
+		encrypted, err := db.blobs.Get(thumbnailKey.String)
+		if err != nil {
+			return nil, "", fmt.Errorf("loading thumbnail blob %s: %w", thumbnailKey.String, err)
+		}
+		thumbnail, err := keys.open(encrypted, wrappedKey, keyID.String, version)
+		if err != nil {
+			return nil, "", fmt.Errorf("decrypting thumbnail: %w", err)
+		}
+		return thumbnail, "image/jpeg", nil
+	}
+
+	if label, ok := placeholderLabels[receiptType.String]; ok {
+		return placeholderThumbnail(label), "image/png", nil
+	}
+
+	receipt, contentType, _, err := db.getReceipt(paymentID, keys)
+	if err != nil {
+		return nil, "", err
+	}
+	thumbnail, err := makeThumbnail(receipt, contentType)
+	if err != nil {
+		return nil, "", err
+	}
+	if thumbnail == nil {
+		return placeholderThumbnail(placeholderLabels[contentType]), "image/png", nil
+	}
+	return thumbnail, "image/jpeg", nil
+}
+
+// receiptThumbnailHandler serves the thumbnail shown in the admin review queue
+func receiptThumbnailHandler(db *Database, keys *Keyring) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		paymentID, err := strconv.Atoi(r.URL.Query().Get("paymentID"))
+		if err != nil {
+			http.Error(w, "Invalid PaymentID format", http.StatusBadRequest)
+			return
+		}
+
+		thumbnail, contentType, err := db.getReceiptThumbnail(paymentID, keys)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Receipt not found", http.StatusNotFound)
+				return
+			}
+			if err == errPaymentTampered {
+				http.Error(w, "Payment record failed its integrity check; see /getSecurityEvents", http.StatusConflict)
+				return
+			}
+			log.Printf("Error loading thumbnail for PaymentID %d: %v", paymentID, err)
+			http.Error(w, "Error loading thumbnail", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Cache-Control", "private, no-store")
+		w.Write(thumbnail)
+	}
+}
+
+func insertPayment(db *Database, keys *Keyring) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Received request to insert payment for LoanID: %s", r.URL.Query().Get("loanID"))
+
+		// Check if the request method is POST
+		if r.Method != http.MethodPost {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Parse the multipart form to handle file uploads
+		err := r.ParseMultipartForm(50 << 20) // Limit file size to 50 MB
+		if err != nil {
+			http.Error(w, "Error parsing form data", http.StatusBadRequest)
+			return
+		}
+
+		// Retrieve LoanID from query parameters
+		loanIDStr := r.URL.Query().Get("loanID")
+		if loanIDStr == "" {
+			http.Error(w, "LoanID is required", http.StatusBadRequest)
+			return
+		}
+
+		// Convert LoanID to integer
+		loanID, err := strconv.Atoi(loanIDStr)
+		if err != nil {
+			http.Error(w, "Invalid LoanID format", http.StatusBadRequest)
+			return
+		}
+
+		submitPayment(db, keys, w, r, loanID, sql.NullInt64{})
+	}
+}
+
+// receiptUpload is an encrypted receipt ready to be stored, however it was encrypted
+type receiptUpload struct {
+	encryptedParts [][]byte // the receipt, then its thumbnail if there is one
+	wrappedKey     []byte
+	keyID          string
+	wrapVersion    int
+	receiptType    string
+	contentHash    string
+	clientHashed   bool // contentHash was asserted by the client rather than computed here
+}
+
+// readPlainReceipt reads a plaintext receipt, strips its metadata and encrypts it with a thumbnail
+func readPlainReceipt(keys *Keyring, w http.ResponseWriter, r *http.Request) (*receiptUpload, bool) {
+	// Retrieve the uploaded file
+	file, _, err := r.FormFile("receipt")
+	if err != nil {
+		log.Printf("Error retrieving the file: %v", err)
+		http.Error(w, "Error retrieving the file", http.StatusBadRequest)
+		return nil, false
+	}
+	defer file.Close()
+
+	// Read the file content
+	fileBytes, err := io.ReadAll(file)
+	if err != nil {
+		log.Printf("Error reading the file: %v", err)
+		http.Error(w, "Error reading the file", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	// Only store receipts we can show back to a reviewer, stripped of metadata
+	normalized, receiptType, err := normalizeReceipt(fileBytes)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid receipt: %v", err), http.StatusUnsupportedMediaType)
+		return nil, false
+	}
+
+	// A thumbnail failure should not stop the payment; reviewers fall back to the full receipt
+	thumbnail, err := makeThumbnail(normalized, receiptType)
+	if err != nil {
+		log.Printf("Error generating receipt thumbnail: %v", err)
+	}
+
+	// Encrypt the file content, and its thumbnail, under a fresh AES key wrapped with RSA
+	parts := [][]byte{normalized}
+	if thumbnail != nil {
+		parts = append(parts, thumbnail)
+	}
+	encryptedParts, encryptedAESKey, keyID, err := keys.seal(parts...)
+	if err != nil {
+		log.Printf("Error encrypting receipt: %v", err)
+		http.Error(w, "Error encrypting file", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return &receiptUpload{
+		encryptedParts: encryptedParts,
+		wrappedKey:     encryptedAESKey,
+		keyID:          keyID,
+		wrapVersion:    currentKeyWrap,
+		receiptType:    receiptType,
+		contentHash:    receiptHash(fileBytes),
+	}, true
+}
+
+// Limits for client-encrypted uploads. The ciphertext is laid out like encryptWithAES output:
+// a 12-byte nonce, then the encrypted data, then the 16-byte GCM tag.
+const (
+	maxClientEncryptedReceipt   = 20 << 20
+	maxClientEncryptedThumbnail = 512 << 10
+	aesGCMOverhead              = 12 + 16
+)
+
+// readClientEncryptedReceipt reads a receipt the client encrypted itself. The server never sees the
+// AES key, so it can only check that the envelope is well formed: the key ID names a keyring key, the
+// wrapped key is a valid RSA-OAEP ciphertext for that key, and the file is large enough to hold a
+// nonce and tag. The client is trusted for the content type and the plaintext hash.
+func readClientEncryptedReceipt(keys *Keyring, w http.ResponseWriter, r *http.Request) (*receiptUpload, bool) {
+	keyID := r.FormValue("key_id")
+	publicKey, ok := keys.PublicKey(keyID)
+	if !ok {
+		http.Error(w, "Unknown key_id; fetch the current key from /getReceiptEncryptionKey", http.StatusBadRequest)
+		return nil, false
+	}
+
+	// An RSA ciphertext is exactly the modulus size and, read as a number, smaller than the modulus
+	wrappedKey, err := base64.StdEncoding.DecodeString(r.FormValue("wrapped_key"))
+	if err != nil || len(wrappedKey) != publicKey.Size() || new(big.Int).SetBytes(wrappedKey).Cmp(publicKey.N) >= 0 {
+		http.Error(w, "wrapped_key must be the base64 RSA-OAEP ciphertext of the AES key", http.StatusBadRequest)
+		return nil, false
+	}
+
+	receiptType := r.FormValue("content_type")
+	if !acceptedReceiptTypes[receiptType] {
+		http.Error(w, "content_type must be image/jpeg, image/png or application/pdf", http.StatusUnsupportedMediaType)
+		return nil, false
+	}
+
+	contentHash := strings.ToLower(r.FormValue("receipt_hash"))
+	if decoded, err := hex.DecodeString(contentHash); err != nil || len(decoded) != sha256.Size {
+		http.Error(w, "receipt_hash must be the hex SHA-256 of the plaintext receipt", http.StatusBadRequest)
+		return nil, false
+	}
+
+	readPart := func(field string, limit int) ([]byte, bool) {
+		file, _, err := r.FormFile(field)
+		if err != nil {
+			return nil, false
+		}
+		defer file.Close()
+		data, err := io.ReadAll(io.LimitReader(file, int64(limit)+1))
+		if err != nil || len(data) <= aesGCMOverhead || len(data) > limit {
+			return nil, false
+		}
+		return data, true
+	}
+
+	encryptedReceipt, ok := readPart("receipt", maxClientEncryptedReceipt)
+	if !ok {
+		http.Error(w, "receipt must be an AES-256-GCM ciphertext (nonce, data, tag) of at most 20 MB", http.StatusBadRequest)
+		return nil, false
+	}
+	parts := [][]byte{encryptedReceipt}
+	if r.MultipartForm != nil && len(r.MultipartForm.File["thumbnail"]) > 0 {
+		encryptedThumbnail, ok := readPart("thumbnail", maxClientEncryptedThumbnail)
+		if !ok {
+			http.Error(w, "thumbnail must be an AES-256-GCM ciphertext of at most 512 KB", http.StatusBadRequest)
+			return nil, false
+		}
+		parts = append(parts, encryptedThumbnail)
+	}
+
+	return &receiptUpload{
+		encryptedParts: parts,
+		wrappedKey:     wrappedKey,
+		keyID:          keyID,
+		wrapVersion:    keyWrapOAEP,
+		receiptType:    receiptType,
+		contentHash:    contentHash,
+		clientHashed:   true,
+	}, true
+}
+
+// receiptEncryptionKeyHandler publishes the key clients encrypt receipts with
+func receiptEncryptionKeyHandler(keys *Keyring) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		keyID, publicKey := keys.Active()
+		publicKeyBytes, err := x509.MarshalPKIXPublicKey(publicKey)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error encoding public key: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		response := map[string]interface{}{
+			"key_id":             keyID,
+			"key_algorithm":      "RSA-OAEP-256",
+			"content_encryption": "A256GCM",
+			"public_key":         string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyBytes})),
+			"jwk":                publicKeyJWK(keyID, publicKey),
+			"max_receipt_bytes":  maxClientEncryptedReceipt,
+		}
+		// Keys rotate rarely, but a client holding an old one gets a clear error and refetches
+		w.Header().Set("Cache-Control", "max-age=300")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// submitPayment stores the uploaded receipt, encrypting it unless the client already did, and records a payment
+// for loanID; resubmissionOf links it to a rejected attempt
+func submitPayment(db *Database, keys *Keyring, w http.ResponseWriter, r *http.Request, loanID int, resubmissionOf sql.NullInt64) {
+	// Receipts arrive either in plaintext, to be cleaned up and encrypted here, or already encrypted by the client
+	var upload *receiptUpload
+	var ok bool
+	if r.FormValue("wrapped_key") != "" {
+		upload, ok = readClientEncryptedReceipt(keys, w, r)
+	} else {
+		upload, ok = readPlainReceipt(keys, w, r)
+	}
+	if !ok {
+		return
+	}
+	encryptedParts, encryptedAESKey, keyID := upload.encryptedParts, upload.wrappedKey, upload.keyID
+	receiptType, contentHash := upload.receiptType, upload.contentHash
+	encryptedFile := encryptedParts[0]
+
+	// A byte-identical receipt that is already waiting or accepted is a duplicate submission. A hash the client
+	// asserted proves nothing about the file, so it is only compared with the borrower's own payments; otherwise
+	// anyone could probe hashes against other borrowers' receipts. Other borrowers' payment IDs are never shown.
+	duplicateQuery := `SELECT p.PaymentID, l.UserID = owner.UserID FROM payment p
+	                   JOIN loan l ON l.LoanID = p.LoanID
+	                   JOIN loan owner ON owner.LoanID = ?
+	                   WHERE p.ReceiptHash = ? AND p.CheckedStatus != 'rejected'`
+	if upload.clientHashed {
+		duplicateQuery += ` AND l.UserID = owner.UserID`
+	}
+	var duplicateID int
+	var ownPayment bool
+	err := db.QueryRow(duplicateQuery+` ORDER BY l.UserID = owner.UserID DESC LIMIT 1`, loanID, contentHash).Scan(&duplicateID, &ownPayment)
+	if err == nil {
+		if !ownPayment {
+			http.Error(w, "This receipt has already been submitted for another loan", http.StatusConflict)
+			return
+		}
+		http.Error(w, fmt.Sprintf("This receipt has already been submitted as payment %d", duplicateID), http.StatusConflict)
+		return
+	}
+	if err != sql.ErrNoRows {
+		http.Error(w, fmt.Sprintf("Error checking for duplicate receipts: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Query to retrieve loan due date and the amounts owed
+	query := `SELECT Amount, Duedate, ExtensionFee, Status FROM loan WHERE LoanID = ?`
+	var amount, extensionFee float64
+	var dueDateStr, loanStatus string
+	err = db.QueryRow(query, loanID).Scan(&amount, &dueDateStr, &extensionFee, &loanStatus)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Loan not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error querying loan due date: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Cancelled and repaid loans take no more payments
+	if loanStatus != "pending" {
+		http.Error(w, fmt.Sprintf("Loan %d is %s and does not accept payments", loanID, loanStatus), http.StatusConflict)
+		return
+	}
+
+	// Parse the due date
+	dueDate, err := fromDB(dueDateStr)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error parsing due date: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	dopayment := db.now()
+
+	// A due date on a weekend or holiday can still be met on the next business day
+	deadline, err := db.nextBusinessDay(dueDate)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error checking business days: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Determine payment status
+	status := "intime"
+	if dopayment.After(deadline) {
+		status = "late"
+	}
+
+	// Lock in the amount from a payoff quote if one was referenced, otherwise the full total is due
+	totalAmount, _, _ := calculateLoanDetails(amount, dueDate, db.now())
+	amountDue := totalAmount + extensionFee
+	var quoteID sql.NullInt64
+	if quoteIDStr := r.URL.Query().Get("quoteID"); quoteIDStr != "" {
+		id, err := strconv.Atoi(quoteIDStr)
+		if err != nil {
+			http.Error(w, "Invalid QuoteID format", http.StatusBadRequest)
+			return
+		}
+		amountDue, err = db.getUsablePayoffQuote(id, loanID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid payoff quote: %v", err), http.StatusBadRequest)
+			return
+		}
+		quoteID = sql.NullInt64{Int64: int64(id), Valid: true}
+	}
+
+	// Store the ciphertext first; if the payment row is never committed the blob is removed again
+	blobKey, err := newReceiptBlobKey(loanID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error naming receipt blob: %v", err), http.StatusInternalServerError)
+		return
+	}
+	var thumbnailKey sql.NullString
+	if len(encryptedParts) > 1 {
+		thumbnailKey = sql.NullString{String: blobKey + ".thumb", Valid: true}
+	}
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		for _, key := range []sql.NullString{{String: blobKey, Valid: true}, thumbnailKey} {
+			if !key.Valid {
+				continue
+			}
+			if err := db.blobs.Delete(key.String); err != nil {
+				log.Printf("Error removing unused receipt blob %s: %v", key.String, err)
+			}
+		}
+	}()
+	if err := db.blobs.Put(blobKey, encryptedFile); err != nil {
+		log.Printf("Error storing receipt blob: %v", err)
+		http.Error(w, "Error storing receipt", http.StatusInternalServerError)
+		return
+	}
+	if thumbnailKey.Valid {
+		if err := db.blobs.Put(thumbnailKey.String, encryptedParts[1]); err != nil {
+			log.Printf("Error storing thumbnail blob: %v", err)
+			http.Error(w, "Error storing receipt", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error starting transaction: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if resubmissionOf.Valid {
+		// Lock the rejected attempt so two resubmissions of it cannot both go through
+		var resubmitted bool
+		err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM payment WHERE ResubmissionOf = ?) FROM payment WHERE PaymentID = ? FOR UPDATE`,
+			resubmissionOf.Int64, resubmissionOf.Int64).Scan(&resubmitted)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error checking earlier resubmissions: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if resubmitted {
+			http.Error(w, "Payment has already been resubmitted", http.StatusConflict)
+			return
+		}
+	}
+
+	// Insert the payment record into the payment table, including the encrypted file and AES key
+	result, err := tx.Exec(`INSERT INTO payment (LoanID, DOPayment, Status, CheckedStatus, BlobKey, ReceiptChecksum, ThumbnailKey, AESKey, AESKeyID, KeyWrapVersion, QuoteID, AmountDue, ResubmissionOf, ReceiptHash, ReceiptType) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		loanID, toDB(dopayment), status, "waiting", blobKey, blobChecksum(encryptedFile), thumbnailKey, encryptedAESKey, keyID, upload.wrapVersion, quoteID, amountDue, resubmissionOf, contentHash, receiptType)
+	if err != nil {
+		log.Printf("Error inserting payment record: %v", err)
+		http.Error(w, fmt.Sprintf("Error inserting payment record: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	paymentID, err := result.LastInsertId()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting payment ID: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := db.signPayment(tx, int(paymentID)); err != nil {
+		http.Error(w, fmt.Sprintf("Error signing payment record: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if quoteID.Valid {
+		// Claim the quote; a concurrent payment that got there first leaves zero rows to update
+		claimed, err := tx.Exec(`UPDATE payoffquote SET PaymentID = ? WHERE QuoteID = ? AND PaymentID IS NULL`, paymentID, quoteID.Int64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error claiming payoff quote: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if n, err := claimed.RowsAffected(); err != nil || n == 0 {
+			http.Error(w, "Payoff quote has already been used", http.StatusConflict)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, fmt.Sprintf("Error committing payment: %v", err), http.StatusInternalServerError)
+		return
+	}
+	committed = true
+
+	// Prepare a success response
+	response := map[string]interface{}{
+		"message":   "Payment inserted and receipt encrypted successfully",
+		"amountDue": amountDue,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// paymentRejectReasons are the reason codes an admin can give when rejecting a payment
+var paymentRejectReasons = map[string]string{
+	"amount_mismatch":    "The amount paid does not match the amount due",
+	"unreadable_receipt": "The receipt image cannot be read",
+	"wrong_account":      "The transfer was not made to our account",
+	"duplicate":          "The receipt was already used for another payment",
+	"other":              "See the note from the reviewer",
+}
+
+// resubmitPayment lets a borrower upload a new receipt for a rejected payment, keeping the rejected attempt on record
+func resubmitPayment(db *Database, keys *Keyring) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := r.ParseMultipartForm(50 << 20); err != nil {
+			http.Error(w, "Error parsing form data", http.StatusBadRequest)
+			return
+		}
+
+		paymentID, err := strconv.Atoi(r.URL.Query().Get("paymentID"))
+		if err != nil {
+			http.Error(w, "Invalid PaymentID format", http.StatusBadRequest)
+			return
+		}
+
+		var loanID int
+		var checkedStatus string
+		err = db.QueryRow(`SELECT LoanID, CheckedStatus FROM payment WHERE PaymentID = ?`, paymentID).Scan(&loanID, &checkedStatus)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Payment not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, fmt.Sprintf("Error querying payment: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if checkedStatus != "rejected" {
+			http.Error(w, "Only rejected payments can be resubmitted", http.StatusConflict)
+			return
+		}
+
+		submitPayment(db, keys, w, r, loanID, sql.NullInt64{Int64: int64(paymentID), Valid: true})
+	}
+}
+
+// PaymentAttempt is one submitted payment in a loan's history
+type PaymentAttempt struct {
+	PaymentID      int     `json:"payment_id"`
+	DOPayment      string  `json:"do_payment"`
+	Status         string  `json:"status"`
+	CheckedStatus  string  `json:"checked_status"`
+	RejectReason   *string `json:"reject_reason,omitempty"`
+	RejectNote     *string `json:"reject_note,omitempty"`
+	ResubmissionOf *int    `json:"resubmission_of,omitempty"`
+}
+
+// GetPaymentHistory returns every payment attempt for a loan, oldest first
+func (db *Database) GetPaymentHistory(loanID int) ([]PaymentAttempt, error) {
+	query := `SELECT PaymentID, DOPayment, Status, CheckedStatus, RejectReason, RejectNote, ResubmissionOf
+	          FROM payment WHERE LoanID = ? ORDER BY PaymentID`
+	rows, err := db.Query(query, loanID)
+	if err != nil {
+		return nil, fmt.Errorf("querying payments: %w", err)
+	}
+	defer rows.Close()
+
+	attempts := []PaymentAttempt{}
+	for rows.Next() {
+		var attempt PaymentAttempt
+		var reason, note sql.NullString
+		var resubmissionOf sql.NullInt64
+		err := rows.Scan(&attempt.PaymentID, &attempt.DOPayment, &attempt.Status, &attempt.CheckedStatus, &reason, &note, &resubmissionOf)
+		if err != nil {
+			return nil, fmt.Errorf("scanning payment row: %w", err)
+		}
+
+		if attempt.DOPayment, err = db.dbToAPITime(attempt.DOPayment); err != nil {
+			return nil, fmt.Errorf("parsing payment date: %w", err)
+		}
+		if reason.Valid {
+			attempt.RejectReason = &reason.String
+		}
+		if note.Valid {
+			attempt.RejectNote = &note.String
+		}
+		if resubmissionOf.Valid {
+			id := int(resubmissionOf.Int64)
+			attempt.ResubmissionOf = &id
+		}
+		attempts = append(attempts, attempt)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return attempts, nil
+}
+
+func handlePaymentApproval(db *Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Received request to approve/reject payment for PaymentID: %s", r.URL.Query().Get("paymentID"))
+
+		// Check if the request method is POST
+		if r.Method != http.MethodPost {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Retrieve PaymentID and the action (accept/reject) from the query parameters
+		paymentIDStr := r.URL.Query().Get("paymentID")
+		action := r.URL.Query().Get("action")
+		if paymentIDStr == "" || action == "" {
+			http.Error(w, "PaymentID and action are required", http.StatusBadRequest)
+			return
+		}
+
+		// Convert PaymentID to integer
+		paymentID, err := strconv.Atoi(paymentIDStr)
+		if err != nil {
+			http.Error(w, "Invalid PaymentID format", http.StatusBadRequest)
+			return
+		}
+
+		// Check if action is valid (accept/reject)
+		if action != "accept" && action != "reject" {
+			http.Error(w, "Invalid action, must be either 'accept' or 'reject'", http.StatusBadRequest)
+			return
+		}
+
+		// A rejection has to tell the borrower what to fix
+		var reason, note sql.NullString
+		if action == "reject" {
+			reasonCode := r.URL.Query().Get("reason")
+			if _, ok := paymentRejectReasons[reasonCode]; !ok {
+				http.Error(w, "A valid rejection reason is required: amount_mismatch, unreadable_receipt, wrong_account, duplicate or other", http.StatusBadRequest)
+				return
+			}
+			reason = sql.NullString{String: reasonCode, Valid: true}
+			note.String = r.URL.Query().Get("note")
+			note.Valid = note.String != ""
+			if reasonCode == "other" && !note.Valid {
+				http.Error(w, "A note is required when the reason is 'other'", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// Update the checked status based on the action
+		checkedStatus := "rejected"
+		if action == "accept" {
+			checkedStatus = "accepted"
+		}
+
+		// Never approve a record that was changed outside the server, and re-sign it with the decision.
+		// The payment, its loan and the collateral change together or not at all.
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error starting transaction: %v", err), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		var loanID int
+		var currentStatus sql.NullString
+		err = tx.QueryRow(`SELECT LoanID, CheckedStatus FROM payment WHERE PaymentID = ? FOR UPDATE`, paymentID).Scan(&loanID, &currentStatus)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Payment not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, fmt.Sprintf("Error retrieving payment: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if currentStatus.String != "waiting" {
+			http.Error(w, fmt.Sprintf("Payment %d is not waiting for review", paymentID), http.StatusConflict)
+			return
+		}
+
+		if err := db.verifyPayment(tx, paymentID, "payment approval"); err != nil {
+			if err == errPaymentTampered {
+				http.Error(w, "Payment record failed its integrity check; see /getSecurityEvents", http.StatusConflict)
+				return
+			}
+			http.Error(w, fmt.Sprintf("Error verifying payment: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		// Update payment checked status for the specific PaymentID
+		_, err = tx.Exec(`UPDATE payment SET CheckedStatus = ?, RejectReason = ?, RejectNote = ? WHERE PaymentID = ? AND CheckedStatus = 'waiting'`,
+			checkedStatus, reason, note, paymentID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error updating payment checked status: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if err := db.signPayment(tx, paymentID); err != nil {
+			http.Error(w, fmt.Sprintf("Error signing payment record: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		// An accepted payment repays the loan, unless it was cancelled or settled in the meantime
+		if action == "accept" {
+			result, err := tx.Exec(`UPDATE loan SET Status = 'complete' WHERE LoanID = ? AND Status = 'pending'`, loanID)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error updating loan status to accepted: %v", err), http.StatusInternalServerError)
+				return
+			}
+			if n, err := result.RowsAffected(); err != nil || n == 0 {
+				http.Error(w, fmt.Sprintf("Loan %d is no longer pending, so the payment cannot be accepted", loanID), http.StatusConflict)
+				return
+			}
+
+			// A repaid loan releases any collateral still pledged against it
+			if err := resolveCollateral(tx, loanID, "released", db.now()); err != nil {
+				http.Error(w, fmt.Sprintf("Error releasing collateral: %v", err), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			http.Error(w, fmt.Sprintf("Error committing payment review: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		// Prepare a success response
+		response := map[string]string{
+			"message": fmt.Sprintf("Payment %s and status updated", action),
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func (db *Database) checkPaymentDetails(loanID int) (map[string]interface{}, error) {
+	query := `SELECT LoanID, DOPayment, Status FROM payment WHERE LoanID = ?`
+	var loanIDFromDB int
+	var doPayment, status string
+
+	err := db.QueryRow(query, loanID).Scan(&loanIDFromDB, &doPayment, &status)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("no payment found for LoanID %d", loanID)
+		}
+		return nil, fmt.Errorf("querying payment details: %w", err)
+	}
+
+	doPayment, err = db.dbToAPITime(doPayment)
+	if err != nil {
+		return nil, fmt.Errorf("parsing payment date: %w", err)
+	}
+
+	response := map[string]interface{}{
+		"loanID":    loanIDFromDB,
+		"doPayment": doPayment,
+		"status":    status,
+	}
+
+	return response, nil
+}
+
+// PAYMENT REVIEW
+
+// PaymentQueueFilter narrows the admin payment review queue
+type PaymentQueueFilter struct {
+	CheckedStatus string // defaults to "waiting"
+	Status        string // "intime" or "late", empty for both
+	UserID        int    // borrower, 0 for everyone
+	From, To      time.Time
+	Page          int
+	PageSize      int
+}
+
+// PaymentQueueItem is a submitted payment together with the loan it pays off
+type PaymentQueueItem struct {
+	PaymentID     int    `json:"payment_id"`
+	LoanID        int    `json:"loan_id"`
+	UserID        int    `json:"user_id"`
+	Borrower      string `json:"borrower"`
+	DOPayment     string `json:"do_payment"`
+	Status        string `json:"status"`
+	CheckedStatus string `json:"checked_status"`
+	QuoteID       *int   `json:"quote_id,omitempty"`
+	// ResubmissionOf points at the rejected payment this one replaces
+	ResubmissionOf *int     `json:"resubmission_of,omitempty"`
+	AmountDue      *float64 `json:"amount_due,omitempty"`
+	LoanAmount     float64  `json:"loan_amount"`
+	DueDateTime    string   `json:"due_date_time"`
+	LoanStatus     string   `json:"loan_status"`
+	Outstanding    float64  `json:"outstanding"`
+	// Integrity is "ok", or "tampered" if the record no longer matches its signature
+	Integrity string `json:"integrity"`
+}
+
+// PaymentQueuePage is one page of the review queue
+type PaymentQueuePage struct {
+	Payments []PaymentQueueItem `json:"payments"`
+	Page     int                `json:"page"`
+	PageSize int                `json:"page_size"`
+	Total    int                `json:"total"`
+}
+
+const maxPaymentQueuePageSize = 100
+
+// GetPaymentQueue lists submitted payments oldest first so reviewers can work through them in order
+func (db *Database) GetPaymentQueue(filter PaymentQueueFilter) (PaymentQueuePage, error) {
+	if filter.CheckedStatus == "" {
+		filter.CheckedStatus = "waiting"
+	}
+	if filter.Page < 1 {
+		filter.Page = 1
+	}
+	if filter.PageSize < 1 || filter.PageSize > maxPaymentQueuePageSize {
+		filter.PageSize = 20
+	}
+
+	conditions := []string{"p.CheckedStatus = ?"}
+	args := []interface{}{filter.CheckedStatus}
+	if filter.Status != "" {
+		conditions = append(conditions, "p.Status = ?")
+		args = append(args, filter.Status)
+	}
+	if filter.UserID != 0 {
+		conditions = append(conditions, "l.UserID = ?")
+		args = append(args, filter.UserID)
+	}
+	if !filter.From.IsZero() {
+		conditions = append(conditions, "p.DOPayment >= ?")
+		args = append(args, toDB(filter.From))
+	}
+	if !filter.To.IsZero() {
+		conditions = append(conditions, "p.DOPayment < ?")
+		args = append(args, toDB(filter.To))
+	}
+	where := strings.Join(conditions, " AND ")
+
+	page := PaymentQueuePage{Payments: []PaymentQueueItem{}, Page: filter.Page, PageSize: filter.PageSize}
+	countQuery := `SELECT COUNT(*) FROM payment p JOIN loan l ON p.LoanID = l.LoanID WHERE ` + where
+	if err := db.QueryRow(countQuery, args...).Scan(&page.Total); err != nil {
+		return page, fmt.Errorf("counting payments: %w", err)
+	}
+
+	query := `SELECT p.PaymentID, p.LoanID, l.UserID, CONCAT(u.FirstName, ' ', u.LastName), p.DOPayment, p.Status, p.CheckedStatus,
+	                 p.QuoteID, p.ResubmissionOf, p.AmountDue, l.Amount, l.Duedate, l.Status, l.ExtensionFee, q.TotalDue
+	          FROM payment p
+	          JOIN loan l ON p.LoanID = l.LoanID
+	          JOIN user u ON l.UserID = u.UserID
+	          LEFT JOIN payoffquote q ON q.QuoteID = p.QuoteID
+	          WHERE ` + where + `
+	          ORDER BY p.DOPayment, p.PaymentID
+	          LIMIT ? OFFSET ?`
+	rows, err := db.Query(query, append(args, filter.PageSize, (filter.Page-1)*filter.PageSize)...)
+	if err != nil {
+		return page, fmt.Errorf("querying payments: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item PaymentQueueItem
+		var quoteID, resubmissionOf sql.NullInt64
+		var amountDue, quoteTotal sql.NullFloat64
+		var extensionFee float64
+		err := rows.Scan(&item.PaymentID, &item.LoanID, &item.UserID, &item.Borrower, &item.DOPayment, &item.Status, &item.CheckedStatus,
+			&quoteID, &resubmissionOf, &amountDue, &item.LoanAmount, &item.DueDateTime, &item.LoanStatus, &extensionFee, &quoteTotal)
+		if err != nil {
+			return page, fmt.Errorf("scanning payment row: %w", err)
+		}
+
+		if quoteID.Valid {
+			id := int(quoteID.Int64)
+			item.QuoteID = &id
+		}
+		if resubmissionOf.Valid {
+			id := int(resubmissionOf.Int64)
+			item.ResubmissionOf = &id
+		}
+		if amountDue.Valid {
+			item.AmountDue = &amountDue.Float64
+		}
+
+		dueDate, err := fromDB(item.DueDateTime)
+		if err != nil {
+			return page, fmt.Errorf("parsing due date: %w", err)
+		}
+		// A payment made against a payoff quote settles the loan for the quoted amount, rebate included
+		switch {
+		case item.LoanStatus != "pending":
+		case quoteTotal.Valid:
+			item.Outstanding = quoteTotal.Float64
+		default:
+			totalAmount, _, _ := calculateLoanDetails(item.LoanAmount, dueDate, db.now())
+			item.Outstanding = roundToTwoDecimalPlaces(totalAmount + extensionFee)
+		}
+
+		item.DueDateTime = db.formatAPITime(dueDate)
+		if item.DOPayment, err = db.dbToAPITime(item.DOPayment); err != nil {
+			return page, fmt.Errorf("parsing payment date: %w", err)
+		}
+		page.Payments = append(page.Payments, item)
+	}
+
+	if err := rows.Err(); err != nil {
+		return page, fmt.Errorf("error iterating rows: %w", err)
+	}
+	rows.Close()
+
+	for i := range page.Payments {
+		page.Payments[i].Integrity = "ok"
+		if err := db.verifyPayment(db, page.Payments[i].PaymentID, "payment queue"); err != nil {
+			if err != errPaymentTampered {
+				return page, err
+			}
+			page.Payments[i].Integrity = "tampered"
+		}
+	}
+	return page, nil
+}
+
+// getPaymentQueue parses the review queue filters from the query string
+func getPaymentQueue(db *Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.URL.Query()
+		filter := PaymentQueueFilter{
+			CheckedStatus: query.Get("checkedStatus"),
+			Status:        query.Get("status"),
+		}
+
+		switch filter.CheckedStatus {
+		case "", "waiting", "accepted", "rejected":
+		default:
+			http.Error(w, "Invalid checkedStatus, must be 'waiting', 'accepted' or 'rejected'", http.StatusBadRequest)
+			return
+		}
+		if filter.Status != "" && filter.Status != "intime" && filter.Status != "late" {
+			http.Error(w, "Invalid status, must be either 'intime' or 'late'", http.StatusBadRequest)
+			return
+		}
+
+		for name, target := range map[string]*int{"userID": &filter.UserID, "page": &filter.Page, "pageSize": &filter.PageSize} {
+			if value := query.Get(name); value != "" {
+				n, err := strconv.Atoi(value)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("Invalid %s format", name), http.StatusBadRequest)
+					return
+				}
+				*target = n
+			}
+		}
+
+		// Dates are whole days in business time; "to" includes the day it names
+		if from := query.Get("from"); from != "" {
+			t, err := db.parseAPITime(apiDateLayout, from)
+			if err != nil {
+				http.Error(w, "Invalid from date, expected YYYY-MM-DD", http.StatusBadRequest)
+				return
+			}
+			filter.From = t
+		}
+		if to := query.Get("to"); to != "" {
+			t, err := db.parseAPITime(apiDateLayout, to)
+			if err != nil {
+				http.Error(w, "Invalid to date, expected YYYY-MM-DD", http.StatusBadRequest)
+				return
+			}
+			filter.To = t.AddDate(0, 0, 1)
+		}
+
+		page, err := db.GetPaymentQueue(filter)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to get payment queue: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	}
+}
+
+func CheckAdminPassword(db *Database, password string) (bool, error) {
+	var storedHash string
+
+	// Query to get the stored password hash from the adminpassword table
+	query := `SELECT PasswordHash FROM adminpassword LIMIT 1`
+	err := db.QueryRow(query).Scan(&storedHash)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, fmt.Errorf("no admin password found")
+		}
+		return false, fmt.Errorf("querying admin password: %w", err)
+	}
+
+	// Compare the hashed provided password with the stored hash
+	if err := bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(password)); err != nil {
+		return false, nil // Password does not match
+	}
+
+	return true, nil // Password matches
+}
+
+func getPaymentStatus(db *Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Enable CORS if needed
+		w.Header().Set("Content-Type", "application/json")
+
+		// Parse loanID from query parameters
+		loanIDStr := r.URL.Query().Get("loanID")
+		if loanIDStr == "" {
+			http.Error(w, "loanID is required", http.StatusBadRequest)
+			return
+		}
+
+		loanID, err := strconv.Atoi(loanIDStr)
+		if err != nil {
+			http.Error(w, "Invalid loanID format", http.StatusBadRequest)
+			return
+		}
+
+		// Query for the latest payment for that loan
+		query := `
+			SELECT PaymentID, CheckedStatus, RejectReason, RejectNote, ResubmissionOf
+			FROM payment
+			WHERE LoanID = ?
+			ORDER BY PaymentID DESC
+			LIMIT 1
+		`
+
+		var paymentID int
+		var checkedStatus string
+		var rejectReason, rejectNote sql.NullString
+		var resubmissionOf sql.NullInt64
+
+		err = db.QueryRow(query, loanID).Scan(&paymentID, &checkedStatus, &rejectReason, &rejectNote, &resubmissionOf)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				// Return null if no payment is found
+				response := map[string]interface{}{
+					"PaymentID":     nil,
+					"CheckedStatus": nil,
+				}
+				json.NewEncoder(w).Encode(response)
+				return
+			}
+			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Prepare and send the response
+		response := map[string]interface{}{
+			"PaymentID":     paymentID,
+			"CheckedStatus": checkedStatus,
+		}
+		if rejectReason.Valid {
+			response["RejectReason"] = rejectReason.String
+			response["RejectReasonText"] = paymentRejectReasons[rejectReason.String]
+		}
+		if rejectNote.Valid {
+			response["RejectNote"] = rejectNote.String
+		}
+		if resubmissionOf.Valid {
+			response["ResubmissionOf"] = resubmissionOf.Int64
+		}
+
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// IDEMPOTENCY
+
+// responseRecorder passes a response through to the client while keeping a copy, for replaying or auditing
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(data []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(data)
+	return rec.ResponseWriter.Write(data)
+}
+
+// requestFingerprint identifies a request by its query string and content. A multipart body is reduced to
+// its field names, file names and content digests, because a retried upload is sent with a new random boundary.
+func requestFingerprint(r *http.Request, body []byte) (string, error) {
+	hash := sha256.New()
+	hash.Write([]byte(r.URL.RawQuery))
+	hash.Write([]byte{0})
+
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		hash.Write(body)
+		return hex.EncodeToString(hash.Sum(nil)), nil
+	}
+
+	var parts []string
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		digest := sha256.New()
+		if _, err := io.Copy(digest, part); err != nil {
+			return "", err
+		}
+		parts = append(parts, fmt.Sprintf("%s\x00%s\x00%x", part.FormName(), part.FileName(), digest.Sum(nil)))
+	}
+	// Clients are free to order the fields differently on a retry
+	sort.Strings(parts)
+	for _, part := range parts {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// idempotent makes retries of a request carrying the same Idempotency-Key replay the first successful response
+// instead of running the handler again. Requests without the header are passed straight through.
+func idempotent(db *Database, scope string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || r.Method != http.MethodPost {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > 100 {
+			http.Error(w, "Idempotency-Key must be at most 100 characters", http.StatusBadRequest)
+			return
+		}
+
+		// Fingerprint the request so a key cannot be reused for a different payload
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 50<<20))
+		if err != nil {
+			http.Error(w, "Error reading request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		requestHash, err := requestFingerprint(r, body)
+		if err != nil {
+			http.Error(w, "Invalid multipart body", http.StatusBadRequest)
+			return
+		}
+
+		windowHours, err := db.GetSetting("idempotency_window_hours")
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error reading idempotency window: %v", err), http.StatusInternalServerError)
+			return
+		}
+		now := db.now()
+		expiredBefore := now.Add(-time.Duration(windowHours * float64(time.Hour)))
+
+		if _, err := db.Exec(`DELETE FROM idempotencykey WHERE Scope = ? AND IdemKey = ? AND CreatedAt < ?`, scope, key, toDB(expiredBefore)); err != nil {
+			http.Error(w, fmt.Sprintf("Error expiring idempotency key: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		// Whoever inserts the key first runs the request; everyone else waits for its stored response
+		claimed, err := db.Exec(`INSERT IGNORE INTO idempotencykey (Scope, IdemKey, RequestHash, CreatedAt) VALUES (?, ?, ?, ?)`,
+			scope, key, requestHash, toDB(now))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error recording idempotency key: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if n, err := claimed.RowsAffected(); err == nil && n == 0 {
+			var storedHash, contentType sql.NullString
+			var statusCode sql.NullInt64
+			var responseBody []byte
+			err := db.QueryRow(`SELECT RequestHash, StatusCode, ContentType, ResponseBody FROM idempotencykey WHERE Scope = ? AND IdemKey = ?`,
+				scope, key).Scan(&storedHash, &statusCode, &contentType, &responseBody)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error reading idempotency key: %v", err), http.StatusInternalServerError)
+				return
+			}
+			if storedHash.String != requestHash {
+				http.Error(w, "Idempotency-Key was already used for a different request", http.StatusUnprocessableEntity)
+				return
+			}
+			if !statusCode.Valid {
+				http.Error(w, "A request with this Idempotency-Key is still being processed", http.StatusConflict)
+				return
+			}
+
+			w.Header().Set("Content-Type", contentType.String)
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(int(statusCode.Int64))
+			w.Write(responseBody)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+
+		// Only successes are kept; a failed attempt frees the key so the client can retry it
+		if rec.status >= 200 && rec.status < 300 {
+			_, err = db.Exec(`UPDATE idempotencykey SET StatusCode = ?, ContentType = ?, ResponseBody = ? WHERE Scope = ? AND IdemKey = ?`,
+				rec.status, w.Header().Get("Content-Type"), rec.body.Bytes(), scope, key)
+		} else {
+			_, err = db.Exec(`DELETE FROM idempotencykey WHERE Scope = ? AND IdemKey = ?`, scope, key)
+		}
+		if err != nil {
+			log.Printf("Error saving idempotent response for %s key %s: %v", scope, key, err)
+		}
+	})
+}
+
+// receiptHash identifies a receipt by its plaintext content so the same file cannot pay twice
+func receiptHash(receipt []byte) string {
+	sum := sha256.Sum256(receipt)
+	return hex.EncodeToString(sum[:])
+}
+
+//PAYMENT SIGNATURES
+
+// dataKeyPaymentSigning is the data key that payment record signatures are computed with
+const dataKeyPaymentSigning = "payment-signing"
+
+// errPaymentTampered is returned when a payment record no longer matches its signature
+var errPaymentTampered = errors.New("payment record failed its integrity check")
+
+// sqlExecutor is satisfied by both *Database and *sql.Tx
+type sqlExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// signedPaymentColumns are the payment columns covered by RecordSignature. ReceiptChecksum ties the
+// signature to the encrypted receipt; the wrapped AES key is left out because key rotation rewrites it.
+const signedPaymentColumns = `PaymentID, LoanID, DOPayment, Status, CheckedStatus, QuoteID, AmountDue, ResubmissionOf,
+	RejectReason, RejectNote, ReceiptHash, ReceiptType, BlobKey, ReceiptChecksum, ThumbnailKey`
+
+// signedPayment is the canonical form of a payment record that is signed, encoded as JSON
+type signedPayment struct {
+	Version         int             `json:"v"`
+	PaymentID       int             `json:"payment_id"`
+	LoanID          int             `json:"loan_id"`
+	DOPayment       string          `json:"do_payment"`
+	Status          sql.NullString  `json:"status"`
+	CheckedStatus   sql.NullString  `json:"checked_status"`
+	QuoteID         sql.NullInt64   `json:"quote_id"`
+	AmountDue       sql.NullFloat64 `json:"amount_due"`
+	ResubmissionOf  sql.NullInt64   `json:"resubmission_of"`
+	RejectReason    sql.NullString  `json:"reject_reason"`
+	RejectNote      sql.NullString  `json:"reject_note"`
+	ReceiptHash     sql.NullString  `json:"receipt_hash"`
+	ReceiptType     sql.NullString  `json:"receipt_type"`
+	BlobKey         sql.NullString  `json:"blob_key"`
+	ReceiptChecksum sql.NullString  `json:"receipt_checksum"`
+	ThumbnailKey    sql.NullString  `json:"thumbnail_key"`
+}
+
+// paymentSignature loads a payment record and computes the signature it should carry, along with the one it has
+func (db *Database) paymentSignature(ex sqlExecutor, paymentID int) (expected string, stored sql.NullString, err error) {
+	record := signedPayment{Version: 1}
+	query := `SELECT ` + signedPaymentColumns + `, RecordSignature FROM payment WHERE PaymentID = ?`
+	err = ex.QueryRow(query, paymentID).Scan(&record.PaymentID, &record.LoanID, &record.DOPayment, &record.Status, &record.CheckedStatus,
+		&record.QuoteID, &record.AmountDue, &record.ResubmissionOf, &record.RejectReason, &record.RejectNote, &record.ReceiptHash,
+		&record.ReceiptType, &record.BlobKey, &record.ReceiptChecksum, &record.ThumbnailKey, &stored)
+	if err != nil {
+		return "", stored, fmt.Errorf("loading payment %d: %w", paymentID, err)
+	}
+
+	canonical, err := json.Marshal(record)
+	if err != nil {
+		return "", stored, fmt.Errorf("encoding payment %d: %w", paymentID, err)
+	}
+	mac := hmac.New(sha256.New, db.signingKey)
+	mac.Write(canonical)
+	return hex.EncodeToString(mac.Sum(nil)), stored, nil
+}
+
+// signPayment (re)signs a payment record after the server has written it
+func (db *Database) signPayment(ex sqlExecutor, paymentID int) error {
+	signature, _, err := db.paymentSignature(ex, paymentID)
+	if err != nil {
+		return err
+	}
+	if _, err := ex.Exec(`UPDATE payment SET RecordSignature = ? WHERE PaymentID = ?`, signature, paymentID); err != nil {
+		return fmt.Errorf("signing payment %d: %w", paymentID, err)
+	}
+	return nil
+}
+
+// verifyPayment checks a payment record against its signature. A mismatch is logged and recorded as a
+// security event, and errPaymentTampered is returned.
+func (db *Database) verifyPayment(ex sqlExecutor, paymentID int, context string) error {
+	expected, stored, err := db.paymentSignature(ex, paymentID)
+	if err != nil {
+		return err
+	}
+	if stored.Valid && hmac.Equal([]byte(expected), []byte(stored.String)) {
+		return nil
+	}
+
+	detail := fmt.Sprintf("payment %d does not match its signature (seen by %s)", paymentID, context)
+	if !stored.Valid {
+		detail = fmt.Sprintf("payment %d has no signature (seen by %s)", paymentID, context)
+	}
+	db.recordSecurityEvent("payment_signature_invalid", sql.NullInt64{Int64: int64(paymentID), Valid: true}, detail)
+	return errPaymentTampered
+}
+
+// loadPaymentSigner loads the payment signing key and signs any payments stored before signing existed
+func (db *Database) loadPaymentSigner(keys *Keyring) error {
+	key, err := db.loadDataKey(keys, dataKeyPaymentSigning)
+	if err != nil {
+		return err
+	}
+	db.signingKey = key
+
+	return db.runMigration("sign-payments", db.signAllPayments)
+}
+
+// signAllPayments signs every payment record as it currently stands. Receipts still stored inline get
+// a ciphertext checksum first, so the signature covers them too.
+func (db *Database) signAllPayments(tx *sql.Tx) error {
+	if _, err := tx.Exec(`UPDATE payment SET ReceiptChecksum = SHA2(Receipt, 256) WHERE Receipt IS NOT NULL AND ReceiptChecksum IS NULL`); err != nil {
+		return fmt.Errorf("computing receipt checksums: %w", err)
+	}
+
+	rows, err := tx.Query(`SELECT PaymentID FROM payment`)
+	if err != nil {
+		return fmt.Errorf("querying payments: %w", err)
+	}
+	var paymentIDs []int
+	for rows.Next() {
+		var paymentID int
+		if err := rows.Scan(&paymentID); err != nil {
+			rows.Close()
+			return fmt.Errorf("scanning payment: %w", err)
+		}
+		paymentIDs = append(paymentIDs, paymentID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	for _, paymentID := range paymentIDs {
+		if err := db.signPayment(tx, paymentID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//SECURITY EVENTS
+
+// SecurityEvent is a detected integrity problem for admins to investigate
+type SecurityEvent struct {
+	EventID   int    `json:"event_id"`
+	Kind      string `json:"kind"`
+	PaymentID *int   `json:"payment_id,omitempty"`
+	Detail    string `json:"detail"`
+	CreatedAt string `json:"created_at"`
+}
+
+// securityEventRepeatWindow stops one tampered record from flooding the log every time it is read
+const securityEventRepeatWindow = time.Hour
+
+// recordSecurityEvent logs a security event and stores it unless the same one was stored recently.
+// Failing to store it is only logged, so the read that detected the problem still fails safely.
+func (db *Database) recordSecurityEvent(kind string, paymentID sql.NullInt64, detail string) {
+	log.Printf("SECURITY EVENT %s: %s", kind, detail)
+
+	_, err := db.Exec(`INSERT INTO securityevent (Kind, PaymentID, Detail, CreatedAt)
+	                   SELECT ?, ?, ?, ? FROM DUAL
+	                   WHERE NOT EXISTS (SELECT 1 FROM securityevent WHERE Kind = ? AND PaymentID <=> ? AND CreatedAt > ?)`,
+		kind, paymentID, detail, toDB(db.now()), kind, paymentID, toDB(db.now().Add(-securityEventRepeatWindow)))
+	if err != nil {
+		log.Printf("Error storing security event: %v", err)
+	}
+}
+
+// GetSecurityEvents lists security events, newest first
+func (db *Database) GetSecurityEvents(limit int) ([]SecurityEvent, error) {
+	rows, err := db.Query(`SELECT EventID, Kind, PaymentID, Detail, CreatedAt FROM securityevent ORDER BY EventID DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("querying security events: %w", err)
+	}
+	defer rows.Close()
+
+	events := []SecurityEvent{}
+	for rows.Next() {
+		var event SecurityEvent
+		var paymentID sql.NullInt64
+		if err := rows.Scan(&event.EventID, &event.Kind, &paymentID, &event.Detail, &event.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scanning security event: %w", err)
+		}
+		if paymentID.Valid {
+			id := int(paymentID.Int64)
+			event.PaymentID = &id
+		}
+		if event.CreatedAt, err = db.dbToAPITime(event.CreatedAt); err != nil {
+			return nil, fmt.Errorf("parsing event time: %w", err)
+		}
+		events = append(events, event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return events, nil
+}
+
+//AUDIT LOG
+
+// dataKeyAuditChain is the data key audit entries are chained with
+const dataKeyAuditChain = "audit-chain"
+
+// auditGenesisHash is the PrevHash of the first audit entry
+var auditGenesisHash = strings.Repeat("0", 64)
+
+// AuditEntry is one privileged or sensitive action. Entries are never updated or deleted; each one's
+// EntryHash is an HMAC over its content and the previous entry's hash, so removing or editing an entry
+// breaks the chain from that point on.
+type AuditEntry struct {
+	AuditID        int64           `json:"audit_id"`
+	OccurredAt     string          `json:"occurred_at"`
+	ActorAccountID *int            `json:"actor_account_id,omitempty"`
+	ActorRole      string          `json:"actor_role"` // admin, user, cli or anonymous
+	Action         string          `json:"action"`
+	EntityType     string          `json:"entity_type"`
+	EntityID       string          `json:"entity_id,omitempty"`
+	Before         json.RawMessage `json:"before,omitempty"`
+	After          json.RawMessage `json:"after,omitempty"`
+	StatusCode     int             `json:"status_code"`
+	IP             string          `json:"ip"`
+	RequestID      string          `json:"request_id"`
+	PrevHash       string          `json:"prev_hash"`
+	EntryHash      string          `json:"entry_hash"`
+}
+
+// auditHash chains an entry to the one before it. OccurredAt is hashed in its stored form, so the
+// chain can be recomputed from the table alone.
+func (db *Database) auditHash(entry AuditEntry, occurredAt string) string {
+	content := entry
+	content.AuditID, content.OccurredAt, content.EntryHash = 0, occurredAt, ""
+	canonical, _ := json.Marshal(content)
+
+	mac := hmac.New(sha256.New, db.auditKey)
+	mac.Write([]byte(entry.PrevHash))
+	mac.Write(canonical)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// appendAudit adds an entry to the end of the chain. The chain head row serializes writers, so
+// entries from concurrent requests still form a single chain.
+func (db *Database) appendAudit(entry AuditEntry) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := tx.QueryRow(`SELECT LastHash FROM auditchain WHERE ChainID = 1 FOR UPDATE`).Scan(&entry.PrevHash); err != nil {
+		return fmt.Errorf("locking audit chain: %w", err)
+	}
+	occurredAt := toDB(db.now())
+	entry.EntryHash = db.auditHash(entry, occurredAt)
+
+	var before, after sql.NullString
+	if entry.Before != nil {
+		before = sql.NullString{String: string(entry.Before), Valid: true}
+	}
+	if entry.After != nil {
+		after = sql.NullString{String: string(entry.After), Valid: true}
+	}
+	result, err := tx.Exec(`INSERT INTO auditlog (OccurredAt, ActorAccountID, ActorRole, Action, EntityType, EntityID, BeforeValue, AfterValue,
+	                                              StatusCode, IP, RequestID, PrevHash, EntryHash)
+	                        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		occurredAt, entry.ActorAccountID, entry.ActorRole, entry.Action, entry.EntityType, entry.EntityID, before, after,
+		entry.StatusCode, entry.IP, entry.RequestID, entry.PrevHash, entry.EntryHash)
+	if err != nil {
+		return fmt.Errorf("inserting audit entry: %w", err)
+	}
+	auditID, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("getting audit entry ID: %w", err)
+	}
+	if _, err := tx.Exec(`UPDATE auditchain SET LastHash = ?, LastAuditID = ? WHERE ChainID = 1`, entry.EntryHash, auditID); err != nil {
+		return fmt.Errorf("advancing audit chain: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing audit entry: %w", err)
+	}
+	return nil
+}
+
+// loadAuditKey loads the key audit entries are chained with
+func (db *Database) loadAuditKey(keys *Keyring) error {
+	key, err := db.loadDataKey(keys, dataKeyAuditChain)
+	if err != nil {
+		return err
+	}
+	db.auditKey = key
+	return nil
+}
+
+// AuditFilter selects audit entries; zero values match everything
+type AuditFilter struct {
+	ActorAccountID int
+	Action         string
+	EntityType     string
+	EntityID       string
+	RequestID      string
+	From, To       time.Time
+	Page           int
+	PageSize       int
+}
+
+// AuditPage is one page of the audit log
+type AuditPage struct {
+	Entries  []AuditEntry `json:"entries"`
+	Page     int          `json:"page"`
+	PageSize int          `json:"page_size"`
+	Total    int          `json:"total"`
+}
+
+// maxAuditPageSize caps how many entries one request can return
+const maxAuditPageSize = 200
+
+// GetAuditLog returns matching audit entries, newest first
+func (db *Database) GetAuditLog(filter AuditFilter) (AuditPage, error) {
+	if filter.Page < 1 {
+		filter.Page = 1
+	}
+	if filter.PageSize < 1 || filter.PageSize > maxAuditPageSize {
+		filter.PageSize = 50
+	}
+
+	conditions := []string{"1 = 1"}
+	var args []interface{}
+	if filter.ActorAccountID != 0 {
+		conditions = append(conditions, "ActorAccountID = ?")
+		args = append(args, filter.ActorAccountID)
+	}
+	for _, match := range []struct{ column, value string }{
+		{"Action", filter.Action}, {"EntityType", filter.EntityType}, {"EntityID", filter.EntityID}, {"RequestID", filter.RequestID},
+	} {
+		if match.value != "" {
+			conditions = append(conditions, match.column+" = ?")
+			args = append(args, match.value)
+		}
+	}
+	if !filter.From.IsZero() {
+		conditions = append(conditions, "OccurredAt >= ?")
+		args = append(args, toDB(filter.From))
+	}
+	if !filter.To.IsZero() {
+		conditions = append(conditions, "OccurredAt < ?")
+		args = append(args, toDB(filter.To))
+	}
+	where := strings.Join(conditions, " AND ")
+
+	page := AuditPage{Entries: []AuditEntry{}, Page: filter.Page, PageSize: filter.PageSize}
+	if err := db.QueryRow(`SELECT COUNT(*) FROM auditlog WHERE `+where, args...).Scan(&page.Total); err != nil {
+		return page, fmt.Errorf("counting audit entries: %w", err)
+	}
+
+	query := `SELECT ` + auditColumns + ` FROM auditlog WHERE ` + where + ` ORDER BY AuditID DESC LIMIT ? OFFSET ?`
+	rows, err := db.Query(query, append(args, filter.PageSize, (filter.Page-1)*filter.PageSize)...)
+	if err != nil {
+		return page, fmt.Errorf("querying audit log: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry, occurredAt, err := scanAuditEntry(rows)
+		if err != nil {
+			return page, err
+		}
+		if entry.OccurredAt, err = db.dbToAPITime(occurredAt); err != nil {
+			return page, fmt.Errorf("parsing audit time: %w", err)
+		}
+		page.Entries = append(page.Entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return page, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return page, nil
+}
+
+const auditColumns = `AuditID, OccurredAt, ActorAccountID, ActorRole, Action, EntityType, EntityID, BeforeValue, AfterValue,
+	StatusCode, IP, RequestID, PrevHash, EntryHash`
+
+// scanAuditEntry reads one auditlog row, returning OccurredAt in its stored form
+func scanAuditEntry(rows *sql.Rows) (AuditEntry, string, error) {
+	var entry AuditEntry
+	var occurredAt string
+	var actorAccountID sql.NullInt64
+	var before, after sql.NullString
+	err := rows.Scan(&entry.AuditID, &occurredAt, &actorAccountID, &entry.ActorRole, &entry.Action, &entry.EntityType, &entry.EntityID,
+		&before, &after, &entry.StatusCode, &entry.IP, &entry.RequestID, &entry.PrevHash, &entry.EntryHash)
+	if err != nil {
+		return entry, "", fmt.Errorf("scanning audit entry: %w", err)
+	}
+	if actorAccountID.Valid {
+		id := int(actorAccountID.Int64)
+		entry.ActorAccountID = &id
+	}
+	if before.Valid {
+		entry.Before = json.RawMessage(before.String)
+	}
+	if after.Valid {
+		entry.After = json.RawMessage(after.String)
+	}
+	return entry, occurredAt, nil
+}
+
+// AuditVerification is the result of walking the audit chain
+type AuditVerification struct {
+	Entries int  `json:"entries"`
+	Valid   bool `json:"valid"`
+	// BrokenAt is the first entry that does not follow from the one before it
+	BrokenAt *int64 `json:"broken_at,omitempty"`
+	Problem  string `json:"problem,omitempty"`
+}
+
+// VerifyAuditLog recomputes the whole chain and checks that it ends at the recorded chain head, which
+// also catches entries removed from the end
+func (db *Database) VerifyAuditLog() (AuditVerification, error) {
+	var result AuditVerification
+	var headHash string
+	var headID int64
+	if err := db.QueryRow(`SELECT LastHash, LastAuditID FROM auditchain WHERE ChainID = 1`).Scan(&headHash, &headID); err != nil {
+		return result, fmt.Errorf("reading audit chain head: %w", err)
+	}
+
+	rows, err := db.Query(`SELECT ` + auditColumns + ` FROM auditlog ORDER BY AuditID`)
+	if err != nil {
+		return result, fmt.Errorf("querying audit log: %w", err)
+	}
+	defer rows.Close()
+
+	prevHash, lastID := auditGenesisHash, int64(0)
+	for rows.Next() {
+		entry, occurredAt, err := scanAuditEntry(rows)
+		if err != nil {
+			return result, err
+		}
+		result.Entries++
+
+		problem := ""
+		switch {
+		case entry.PrevHash != prevHash:
+			problem = "does not link to the previous entry"
+		case !hmac.Equal([]byte(db.auditHash(entry, occurredAt)), []byte(entry.EntryHash)):
+			problem = "content does not match its hash"
+		}
+		if problem != "" {
+			result.BrokenAt, result.Problem = &entry.AuditID, fmt.Sprintf("entry %d %s", entry.AuditID, problem)
+			return result, nil
+		}
+		prevHash, lastID = entry.EntryHash, entry.AuditID
+	}
+	if err := rows.Err(); err != nil {
+		return result, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	if prevHash != headHash || lastID != headID {
+		result.Problem = fmt.Sprintf("chain ends at entry %d but the head records entry %d", lastID, headID)
+		return result, nil
+	}
+	result.Valid = true
+	return result, nil
+}
+
+// getAuditLog serves the audit log to admins for compliance review
+func getAuditLog(db *Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.URL.Query()
+		filter := AuditFilter{
+			Action:     query.Get("action"),
+			EntityType: query.Get("entityType"),
+			EntityID:   query.Get("entityID"),
+			RequestID:  query.Get("requestID"),
+		}
+		for name, target := range map[string]*int{"actorAccountID": &filter.ActorAccountID, "page": &filter.Page, "pageSize": &filter.PageSize} {
+			if value := query.Get(name); value != "" {
+				n, err := strconv.Atoi(value)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("Invalid %s format", name), http.StatusBadRequest)
+					return
+				}
+				*target = n
+			}
+		}
+
+		// Dates are whole days in business time; "to" includes the day it names
+		if from := query.Get("from"); from != "" {
+			t, err := db.parseAPITime(apiDateLayout, from)
+			if err != nil {
+				http.Error(w, "Invalid from date, expected YYYY-MM-DD", http.StatusBadRequest)
+				return
+			}
+			filter.From = t
+		}
+		if to := query.Get("to"); to != "" {
+			t, err := db.parseAPITime(apiDateLayout, to)
+			if err != nil {
+				http.Error(w, "Invalid to date, expected YYYY-MM-DD", http.StatusBadRequest)
+				return
+			}
+			filter.To = t.AddDate(0, 0, 1)
+		}
+
+		page, err := db.GetAuditLog(filter)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to get audit log: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	}
+}
+
+// requestIDKey is the context key for the request ID
+type requestIDKey struct{}
+
+// withRequestID gives every request an ID, taken from a well-formed X-Request-ID header or generated,
+// and returns it in the X-Request-ID response header
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if len(requestID) == 0 || len(requestID) > 64 || strings.Trim(requestID, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.") != "" {
+			idBytes := make([]byte, 16)
+			rand.Read(idBytes)
+			requestID = hex.EncodeToString(idBytes)
+		}
+		w.Header().Set("X-Request-ID", requestID)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, requestID)))
+	})
+}
+
+// auditSpec describes how an endpoint is audited
+type auditSpec struct {
+	action      string
+	entityType  string
+	entityParam string // query parameter holding the entity ID
+	// snapshot captures the entity before and after the handler runs
+	snapshot func(db *Database, entityID string) (interface{}, error)
+	// recordResponse stores the JSON response as the after value, for actions that create the entity
+	recordResponse bool
+}
+
+// audited records every call of an endpoint in the audit log, successful or not. The action has
+// already happened when the entry is written, so a failure to write it is logged rather than returned.
+func audited(db *Database, spec auditSpec, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entityID := ""
+		if spec.entityParam != "" {
+			entityID = r.URL.Query().Get(spec.entityParam)
+		}
+		entry := db.requestAuditEntry(r, spec.action, spec.entityType, entityID)
+
+		takeSnapshot := func() json.RawMessage {
+			if spec.snapshot == nil {
+				return nil
+			}
+			value, err := spec.snapshot(db, entry.EntityID)
+			if err != nil {
+				log.Printf("Error taking audit snapshot of %s %s: %v", spec.entityType, entry.EntityID, err)
+				return nil
+			}
+			if value == nil {
+				return nil
+			}
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				return nil
+			}
+			return encoded
+		}
+
+		entry.Before = takeSnapshot()
+		rec := &responseRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		entry.StatusCode = rec.status
+		if entry.StatusCode == 0 {
+			entry.StatusCode = http.StatusOK
+		}
+
+		if entry.StatusCode/100 == 2 {
+			entry.After = takeSnapshot()
+			if spec.recordResponse && json.Valid(rec.body.Bytes()) {
+				entry.After = json.RawMessage(bytes.TrimSpace(rec.body.Bytes()))
+			}
+		}
+
+		db.recordAudit(entry)
+	})
+}
+
+// requestAuditEntry starts an audit entry for a request, with the caller's session, IP and request ID
+func (db *Database) requestAuditEntry(r *http.Request, action, entityType, entityID string) AuditEntry {
+	entry := AuditEntry{Action: action, EntityType: entityType, EntityID: entityID, ActorRole: "anonymous"}
+	if session, err := db.sessionFromRequest(r); err == nil {
+		entry.ActorAccountID, entry.ActorRole = &session.AccountID, session.Role
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		entry.IP = host
+	}
+	entry.RequestID, _ = r.Context().Value(requestIDKey{}).(string)
+	return entry
+}
+
+// recordAudit appends an entry for an action that has already happened, so a failure is logged rather than returned
+func (db *Database) recordAudit(entry AuditEntry) {
+	if err := db.appendAudit(entry); err != nil {
+		log.Printf("AUDIT WRITE FAILED for %s %s %s (request %s): %v", entry.Action, entry.EntityType, entry.EntityID, entry.RequestID, err)
+	}
+}
+
+// snapshotRow captures one row as a column-to-value map, or nil if there is no such row
+func (db *Database) snapshotRow(query string, args ...interface{}) (interface{}, error) {
+	records, err := db.queryRowMaps(query, args...)
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	return records[0], nil
+}
+
+// queryRowMaps reads every row of a query as a column-to-value map
+func (db *Database) queryRowMaps(query string, args ...interface{}) ([]map[string]interface{}, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	records := []map[string]interface{}{}
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+
+		record := make(map[string]interface{}, len(columns))
+		for i, column := range columns {
+			record[column] = nil
+			if values[i].Valid {
+				record[column] = values[i].String
+			}
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// Audit snapshots of the entities admins and borrowers change
+func snapshotLoan(db *Database, loanID string) (interface{}, error) {
+	return db.snapshotRow(`SELECT Status, Amount, Duedate, ExtensionFee, DisbursedAt, DefaultedAt FROM loan WHERE LoanID = ?`, loanID)
+}
+
+func snapshotPayment(db *Database, paymentID string) (interface{}, error) {
+	return db.snapshotRow(`SELECT CheckedStatus, RejectReason, RejectNote FROM payment WHERE PaymentID = ?`, paymentID)
+}
+
+func snapshotExtension(db *Database, extensionID string) (interface{}, error) {
+	return db.snapshotRow(`SELECT Status, DecidedAt, AdminNote FROM loanextension WHERE ExtensionID = ?`, extensionID)
+}
+
+func snapshotHoliday(db *Database, date string) (interface{}, error) {
+	return db.snapshotRow(`SELECT HolidayDate, Name FROM holiday WHERE HolidayDate = ?`, date)
+}
+
+// snapshotUser records personal data masked, so the audit log does not become a copy of it
+func snapshotUser(db *Database, userID string) (interface{}, error) {
+	id, err := strconv.Atoi(userID)
+	if err != nil {
+		return nil, nil
+	}
+	userAccount, err := db.GetUserInfo(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	userAccount.maskPII()
+	return userAccount, nil
+}
+
+func snapshotSettings(db *Database, _ string) (interface{}, error) {
+	return db.GetSettings()
+}
+
+func snapshotRiskBands(db *Database, _ string) (interface{}, error) {
+	return db.GetRiskBands()
+}
+
+//BLOB STORAGE
+
+// BlobStore keeps encrypted receipts outside MySQL; keys are slash-separated paths
+type BlobStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+}
+
+// errBlobNotFound is returned by Get when a key has no blob
+var errBlobNotFound = errors.New("blob not found")
+
+// newBlobStoreFromEnv picks the blob store named by LOANLOEY_BLOB_STORE, defaulting to the local filesystem
+func newBlobStoreFromEnv() (BlobStore, error) {
+	switch kind := os.Getenv("LOANLOEY_BLOB_STORE"); kind {
+	case "", "fs":
+		root := os.Getenv("LOANLOEY_BLOB_DIR")
+		if root == "" {
+			root = "blobs"
+		}
+		return &fsBlobStore{root: root}, nil
+
+	case "s3":
+		store := &s3BlobStore{
+			endpoint:  strings.TrimRight(os.Getenv("LOANLOEY_S3_ENDPOINT"), "/"),
+			region:    os.Getenv("LOANLOEY_S3_REGION"),
+			bucket:    os.Getenv("LOANLOEY_S3_BUCKET"),
+			accessKey: os.Getenv("LOANLOEY_S3_ACCESS_KEY"),
+			secretKey: os.Getenv("LOANLOEY_S3_SECRET_KEY"),
+			client:    &http.Client{Timeout: 60 * time.Second},
+			now:       time.Now,
+		}
+		if store.region == "" {
+			store.region = "us-east-1"
+		}
+		if store.endpoint == "" || store.bucket == "" || store.accessKey == "" || store.secretKey == "" {
+			return nil, fmt.Errorf("s3 blob store needs LOANLOEY_S3_ENDPOINT, LOANLOEY_S3_BUCKET, LOANLOEY_S3_ACCESS_KEY and LOANLOEY_S3_SECRET_KEY")
+		}
+		return store, nil
+
+	default:
+		return nil, fmt.Errorf("unknown blob store %q, must be fs or s3", kind)
+	}
+}
+
+// validBlobKey rejects keys that could escape the store's root
+func validBlobKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return fmt.Errorf("invalid blob key %q", key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("invalid blob key %q", key)
+		}
+	}
+	return nil
+}
+
+// newReceiptBlobKey names the blob for a new receipt of a loan
+func newReceiptBlobKey(loanID int) (string, error) {
+	suffix := make([]byte, 16)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", fmt.Errorf("generating blob key: %w", err)
+	}
+	return fmt.Sprintf("receipts/%d/%s", loanID, hex.EncodeToString(suffix)), nil
+}
+
+// fsBlobStore keeps blobs as files under a root directory
+type fsBlobStore struct {
+	root string
+}
+
+func (s *fsBlobStore) path(key string) (string, error) {
+	if err := validBlobKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
+
+// Put writes to a temporary file first so a crash never leaves a half-written blob behind
+func (s *fsBlobStore) Put(key string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("creating blob directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("creating blob file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing blob: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("syncing blob: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("closing blob: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("storing blob: %w", err)
+	}
+	return nil
+}
+
+func (s *fsBlobStore) Get(key string) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errBlobNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading blob: %w", err)
+	}
+	return data, nil
+}
+
+func (s *fsBlobStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("deleting blob: %w", err)
+	}
+	return nil
+}
+
+// s3BlobStore talks to any S3-compatible service (AWS S3, MinIO, ...) using path-style URLs
+// and requests signed with AWS Signature Version 4
+type s3BlobStore struct {
+	endpoint  string // e.g. http://localhost:9000
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+	now       func() time.Time
+}
+
+func (s *s3BlobStore) Put(key string, data []byte) error {
+	resp, err := s.do(http.MethodPut, key, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error("storing blob", resp)
+	}
+	return nil
+}
+
+func (s *s3BlobStore) Get(key string) ([]byte, error) {
+	resp, err := s.do(http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errBlobNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s3Error("reading blob", resp)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading blob: %w", err)
+	}
+	return data, nil
+}
+
+func (s *s3BlobStore) Delete(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return s3Error("deleting blob", resp)
+	}
+	return nil
+}
+
+// s3Error includes the start of the service's XML error document in the error
+func s3Error(action string, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("%s: %s: %s", action, resp.Status, strings.TrimSpace(string(body)))
+}
+
+func (s *s3BlobStore) do(method, key string, body []byte) (*http.Response, error) {
+	if err := validBlobKey(key); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, s.endpoint+"/"+s3EscapePath(s.bucket+"/"+key), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("building s3 request: %w", err)
+	}
+	signS3Request(req, body, s.accessKey, s.secretKey, s.region, s.now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("calling s3: %w", err)
+	}
+	return resp, nil
+}
+
+// s3EscapePath URI-encodes each segment of a path the way SigV4 expects, leaving the slashes alone
+func s3EscapePath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c == '/' || c == '-' || c == '_' || c == '.' || c == '~' ||
+			('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// signS3Request adds AWS Signature Version 4 headers to a request. It signs the host, any x-amz-*
+// headers and a Range header if present; the URL path must already be escaped with s3EscapePath.
+func signS3Request(req *http.Request, body []byte, accessKey, secretKey, region string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256.Sum256(body)
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", hex.EncodeToString(payloadHash[:]))
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "range" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// Query parameters are sorted by name; receipts never use any but the signer supports them anyway
+	query := req.URL.Query()
+	queryNames := make([]string, 0, len(query))
+	for name := range query {
+		queryNames = append(queryNames, name)
+	}
+	sort.Strings(queryNames)
+	var canonicalQuery []string
+	for _, name := range queryNames {
+		for _, value := range query[name] {
+			canonicalQuery = append(canonicalQuery, s3EscapePath(name)+"="+strings.ReplaceAll(s3EscapePath(value), "/", "%2F"))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		strings.Join(canonicalQuery, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := day + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// blobChecksum is stored next to a blob key so corrupted or swapped blobs are caught on read
+func blobChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// loadReceiptCiphertext returns a payment's encrypted receipt, from the blob store when the row points
+// to one or from the legacy Receipt column otherwise
+func (db *Database) loadReceiptCiphertext(inline []byte, blobKey, checksum sql.NullString) ([]byte, error) {
+	if !blobKey.Valid {
+		if inline == nil {
+			return nil, sql.ErrNoRows
+		}
+		if checksum.Valid && blobChecksum(inline) != checksum.String {
+			return nil, fmt.Errorf("inline receipt does not match its checksum")
+		}
+		return inline, nil
+	}
+
+	data, err := db.blobs.Get(blobKey.String)
+	if err != nil {
+		return nil, fmt.Errorf("loading receipt blob %s: %w", blobKey.String, err)
+	}
+	if checksum.Valid && blobChecksum(data) != checksum.String {
+		return nil, fmt.Errorf("receipt blob %s does not match its checksum", blobKey.String)
+	}
+	return data, nil
+}
+
+// migrateReceiptsToBlobStore moves receipts still stored in payment.Receipt into the blob store,
+// a batch at a time, returning how many were moved
+func (db *Database) migrateReceiptsToBlobStore(batchSize int) (int, error) {
+	moved, lastID := 0, 0
+	for {
+		rows, err := db.Query(`SELECT PaymentID, LoanID, Receipt FROM payment WHERE Receipt IS NOT NULL AND BlobKey IS NULL AND PaymentID > ?
+		                       ORDER BY PaymentID LIMIT ?`, lastID, batchSize)
+		if err != nil {
+			return moved, fmt.Errorf("querying receipts: %w", err)
+		}
+
+		type pendingReceipt struct {
+			paymentID, loanID int
+			receipt           []byte
+		}
+		var batch []pendingReceipt
+		for rows.Next() {
+			var p pendingReceipt
+			if err := rows.Scan(&p.paymentID, &p.loanID, &p.receipt); err != nil {
+				rows.Close()
+				return moved, fmt.Errorf("scanning receipt row: %w", err)
+			}
+			batch = append(batch, p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return moved, fmt.Errorf("error iterating rows: %w", err)
+		}
+		if len(batch) == 0 {
+			return moved, nil
+		}
+
+		for _, p := range batch {
+			lastID = p.paymentID
+			ok, err := db.moveReceiptToBlobStore(p.paymentID, p.loanID, p.receipt)
+			if err != nil {
+				return moved, err
+			}
+			if ok {
+				moved++
+			}
+		}
+		log.Printf("Moved %d receipts to the blob store", moved)
+	}
+}
+
+// moveReceiptToBlobStore moves one inline receipt, reporting false if the row changed since it was read
+// or failed its integrity check, which is left for an admin to investigate
+func (db *Database) moveReceiptToBlobStore(paymentID, loanID int, receipt []byte) (bool, error) {
+	if err := db.verifyPayment(db, paymentID, "receipt migration"); err != nil {
+		if err == errPaymentTampered {
+			return false, nil
+		}
+		return false, err
+	}
+
+	key, err := newReceiptBlobKey(loanID)
+	if err != nil {
+		return false, err
+	}
+	if err := db.blobs.Put(key, receipt); err != nil {
+		return false, fmt.Errorf("moving receipt of payment %d: %w", paymentID, err)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			db.blobs.Delete(key)
+		}
+	}()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Only clear the column if the row still holds what was copied
+	result, err := tx.Exec(`UPDATE payment SET BlobKey = ?, ReceiptChecksum = ?, Receipt = NULL WHERE PaymentID = ? AND BlobKey IS NULL AND ReceiptChecksum = ?`,
+		key, blobChecksum(receipt), paymentID, blobChecksum(receipt))
+	if err != nil {
+		return false, fmt.Errorf("updating payment %d: %w", paymentID, err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	if err := db.signPayment(tx, paymentID); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("committing payment %d: %w", paymentID, err)
+	}
+	committed = true
+	return true, nil
+}
+
+// Enable CORS
+func enableCORS(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Allow only specific origin (you can change this based on your frontend URL)
+		w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key, X-Request-ID")
+		w.Header().Set("Access-Control-Expose-Headers", "Content-Disposition, Content-Range, Idempotent-Replayed, X-Request-ID")
+
+		// Allow credentials if needed (for cookies or authorization headers)
+		// w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+		// Handle preflight requests (OPTIONS)
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		// Pass the request to the next handler
+		h.ServeHTTP(w, r)
+	})
+}
+
+// keysUsage is printed for `keys` without a valid subcommand
+const keysUsage = `usage: keys <command>
+  list                         list the keyring
+  generate [activate]          generate a new key; activated if asked or if there is no active key
+  import <private_key.pem> [activate]
+                               import an existing key; activated if asked or if there is no active key
+  inspect <keyID>              show a key's fingerprint, size, dates and how many AES keys it wraps
+  activate <keyID>             wrap new AES keys with this key
+  retire <keyID>               stop using a key that no longer wraps anything
+  verify [keyID]               check the provider's private key matches the recorded public key
+  rewrap                       re-wrap every AES key onto the active key now
+  export [keyID] [pem|jwk]     print a public key (default: the active key as PEM)`
+
+// runKeysCommand manages the RSA keyring. It works without a loaded keyring, so a fresh install can
+// generate its first key; only rewrap needs one.
+func runKeysCommand(db *Database, provider KeyProvider, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf(keysUsage)
+	}
+
+	needArgs := func(min, max int) error {
+		if len(args)-1 < min || len(args)-1 > max {
+			return fmt.Errorf(keysUsage)
+		}
+		return nil
+	}
+
+	switch args[0] {
+	case "list":
+		keys, err := db.GetRSAKeys()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%-16s  %-8s  %5s  %-19s  %-19s\n", "KEY ID", "STATUS", "BITS", "CREATED", "ACTIVATED")
+		for _, key := range keys {
+			activatedAt := "-"
+			if key.ActivatedAt != nil {
+				activatedAt = *key.ActivatedAt
+			}
+			fmt.Printf("%-16s  %-8s  %5d  %-19s  %-19s\n", key.KeyID, key.Status, key.Bits, key.CreatedAt, activatedAt)
+		}
+		return nil
+
+	case "generate":
+		if err := needArgs(0, 1); err != nil {
+			return err
+		}
+		privateKey, _, err := GenerateRSAKeys()
+		if err != nil {
+			return err
+		}
+		keyID, err := db.AddRSAKey(provider, privateKey)
+		if err != nil {
+			return err
+		}
+
+		var activeCount int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM rsakey WHERE Status = 'active'`).Scan(&activeCount); err != nil {
+			return fmt.Errorf("checking for an active key: %w", err)
+		}
+		if (len(args) == 2 && args[1] == "activate") || activeCount == 0 {
+			if err := db.ActivateRSAKey(keyID); err != nil {
+				return err
+			}
+			fmt.Printf("Generated key %s (active)\n", keyID)
+			return nil
+		}
+		fmt.Printf("Generated key %s (inactive)\n", keyID)
+		return nil
+
+	case "import":
+		if err := needArgs(1, 2); err != nil {
+			return err
+		}
+		privateKey, err := loadPrivateKey(args[1])
+		if err != nil {
+			return err
+		}
+
+		var activeCount int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM rsakey WHERE Status = 'active'`).Scan(&activeCount); err != nil {
+			return fmt.Errorf("checking for an active key: %w", err)
+		}
+		keyID, err := db.AddRSAKey(provider, privateKey)
+		if err != nil {
+			return err
+		}
+		tagged, err := db.tagLegacyKeys(provider, keyID)
+		if err != nil {
+			return err
+		}
+		if tagged > 0 {
+			fmt.Printf("Tagged %d AES keys wrapped before the keyring existed with key %s\n", tagged, keyID)
+		}
+
+		if (len(args) == 3 && args[2] == "activate") || activeCount == 0 {
+			if err := db.ActivateRSAKey(keyID); err != nil {
+				return err
+			}
+			fmt.Printf("Imported key %s (active)\n", keyID)
+			return nil
+		}
+		fmt.Printf("Imported key %s (inactive)\n", keyID)
+		return nil
+
+	case "inspect":
+		if err := needArgs(1, 1); err != nil {
+			return err
+		}
+		key, err := db.GetRSAKey(args[1])
+		if err != nil {
+			return err
+		}
+		usage, err := db.rsaKeyUsage(key.KeyID)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Key ID:       %s\n", key.KeyID)
+		fmt.Printf("Fingerprint:  SHA256:%s\n", key.Fingerprint)
+		fmt.Printf("Size:         %d bits\n", key.Bits)
+		fmt.Printf("Status:       %s\n", key.Status)
+		fmt.Printf("Created:      %s\n", key.CreatedAt)
+		if key.ActivatedAt != nil {
+			fmt.Printf("Activated:    %s\n", *key.ActivatedAt)
+		}
+		if key.RetiredAt != nil {
+			fmt.Printf("Retired:      %s\n", *key.RetiredAt)
+		}
+		fmt.Printf("Wraps:        %d AES keys\n", usage)
+		return nil
+
+	case "activate":
+		if err := needArgs(1, 1); err != nil {
+			return err
+		}
+		if err := db.ActivateRSAKey(args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("Key %s is now active; running servers pick it up within %s\n", args[1], keyRewrapInterval)
+		return nil
+
+	case "retire":
+		if err := needArgs(1, 1); err != nil {
+			return err
+		}
+		if err := db.RetireRSAKey(args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("Key %s is retired; its private key can now be destroyed\n", args[1])
+		return nil
+
+	case "verify":
+		if err := needArgs(0, 1); err != nil {
+			return err
+		}
+		keys, err := db.GetRSAKeys()
+		if err != nil {
+			return err
+		}
+		failed := 0
+		for _, key := range keys {
+			if key.Status == "retired" || (len(args) == 2 && key.KeyID != args[1]) {
+				continue
+			}
+			if err := db.verifyRSAKey(provider, key.KeyID); err != nil {
+				fmt.Printf("%s  FAILED: %v\n", key.KeyID, err)
+				failed++
+				continue
+			}
+			fmt.Printf("%s  ok\n", key.KeyID)
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d keys failed verification", failed)
+		}
+		return nil
+
+	case "rewrap":
+		// Offline equivalent of the background job: re-wraps everything now, then exits
+		keys, err := loadKeyring(db, provider)
+		if err != nil {
+			return err
+		}
+		total := 0
+		for {
+			rewrapped, err := db.rewrapKeys(keys, 100)
+			if err != nil {
+				return err
+			}
+			if rewrapped == 0 {
+				break
+			}
+			total += rewrapped
+			log.Printf("Re-wrapped %d keys so far", total)
+		}
+		activeID, _ := keys.Active()
+		fmt.Printf("Re-wrapped %d keys onto key %s\n", total, activeID)
+		return nil
+
+	case "export":
+		if err := needArgs(0, 2); err != nil {
+			return err
+		}
+		keyID, format := "", "pem"
+		for _, arg := range args[1:] {
+			if arg == "pem" || arg == "jwk" {
+				format = arg
+			} else {
+				keyID = arg
+			}
+		}
+		if keyID == "" {
+			if err := db.QueryRow(`SELECT KeyID FROM rsakey WHERE Status = 'active'`).Scan(&keyID); err != nil {
+				return fmt.Errorf("finding the active key: %w", err)
+			}
+		}
+		publicKeyPEM, err := db.rsaPublicKeyPEM(keyID)
+		if err != nil {
+			return err
+		}
+		if format == "pem" {
+			fmt.Print(publicKeyPEM)
+			return nil
+		}
+		publicKey, err := parsePublicKeyPEM([]byte(publicKeyPEM))
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(publicKeyJWK(keyID, publicKey))
+
+	default:
+		return fmt.Errorf(keysUsage)
+	}
+}
+
+// runCommand runs a maintenance subcommand against the database
+func runCommand(db *Database, keys *Keyring, args []string) error {
+	switch args[0] {
+	case "export-receipts":
+		if len(args) < 4 || len(args) > 5 || (len(args) == 5 && args[4] != "sign") {
+			return fmt.Errorf("usage: export-receipts <loan|payment> <id> <dir> [sign]")
+		}
+		id, err := strconv.Atoi(args[2])
+		if err != nil {
+			return fmt.Errorf("invalid %s ID %q", args[1], args[2])
+		}
+		var signingKey ed25519.PrivateKey
+		if len(args) == 5 {
+			if signingKey, err = loadEvidenceKey(evidenceKeyFile()); err != nil {
+				return err
+			}
+		}
+		manifest, err := db.exportReceipts(keys, args[1], id, args[3], signingKey)
+		if err != nil {
+			return err
+		}
+		after, _ := json.Marshal(map[string]interface{}{"dir": args[3], "receipts": len(manifest.Receipts), "signed": signingKey != nil})
+		entry := AuditEntry{ActorRole: "cli", Action: "receipt.export", EntityType: args[1], EntityID: args[2], After: after, StatusCode: http.StatusOK}
+		if err := db.appendAudit(entry); err != nil {
+			log.Printf("AUDIT WRITE FAILED for receipt.export %s %s: %v", args[1], args[2], err)
+		}
+		fmt.Printf("Exported %d receipts for %s to %s\n", len(manifest.Receipts), manifest.Scope, args[3])
+		if signingKey != nil {
+			fmt.Printf("Signed evidence bundle: %s.zip\n", filepath.Clean(args[3]))
+		}
+		return nil
+	case "verify-evidence":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: verify-evidence <bundle.zip|dir>")
+		}
+		fingerprint, manifest, err := verifyEvidence(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Evidence for %s generated %s: signature and %d receipt hashes valid\n", manifest.Scope, manifest.GeneratedAt, len(manifest.Receipts))
+		fmt.Printf("Signed by key SHA256:%s\n", fingerprint)
+		return nil
+	case "data-export":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: data-export <userID> <file.zip>")
+		}
+		userID, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid user ID %q", args[1])
+		}
+		archive, manifest, err := db.buildDataExport(keys, userID)
+		if err != nil {
+			return err
+		}
+		// The export holds decrypted personal data: keep it readable by the operator only
+		if err := os.WriteFile(args[2], archive, 0o600); err != nil {
+			return fmt.Errorf("writing export: %w", err)
+		}
+		entry := AuditEntry{ActorRole: "cli", Action: "dataexport.build", EntityType: "user", EntityID: args[1], StatusCode: http.StatusOK}
+		if err := db.appendAudit(entry); err != nil {
+			log.Printf("AUDIT WRITE FAILED for dataexport.build user %s: %v", args[1], err)
+		}
+		fmt.Printf("Exported %d loans and %d payments for user %d to %s\n", len(manifest.Loans), len(manifest.Payments), userID, args[2])
+		return nil
+	case "verify-audit-log":
+		result, err := db.VerifyAuditLog()
+		if err != nil {
+			return err
+		}
+		if !result.Valid {
+			return fmt.Errorf("audit log checked %d entries: %s", result.Entries, result.Problem)
+		}
+		fmt.Printf("Audit log intact: %d entries\n", result.Entries)
+		return nil
+	case "migrate-receipts":
+		moved, err := db.migrateReceiptsToBlobStore(100)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Moved %d receipts to the blob store\n", moved)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// Main function to set up server and routes
+func main() {
+
+	// The KMS stand-in runs on its own, without a database
+	if len(os.Args) > 1 && os.Args[1] == "kms-serve" {
+		if err := runKMSStandIn(); err != nil {
+			log.Fatalf("kms-serve failed: %v", err)
+		}
+		return
+	}
+
+	// Connect to the database
+	db, err := sql.Open("mysql", "root:root@tcp(localhost:8889)/loanloey")
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+
+	loc, err := loadBusinessLocation()
+	if err != nil {
+		log.Fatalf("Failed to load timezone: %v", err)
+	}
+
+	blobs, err := newBlobStoreFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure blob store: %v", err)
+	}
+
+	database := &Database{DB: db, clock: systemClock{}, loc: loc, blobs: blobs}
+
+	if err := database.ensureSchema(); err != nil {
+		log.Fatalf("Failed to prepare database schema: %v", err)
+	}
+
+	provider, err := newKeyProviderFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure key provider: %v", err)
+	}
+
+	// Key management runs before the keyring is loaded, so it can create the first key
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		if err := runKeysCommand(database, provider, os.Args[2:]); err != nil {
+			log.Fatalf("keys failed: %v", err)
+		}
+		return
+	}
+
+	// Load the RSA keyring; the first key has to be added with `keys import` or `keys generate`
+	keyring, err := loadKeyring(database, provider)
+	if err != nil {
+		log.Fatalf("Failed to load RSA keyring: %v", err)
+	}
+
+	// Personal data is encrypted under a data key wrapped by the keyring
+	if err := database.loadFieldCipher(keyring); err != nil {
+		log.Fatalf("Failed to load personal data key: %v", err)
+	}
+	if err := database.loadPaymentSigner(keyring); err != nil {
+		log.Fatalf("Failed to load payment signing key: %v", err)
+	}
+	if err := database.loadAuditKey(keyring); err != nil {
+		log.Fatalf("Failed to load audit log key: %v", err)
+	}
+
+	// Maintenance commands run instead of the server, e.g. `go run main.go migrate-receipts`
+	if len(os.Args) > 1 {
+		if err := runCommand(database, keyring, os.Args[1:]); err != nil {
+			log.Fatalf("%s failed: %v", os.Args[1], err)
+		}
+		return
+	}
+
+	startKeyRewrapJob(database, keyring)
+	wakeExports := startDataExportJob(database, keyring)
+
+	//ACCOUNT
+
+	// HTTP route for user signup
+	http.Handle("/signup", enableCORS(audited(database, auditSpec{action: "user.signup", entityType: "user", recordResponse: true}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var userAccount UserAccount
+		if err := json.NewDecoder(r.Body).Decode(&userAccount); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if err := database.Signup(userAccount); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errIDCardRegistered) {
+				status = http.StatusConflict
+			}
+			http.Error(w, fmt.Sprintf("Signup failed: %v", err), status)
+			return
+		}
+
+		response := map[string]string{"message": "Account and User created successfully!"}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}))))
+
+	// HTTP route to delete an account
+	http.Handle("/deleteAccount", enableCORS(audited(database, auditSpec{action: "user.delete", entityType: "user", entityParam: "userID", snapshot: snapshotUser}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Parse userID from query parameters
+		userIDStr := r.URL.Query().Get("userID")
+		if userIDStr == "" {
+			http.Error(w, "UserID is required", http.StatusBadRequest)
+			return
+		}
+
+		// Convert userID to integer
+		userID, err := strconv.Atoi(userIDStr)
+		if err != nil {
+			http.Error(w, "Invalid UserID format", http.StatusBadRequest)
+			return
+		}
+		if _, ok := database.userSession(w, r, userID); !ok {
+			return
 		}
 
-		// Return the receipts as a JSON response
-		response := map[string]interface{}{
-			"loanID":   loanID,
-			"receipts": receipts,
+		// Call DeleteAccount with userID
+		if err := database.DeleteAccount(userID); err != nil {
+			http.Error(w, fmt.Sprintf("DeleteAccount failed: %v", err), http.StatusInternalServerError)
+			return
 		}
+
+		// Respond with success message
+		response := map[string]string{"message": "Account deleted successfully!"}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
-	}
-}
 
-func testRSAKeys(privateKey *rsa.PrivateKey, publicKey *rsa.PublicKey) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Generate a random AES key
-		aesKey, err := generateAESKey()
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error generating AES key: %v", err), http.StatusInternalServerError)
+	}))))
+
+	// HTTP route for user login
+	http.Handle("/login", enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		// Encrypt the AES key using the public key
-		encryptedAESKey, err := rsa.EncryptPKCS1v15(rand.Reader, publicKey, aesKey)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error encrypting AES key: %v", err), http.StatusInternalServerError)
+		var credentials struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
 
-		// Decrypt the AES key using the private key
-		decryptedAESKey, err := rsa.DecryptPKCS1v15(rand.Reader, privateKey, encryptedAESKey)
+		// Every attempt is audited against the username. The caller has no session yet, so a successful
+		// login is attributed to the session it creates.
+		entry := database.requestAuditEntry(r, "account.login", "account", credentials.Username)
+		role, err := database.Login(credentials.Username, credentials.Password)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Error decrypting AES key: %v", err), http.StatusInternalServerError)
+			entry.StatusCode = http.StatusUnauthorized
+			database.recordAudit(entry)
+			http.Error(w, fmt.Sprintf("Login failed: %v", err), http.StatusUnauthorized)
 			return
 		}
+		entry.StatusCode = http.StatusOK
+		if token, ok := role["token"].(string); ok {
+			if session, err := database.sessionFromToken(token); err == nil {
+				entry.ActorAccountID, entry.ActorRole = &session.AccountID, session.Role
+			}
+		}
+		database.recordAudit(entry)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(role)
+	})))
+
+	// http.HandleFunc("/adminpage", func(w http.ResponseWriter, r *http.Request) {
+	// 	fmt.Fprintln(w, "Welcome to the Admin Page!")
+	// })
+
+	// http.HandleFunc("/homepage", func(w http.ResponseWriter, r *http.Request) {
+	// 	fmt.Fprintln(w, "Welcome to the Home Page!")
+	// })
+
+	//USER
 
-		// Verify if the decrypted AES key matches the original AES key
-		if string(aesKey) != string(decryptedAESKey) {
-			http.Error(w, "Decrypted AES key does not match the original AES key", http.StatusInternalServerError)
+	// HTTP route to update user information
+	http.Handle("/updateUserInfo", enableCORS(audited(database, auditSpec{action: "user.update", entityType: "user", entityParam: "userID", snapshot: snapshotUser}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		// Respond with success
-		response := map[string]string{
-			"message": "RSA keys match and encryption/decryption works correctly",
+		var userAccount UserAccount
+		if err := json.NewDecoder(r.Body).Decode(&userAccount); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
-	}
-}
 
-func DebugDecryptReceipt(db *sql.DB, privateKey *rsa.PrivateKey) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		loanID := vars["loanID"]
+		userIDStr := r.URL.Query().Get("userID")
+		if userIDStr == "" {
+			http.Error(w, "UserID is required", http.StatusBadRequest)
+			return
+		}
 
-		// Fetch data from DB
-		var encryptedAESKey []byte
-		var encryptedImage []byte
-		err := db.QueryRow("SELECT encrypted_aes_key, receipt_image FROM payment WHERE loan_id = ?", loanID).
-			Scan(&encryptedAESKey, &encryptedImage)
+		userID, err := strconv.Atoi(userIDStr)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("DB error: %v", err), http.StatusInternalServerError)
+			http.Error(w, "Invalid UserID format", http.StatusBadRequest)
 			return
 		}
 
-		// Decrypt AES key
-		aesKey, err := rsa.DecryptPKCS1v15(rand.Reader, privateKey, encryptedAESKey)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("RSA decryption failed: %v", err), http.StatusInternalServerError)
+		if err := database.UpdateUserInfo(userID, userAccount); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errIDCardRegistered) {
+				status = http.StatusConflict
+			}
+			http.Error(w, fmt.Sprintf("UpdateUserInfo failed: %v", err), status)
+			return
+		}
+
+		response := map[string]string{"message": "User information updated successfully!"}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}))))
+
+	// HTTP route to get user information
+	http.Handle("/getUserInfo", enableCORS(audited(database, auditSpec{action: "user.view", entityType: "user", entityParam: "userID"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		log.Printf("🔐 Decrypted AES Key (base64): %s", base64.StdEncoding.EncodeToString(aesKey))
+		userIDStr := r.URL.Query().Get("userID")
+		log.Printf("Received UserID: %s", userIDStr)
+
+		if userIDStr == "" {
+			http.Error(w, "UserID is required", http.StatusBadRequest)
+			return
+		}
 
-		// Now decrypt the image using AES
-		block, err := aes.NewCipher(aesKey)
+		userID, err := strconv.Atoi(userIDStr)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Error creating AES cipher: %v", err), http.StatusInternalServerError)
+			log.Printf("Error converting UserID: %v", err)
+			http.Error(w, "Invalid UserID format", http.StatusBadRequest)
 			return
 		}
 
-		if len(encryptedImage) < aes.BlockSize {
-			http.Error(w, "Encrypted image too short", http.StatusInternalServerError)
+		userAccount, err := database.GetUserInfo(userID)
+		if err != nil {
+			log.Printf("Failed to get user info: %v", err)
+			http.Error(w, "User not found", http.StatusNotFound)
 			return
 		}
 
-		iv := encryptedImage[:aes.BlockSize]
-		cipherText := encryptedImage[aes.BlockSize:]
+		// Only admins see personal data in full
+		if session, err := database.sessionFromRequest(r); err != nil || session.Role != "admin" {
+			userAccount.maskPII()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(userAccount); err != nil {
+			log.Printf("Error encoding user info to JSON: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}))))
 
-		mode := cipher.NewCBCDecrypter(block, iv)
-		decrypted := make([]byte, len(cipherText))
-		mode.CryptBlocks(decrypted, cipherText)
+	// HTTP route to get user credit level
+	http.Handle("/getUserCreditLevel", enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
 
-		// Remove padding (PKCS#7)
-		padLen := int(decrypted[len(decrypted)-1])
-		if padLen > aes.BlockSize || padLen == 0 {
-			http.Error(w, "Invalid padding", http.StatusInternalServerError)
+		userIDStr := r.URL.Query().Get("userID")
+		if userIDStr == "" {
+			http.Error(w, "UserID is required", http.StatusBadRequest)
 			return
 		}
-		decrypted = decrypted[:len(decrypted)-padLen]
 
-		log.Printf("Successfully decrypted image for LoanID %s (size: %d bytes)", loanID, len(decrypted))
+		userID, err := strconv.Atoi(userIDStr)
+		if err != nil {
+			http.Error(w, "Invalid UserID format", http.StatusBadRequest)
+			return
+		}
 
-		// Return debug info
-		response := map[string]string{
-			"loanID":           loanID,
-			"aesKeyBase64":     base64.StdEncoding.EncodeToString(aesKey),
-			"decryptedImgSize": fmt.Sprintf("%d", len(decrypted)),
-			"decryptionStatus": "success",
+		creditLevel, err := database.GetUserCreditLevel(userID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to get credit level: %v", err), http.StatusInternalServerError)
+			return
 		}
+
+		response := map[string]string{"credit_level": creditLevel}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
-	}
-}
-
-// PAYMENT
-func confirmPaymentDetails(db *Database) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Received request: %s %s", r.Method, r.URL.Path)
+	})))
 
-		// Check if the request method is GET
+	http.Handle("/getAllUserInfoForAdmin", enableCORS(audited(database, auditSpec{action: "user.list", entityType: "user"}, adminOnly(database, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		// Retrieve LoanID from query parameters
-		loanIDStr := r.URL.Query().Get("loanID")
-		if loanIDStr == "" {
-			http.Error(w, "LoanID is required", http.StatusBadRequest)
+		users, err := database.getAllUserInfoForAdmin()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to get all user info: %v", err), http.StatusInternalServerError)
 			return
 		}
 
-		// Convert LoanID to integer
-		loanID, err := strconv.Atoi(loanIDStr)
+		w.Header().Set("Content-Type", "application/json")
+		// Return users data with UserID
+		json.NewEncoder(w).Encode(users)
+	})))))
+
+	// HTTP route to list the configured risk bands
+	http.Handle("/getRiskBands", enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		bands, err := database.GetRiskBands()
 		if err != nil {
-			http.Error(w, "Invalid LoanID format", http.StatusBadRequest)
+			http.Error(w, fmt.Sprintf("Failed to get risk bands: %v", err), http.StatusInternalServerError)
 			return
 		}
 
-		// Query to retrieve loan details
-		query := `SELECT Amount, Duedate FROM loan WHERE LoanID = ?`
-		var amount float64
-		var dueDateStr string
-		err = db.QueryRow(query, loanID).Scan(&amount, &dueDateStr)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(bands)
+	})))
 
-		// Check for errors in the query
-		if err == sql.ErrNoRows {
-			http.Error(w, "Loan not found", http.StatusNotFound)
+	// HTTP route for admins to replace the risk band configuration
+	http.Handle("/updateRiskBands", enableCORS(audited(database, auditSpec{action: "riskbands.update", entityType: "riskband", snapshot: snapshotRiskBands}, adminOnly(database, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 			return
-		} else if err != nil {
-			log.Printf("Error querying loan: %v", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+
+		var bands []RiskBand
+		if err := json.NewDecoder(r.Body).Decode(&bands); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
 
-		// Parse the due date
-		dueDate, err := time.Parse("2006-01-02 15:04:05", dueDateStr)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Parsing due date: %v", err), http.StatusInternalServerError)
+		if err := database.ReplaceRiskBands(bands); err != nil {
+			http.Error(w, fmt.Sprintf("UpdateRiskBands failed: %v", err), http.StatusBadRequest)
 			return
 		}
 
-		// Calculate total amount using your helper functions
-		totalAmount, _, _ := calculateLoanDetails(amount, dueDate)
+		response := map[string]string{"message": "Risk bands updated successfully!"}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})))))
 
-		// Prepare the JSON response with only the total amount
-		response := map[string]float64{
-			"totalAmount": totalAmount,
+	//ADMIN
+	// HTTP route for admin creation
+	http.Handle("/createAdmin", enableCORS(audited(database, auditSpec{action: "admin.create", entityType: "admin"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
 		}
 
-		// Set response headers and encode the response as JSON
+		// Only an admin can create another admin; the first one is created while setting up the install
+		var adminCount int
+		if err := database.QueryRow(`SELECT COUNT(*) FROM loansharkadmin`).Scan(&adminCount); err != nil {
+			http.Error(w, fmt.Sprintf("Error counting admins: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if adminCount > 0 {
+			if session, err := database.sessionFromRequest(r); err != nil || session.Role != "admin" {
+				http.Error(w, "An admin session is required", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		var admin Admin
+		if err := json.NewDecoder(r.Body).Decode(&admin); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if err := database.CreateAdmin(admin); err != nil {
+			http.Error(w, fmt.Sprintf("CreateAdmin failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		response := map[string]string{"message": "Admin created successfully!"}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
-	}
-}
+	}))))
 
-func insertPayment(db *Database, publicKey *rsa.PublicKey) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Received request to insert payment for LoanID: %s", r.URL.Query().Get("loanID"))
+	//HOLIDAYS
+	// HTTP route to list holidays, optionally for a single year
+	http.Handle("/getHolidays", enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
 
-		// Check if the request method is POST
+		year := 0
+		if yearStr := r.URL.Query().Get("year"); yearStr != "" {
+			var err error
+			year, err = strconv.Atoi(yearStr)
+			if err != nil {
+				http.Error(w, "Invalid year format", http.StatusBadRequest)
+				return
+			}
+		}
+
+		holidays, err := database.GetHolidays(year)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to get holidays: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(holidays)
+	})))
+
+	// HTTP route for admins to add or rename holidays; accepts a single holiday or an array
+	http.Handle("/importHolidays", enableCORS(audited(database, auditSpec{action: "holidays.import", entityType: "holiday"}, adminOnly(database, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		// Parse the multipart form to handle file uploads
-		err := r.ParseMultipartForm(50 << 20) // Limit file size to 50 MB
-		if err != nil {
-			http.Error(w, "Error parsing form data", http.StatusBadRequest)
+		var body json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
+		var holidays []Holiday
+		if err := json.Unmarshal(body, &holidays); err != nil {
+			var holiday Holiday
+			if err := json.Unmarshal(body, &holiday); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+			holidays = []Holiday{holiday}
+		}
 
-		// Retrieve LoanID from query parameters
-		loanIDStr := r.URL.Query().Get("loanID")
-		if loanIDStr == "" {
-			http.Error(w, "LoanID is required", http.StatusBadRequest)
+		if err := database.ImportHolidays(holidays); err != nil {
+			http.Error(w, fmt.Sprintf("ImportHolidays failed: %v", err), http.StatusBadRequest)
 			return
 		}
 
-		// Convert LoanID to integer
-		loanID, err := strconv.Atoi(loanIDStr)
-		if err != nil {
-			http.Error(w, "Invalid LoanID format", http.StatusBadRequest)
+		response := map[string]string{"message": "Holidays saved successfully!"}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})))))
+
+	// HTTP route for admins to remove a holiday
+	http.Handle("/deleteHoliday", enableCORS(audited(database, auditSpec{action: "holiday.delete", entityType: "holiday", entityParam: "date", snapshot: snapshotHoliday}, adminOnly(database, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		// Retrieve the uploaded file
-		file, _, err := r.FormFile("receipt")
-		if err != nil {
-			log.Printf("Error retrieving the file: %v", err)
-			http.Error(w, "Error retrieving the file", http.StatusBadRequest)
+		date := r.URL.Query().Get("date")
+		if date == "" {
+			http.Error(w, "date is required", http.StatusBadRequest)
+			return
+		}
+
+		if err := database.DeleteHoliday(date); err != nil {
+			http.Error(w, fmt.Sprintf("DeleteHoliday failed: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		response := map[string]string{"message": "Holiday deleted successfully!"}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})))))
+
+	//SETTINGS
+	// HTTP route to list the admin-tunable settings
+	http.Handle("/getSettings", enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
-		defer file.Close()
 
-		// Read the file content
-		fileBytes, err := io.ReadAll(file)
+		settings, err := database.GetSettings()
 		if err != nil {
-			log.Printf("Error reading the file: %v", err)
-			http.Error(w, "Error reading the file", http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("Failed to get settings: %v", err), http.StatusInternalServerError)
 			return
 		}
 
-		// Generate a random AES key
-		aesKey, err := generateAESKey()
-		if err != nil {
-			log.Printf("Error generating AES key: %v", err)
-			http.Error(w, "Error generating AES key", http.StatusInternalServerError)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(settings)
+	})))
+
+	// HTTP route for admins to change a setting
+	http.Handle("/updateSetting", enableCORS(audited(database, auditSpec{action: "setting.update", entityType: "setting", snapshot: snapshotSettings}, adminOnly(database, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		// Encrypt the file content using AES
-		encryptedFile, err := encryptWithAES(fileBytes, aesKey)
-		if err != nil {
-			log.Printf("Error encrypting file with AES: %v", err)
-			http.Error(w, "Error encrypting file", http.StatusInternalServerError)
+		var request struct {
+			Name  string  `json:"name"`
+			Value float64 `json:"value"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
 
-		// Encrypt the AES key using RSA
-		encryptedAESKey, err := rsa.EncryptPKCS1v15(rand.Reader, publicKey, aesKey)
-		if err != nil {
-			log.Printf("Error encrypting AES key with RSA: %v", err)
-			http.Error(w, "Error encrypting AES key", http.StatusInternalServerError)
+		if err := database.UpdateSetting(request.Name, request.Value); err != nil {
+			http.Error(w, fmt.Sprintf("UpdateSetting failed: %v", err), http.StatusBadRequest)
 			return
 		}
 
-		// Query to retrieve loan due date
-		query := `SELECT Duedate FROM loan WHERE LoanID = ?`
-		var dueDateStr string
-		err = db.QueryRow(query, loanID).Scan(&dueDateStr)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				http.Error(w, "Loan not found", http.StatusNotFound)
-				return
-			}
-			http.Error(w, fmt.Sprintf("Error querying loan due date: %v", err), http.StatusInternalServerError)
+		response := map[string]string{"message": "Setting updated successfully!"}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})))))
+
+	//LOAN
+	// HTTP route to get total loan amount with pending status
+	http.Handle("/getTotalLoan", enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		// Parse the due date
-		dueDate, err := time.Parse("2006-01-02 15:04:05", dueDateStr)
+		totalLoan, err := database.GetTotalLoan()
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Error parsing due date: %v", err), http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("Failed to get total loan: %v", err), http.StatusInternalServerError)
 			return
 		}
 
-		// Get current Thai time
-		tz, err := time.LoadLocation("Asia/Bangkok")
-		if err != nil {
-			http.Error(w, "Error loading timezone", http.StatusInternalServerError)
+		response := map[string]float64{"total_loan": totalLoan}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})))
+
+	http.Handle("/getUserTotalLoan", enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
-		dopayment := time.Now().In(tz)
 
-		// Determine payment status
-		status := "intime"
-		if dopayment.After(dueDate) {
-			status = "late"
+		userIDStr := r.URL.Query().Get("userID")
+		if userIDStr == "" {
+			http.Error(w, "UserID is required", http.StatusBadRequest)
+			return
 		}
 
-		// Insert the payment record into the payment table, including the encrypted file and AES key
-		_, err = db.Exec(`INSERT INTO payment (LoanID, DOPayment, Status, CheckedStatus, Receipt, AESKey) VALUES (?, ?, ?, ?, ?, ?)`,
-			loanID, dopayment.Format("2006-01-02 15:04:05"), status, "waiting", encryptedFile, encryptedAESKey)
+		userID, err := strconv.Atoi(userIDStr)
 		if err != nil {
-			log.Printf("Error inserting payment record: %v", err)
-			http.Error(w, fmt.Sprintf("Error inserting payment record: %v", err), http.StatusInternalServerError)
+			http.Error(w, "Invalid UserID format", http.StatusBadRequest)
 			return
 		}
 
-		// Prepare a success response
-		response := map[string]string{
-			"message": "Payment inserted and receipt encrypted successfully",
+		totalLoan, err := database.GetUserTotalLoan(userID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to get total loan: %v", err), http.StatusInternalServerError)
+			return
 		}
 
+		response := map[string]float64{"total_loan": totalLoan}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
-	}
-}
-
-func handlePaymentApproval(db *Database) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Received request to approve/reject payment for PaymentID: %s", r.URL.Query().Get("paymentID"))
+	})))
 
-		// Check if the request method is POST
-		if r.Method != http.MethodPost {
+	http.Handle("/getUserTotalLoanHistory", enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
 			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		// Retrieve PaymentID and the action (accept/reject) from the query parameters
-		paymentIDStr := r.URL.Query().Get("paymentID")
-		action := r.URL.Query().Get("action")
-		if paymentIDStr == "" || action == "" {
-			http.Error(w, "PaymentID and action are required", http.StatusBadRequest)
+		userIDStr := r.URL.Query().Get("userID")
+		if userIDStr == "" {
+			http.Error(w, "UserID is required", http.StatusBadRequest)
 			return
 		}
 
-		// Convert PaymentID to integer
-		paymentID, err := strconv.Atoi(paymentIDStr)
+		userID, err := strconv.Atoi(userIDStr)
 		if err != nil {
-			http.Error(w, "Invalid PaymentID format", http.StatusBadRequest)
+			http.Error(w, "Invalid UserID format", http.StatusBadRequest)
 			return
 		}
 
-		// Check if action is valid (accept/reject)
-		if action != "accept" && action != "reject" {
-			http.Error(w, "Invalid action, must be either 'accept' or 'reject'", http.StatusBadRequest)
+		totalLoan, err := database.GetUserTotalLoanHistory(userID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to get total loan: %v", err), http.StatusInternalServerError)
 			return
 		}
+		response := map[string]float64{"total_loan": totalLoan}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})))
 
-		// Update the checked status based on the action
-		checkedStatus := "rejected"
-		if action == "accept" {
-			checkedStatus = "accepted"
-		}
+	http.Handle("/getUserLoans", enableCORS(http.HandlerFunc(getUserLoans(database))))
 
-		// Update payment checked status for the specific PaymentID
-		_, err = db.Exec(`UPDATE payment SET CheckedStatus = ? WHERE PaymentID = ?`, checkedStatus, paymentID)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error updating payment checked status: %v", err), http.StatusInternalServerError)
+	http.Handle("/checkLoanDetails", enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		// If the payment is accepted, check if the loan status needs to be updated
-		if action == "accept" {
-			// Retrieve the LoanID associated with the PaymentID
-			var loanID int
-			err = db.QueryRow(`SELECT LoanID FROM payment WHERE PaymentID = ?`, paymentID).Scan(&loanID)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Error retrieving LoanID: %v", err), http.StatusInternalServerError)
-				return
-			}
-
-			_, err = db.Exec(`UPDATE loan SET Status = 'complete' WHERE LoanID = ?`, loanID)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Error updating loan status to accepted: %v", err), http.StatusInternalServerError)
-				return
-
-			}
+		var loanRequest LoanRequest
+		if err := json.NewDecoder(r.Body).Decode(&loanRequest); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
 		}
 
-		// Prepare a success response
-		response := map[string]string{
-			"message": fmt.Sprintf("Payment %s and status updated", action),
+		response, err := database.checkLoanDetails(loanRequest)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Loan info calculation failed: %v", err), http.StatusInternalServerError)
+			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
-	}
-}
-
-func (db *Database) checkPaymentDetails(loanID int) (map[string]interface{}, error) {
-	query := `SELECT LoanID, DOPayment, Status FROM payment WHERE LoanID = ?`
-	var loanIDFromDB int
-	var doPayment, status string
-
-	err := db.QueryRow(query, loanID).Scan(&loanIDFromDB, &doPayment, &status)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("no payment found for LoanID %d", loanID)
-		}
-		return nil, fmt.Errorf("querying payment details: %w", err)
-	}
-
-	response := map[string]interface{}{
-		"loanID":    loanIDFromDB,
-		"doPayment": doPayment,
-		"status":    status,
-	}
-
-	return response, nil
-}
+	})))
 
-func CheckAdminPassword(db *Database, password string) (bool, error) {
-	var storedHash string
+	// / HTTP route for applying for a loan
+	http.Handle("/applyForLoan", enableCORS(audited(database, auditSpec{action: "loan.apply", entityType: "loan", recordResponse: true}, idempotent(database, "applyForLoan", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-	// Query to get the stored password hash from the adminpassword table
-	query := `SELECT PasswordHash FROM adminpassword LIMIT 1`
-	err := db.QueryRow(query).Scan(&storedHash)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return false, fmt.Errorf("no admin password found")
+		if r.Method != http.MethodPost {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
 		}
-		return false, fmt.Errorf("querying admin password: %w", err)
-	}
-	// Print both hashes for debugging
-
-	fmt.Printf("Stored Hash: %s\n", storedHash)
-	fmt.Printf("Provided Hash: %s\n", password)
-
-	// Compare the hashed provided password with the stored hash
-	if err := bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(password)); err != nil {
-		return false, nil // Password does not match
-	}
-
-	return true, nil // Password matches
-}
-
-func getPaymentStatus(db *Database) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Enable CORS if needed
-		w.Header().Set("Content-Type", "application/json")
 
-		// Parse loanID from query parameters
-		loanIDStr := r.URL.Query().Get("loanID")
-		if loanIDStr == "" {
-			http.Error(w, "loanID is required", http.StatusBadRequest)
+		var loanRequest LoanRequest
+		if err := json.NewDecoder(r.Body).Decode(&loanRequest); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
 
-		loanID, err := strconv.Atoi(loanIDStr)
+		response, err := database.applyForLoan(loanRequest)
 		if err != nil {
-			http.Error(w, "Invalid loanID format", http.StatusBadRequest)
+			http.Error(w, fmt.Sprintf("Loan application failed: %v", err), http.StatusInternalServerError)
 			return
 		}
 
-		// Query for the latest payment for that loan
-		query := `
-			SELECT PaymentID, CheckedStatus
-			FROM payment
-			WHERE LoanID = ?
-			ORDER BY PaymentID DESC
-			LIMIT 1
-		`
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})))))
 
-		var paymentID int
-		var checkedStatus string
+	// HTTP route for a borrower to cancel a loan during its cooling-off period
+	http.Handle("/cancelLoan", enableCORS(audited(database, auditSpec{action: "loan.cancel", entityType: "loan", entityParam: "loanID", snapshot: snapshotLoan}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
 
-		err = db.QueryRow(query, loanID).Scan(&paymentID, &checkedStatus)
+		loanID, err := strconv.Atoi(r.URL.Query().Get("loanID"))
 		if err != nil {
-			if err == sql.ErrNoRows {
-				// Return null if no payment is found
-				response := map[string]interface{}{
-					"PaymentID":     nil,
-					"CheckedStatus": nil,
-				}
-				json.NewEncoder(w).Encode(response)
-				return
-			}
-			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+			http.Error(w, "Invalid LoanID format", http.StatusBadRequest)
 			return
 		}
 
-		// Prepare and send the response
-		response := map[string]interface{}{
-			"PaymentID":     paymentID,
-			"CheckedStatus": checkedStatus,
+		// Only the borrower may cancel, so the user comes from the session rather than the request
+		session, err := database.sessionFromRequest(r)
+		if err != nil || session.UserID == 0 {
+			http.Error(w, "A user session is required", http.StatusUnauthorized)
+			return
 		}
 
-		json.NewEncoder(w).Encode(response)
-	}
-}
-
-// Enable CORS
-func enableCORS(h http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Allow only specific origin (you can change this based on your frontend URL)
-		w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-
-		// Allow credentials if needed (for cookies or authorization headers)
-		// w.Header().Set("Access-Control-Allow-Credentials", "true")
-
-		// Handle preflight requests (OPTIONS)
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusNoContent)
+		if err := database.CancelLoan(loanID, session.UserID); err != nil {
+			http.Error(w, fmt.Sprintf("CancelLoan failed: %v", err), http.StatusBadRequest)
 			return
 		}
 
-		// Pass the request to the next handler
-		h.ServeHTTP(w, r)
-	})
-}
-
-// Main function to set up server and routes
-func main() {
-
-	// Load the RSA keys from files
-	privateKey, err := loadPrivateKey("private_key.pem")
-	if err != nil {
-		log.Fatalf("Failed to load RSA private key: %v", err)
-	}
-
-	publicKey, err := loadPublicKey("public_key.pem")
-	if err != nil {
-		log.Fatalf("Failed to load RSA public key: %v", err)
-	}
+		response := map[string]string{"message": "Loan cancelled successfully!"}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}))))
 
-	// Connect to the database
-	db, err := sql.Open("mysql", "root:root@tcp(localhost:8889)/loanloey")
-	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
-	}
-	defer db.Close()
+	// HTTP route to list the collateral pledged against a loan
+	http.Handle("/getLoanCollateral", enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
 
-	database := &Database{db}
+		loanID, err := strconv.Atoi(r.URL.Query().Get("loanID"))
+		if err != nil {
+			http.Error(w, "Invalid LoanID format", http.StatusBadRequest)
+			return
+		}
 
-	// Set up router for debug-decrypt
-	r := mux.NewRouter()
-	r.HandleFunc("/debug-decrypt/{loanID}", DebugDecryptReceipt(database.DB, privateKey)).Methods("GET")
+		items, err := database.GetLoanCollateral(loanID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to get collateral: %v", err), http.StatusInternalServerError)
+			return
+		}
 
-	//ACCOUNT
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(items)
+	})))
+	http.Handle("/addCollateralPhoto", enableCORS(audited(database, auditSpec{action: "collateral.photo.add", entityType: "collateral", entityParam: "collateralID"}, http.HandlerFunc(addCollateralPhoto(database, keyring)))))
+	http.Handle("/decryptCollateralPhotos", enableCORS(audited(database, auditSpec{action: "collateral.photo.decrypt", entityType: "collateral", entityParam: "collateralID"}, adminOnly(database, http.HandlerFunc(decryptCollateralPhotos(database, keyring))))))
 
-	// HTTP route for user signup
-	http.Handle("/signup", enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	// HTTP route for admins to record that an overdue loan defaulted, seizing its collateral
+	http.Handle("/markLoanDefaulted", enableCORS(audited(database, auditSpec{action: "loan.default", entityType: "loan", entityParam: "loanID", snapshot: snapshotLoan}, adminOnly(database, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		var userAccount UserAccount
-		if err := json.NewDecoder(r.Body).Decode(&userAccount); err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+		loanID, err := strconv.Atoi(r.URL.Query().Get("loanID"))
+		if err != nil {
+			http.Error(w, "Invalid LoanID format", http.StatusBadRequest)
 			return
 		}
 
-		if err := database.Signup(userAccount); err != nil {
-			http.Error(w, fmt.Sprintf("Signup failed: %v", err), http.StatusInternalServerError)
+		if err := database.MarkLoanDefaulted(loanID); err != nil {
+			http.Error(w, fmt.Sprintf("MarkLoanDefaulted failed: %v", err), http.StatusBadRequest)
 			return
 		}
 
-		response := map[string]string{"message": "Account and User created successfully!"}
+		response := map[string]string{"message": "Loan marked as defaulted and collateral seized"}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
-	})))
+	})))))
 
-	// HTTP route to delete an account
-	http.Handle("/deleteAccount", enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodDelete {
+	// HTTP route for admins to mark a loan as paid out
+	http.Handle("/disburseLoan", enableCORS(audited(database, auditSpec{action: "loan.disburse", entityType: "loan", entityParam: "loanID", snapshot: snapshotLoan}, adminOnly(database, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
 			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		// Parse userID from query parameters
-		userIDStr := r.URL.Query().Get("userID")
-		if userIDStr == "" {
-			http.Error(w, "UserID is required", http.StatusBadRequest)
-			return
-		}
-
-		// Convert userID to integer
-		userID, err := strconv.Atoi(userIDStr)
+		loanID, err := strconv.Atoi(r.URL.Query().Get("loanID"))
 		if err != nil {
-			http.Error(w, "Invalid UserID format", http.StatusBadRequest)
+			http.Error(w, "Invalid LoanID format", http.StatusBadRequest)
 			return
 		}
 
-		// Call DeleteAccount with userID
-		if err := database.DeleteAccount(userID); err != nil {
-			http.Error(w, fmt.Sprintf("DeleteAccount failed: %v", err), http.StatusInternalServerError)
+		if err := database.DisburseLoan(loanID); err != nil {
+			http.Error(w, fmt.Sprintf("DisburseLoan failed: %v", err), http.StatusBadRequest)
 			return
 		}
 
-		// Respond with success message
-		response := map[string]string{"message": "Account deleted successfully!"}
+		response := map[string]string{"message": "Loan disbursed successfully!"}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
+	})))))
 
-	})))
-
-	// HTTP route for user login
-	http.Handle("/login", enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
+	// HTTP route for the logged-in user to see the loans they were asked to guarantee
+	http.Handle("/getGuaranteeRequests", enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
 			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		var credentials struct {
-			Username string `json:"username"`
-			Password string `json:"password"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+		session, err := database.sessionFromRequest(r)
+		if err != nil || session.UserID == 0 {
+			http.Error(w, "A user session is required", http.StatusUnauthorized)
 			return
 		}
 
-		role, err := database.Login(credentials.Username, credentials.Password)
+		requests, err := database.GetGuaranteeRequests(session.UserID)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Login failed: %v", err), http.StatusUnauthorized)
+			http.Error(w, fmt.Sprintf("Failed to get guarantee requests: %v", err), http.StatusInternalServerError)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(role)
+		json.NewEncoder(w).Encode(requests)
 	})))
 
-	// http.HandleFunc("/adminpage", func(w http.ResponseWriter, r *http.Request) {
-	// 	fmt.Fprintln(w, "Welcome to the Admin Page!")
-	// })
-
-	// http.HandleFunc("/homepage", func(w http.ResponseWriter, r *http.Request) {
-	// 	fmt.Fprintln(w, "Welcome to the Home Page!")
-	// })
-
-	//USER
-
-	// HTTP route to update user information
-	http.Handle("/updateUserInfo", enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPut {
+	// HTTP route for the logged-in user to accept or decline guaranteeing a loan
+	http.Handle("/respondGuarantee", enableCORS(audited(database, auditSpec{action: "guarantee.respond", entityType: "loan", entityParam: "loanID"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
 			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		var userAccount UserAccount
-		if err := json.NewDecoder(r.Body).Decode(&userAccount); err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+		session, err := database.sessionFromRequest(r)
+		if err != nil || session.UserID == 0 {
+			http.Error(w, "A user session is required", http.StatusUnauthorized)
 			return
 		}
 
-		userIDStr := r.URL.Query().Get("userID")
-		if userIDStr == "" {
-			http.Error(w, "UserID is required", http.StatusBadRequest)
+		loanID, err := strconv.Atoi(r.URL.Query().Get("loanID"))
+		if err != nil {
+			http.Error(w, "Invalid LoanID format", http.StatusBadRequest)
 			return
 		}
 
-		userID, err := strconv.Atoi(userIDStr)
-		if err != nil {
-			http.Error(w, "Invalid UserID format", http.StatusBadRequest)
+		action := r.URL.Query().Get("action")
+		if action != "accept" && action != "decline" {
+			http.Error(w, "Invalid action, must be either 'accept' or 'decline'", http.StatusBadRequest)
 			return
 		}
 
-		if err := database.UpdateUserInfo(userID, userAccount); err != nil {
-			http.Error(w, fmt.Sprintf("UpdateUserInfo failed: %v", err), http.StatusInternalServerError)
+		if err := database.RespondToGuarantee(loanID, session.UserID, action == "accept"); err != nil {
+			http.Error(w, fmt.Sprintf("RespondGuarantee failed: %v", err), http.StatusBadRequest)
 			return
 		}
 
-		response := map[string]string{"message": "User information updated successfully!"}
+		message := "Guarantee declined and loan cancelled"
+		if action == "accept" {
+			message = "Guarantee accepted successfully!"
+		}
+
+		response := map[string]string{"message": message}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
-	})))
+	}))))
 
-	// HTTP route to get user information
-	http.Handle("/getUserInfo", enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
+	// HTTP route to quote a due-date extension without requesting it
+	http.Handle("/checkLoanExtension", enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
 			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		userIDStr := r.URL.Query().Get("userID")
-		log.Printf("Received UserID: %s", userIDStr)
-
-		if userIDStr == "" {
-			http.Error(w, "UserID is required", http.StatusBadRequest)
+		session, err := database.sessionFromRequest(r)
+		if err != nil || session.UserID == 0 {
+			http.Error(w, "A user session is required", http.StatusUnauthorized)
 			return
 		}
 
-		userID, err := strconv.Atoi(userIDStr)
-		if err != nil {
-			log.Printf("Error converting UserID: %v", err)
-			http.Error(w, "Invalid UserID format", http.StatusBadRequest)
+		var extensionRequest ExtensionRequest
+		if err := json.NewDecoder(r.Body).Decode(&extensionRequest); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
+		extensionRequest.UserID = session.UserID
 
-		userAccount, err := database.GetUserInfo(userID)
+		response, err := database.quoteLoanExtension(extensionRequest)
 		if err != nil {
-			log.Printf("Failed to get user info: %v", err)
-			http.Error(w, "User not found", http.StatusNotFound)
+			http.Error(w, fmt.Sprintf("Extension quote failed: %v", err), http.StatusBadRequest)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(userAccount); err != nil {
-			log.Printf("Error encoding user info to JSON: %v", err)
-			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
-			return
-		}
+		json.NewEncoder(w).Encode(response)
 	})))
 
-	// HTTP route to get user credit level
-	http.Handle("/getUserCreditLevel", enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
+	// HTTP route for a borrower to request a due-date extension
+	http.Handle("/requestLoanExtension", enableCORS(audited(database, auditSpec{action: "extension.request", entityType: "loanextension", recordResponse: true}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
 			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		userIDStr := r.URL.Query().Get("userID")
-		if userIDStr == "" {
-			http.Error(w, "UserID is required", http.StatusBadRequest)
+		session, err := database.sessionFromRequest(r)
+		if err != nil || session.UserID == 0 {
+			http.Error(w, "A user session is required", http.StatusUnauthorized)
 			return
 		}
 
-		userID, err := strconv.Atoi(userIDStr)
-		if err != nil {
-			http.Error(w, "Invalid UserID format", http.StatusBadRequest)
+		var extensionRequest ExtensionRequest
+		if err := json.NewDecoder(r.Body).Decode(&extensionRequest); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
+		extensionRequest.UserID = session.UserID
 
-		creditLevel, err := database.GetUserCreditLevel(userID)
+		response, err := database.RequestLoanExtension(extensionRequest)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to get credit level: %v", err), http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("Extension request failed: %v", err), http.StatusBadRequest)
 			return
 		}
 
-		response := map[string]string{"credit_level": creditLevel}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
-	})))
+	}))))
 
-	http.Handle("/getAllUserInfoForAdmin", enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
+	// HTTP route for admins to approve or reject an extension
+	http.Handle("/handleLoanExtension", enableCORS(audited(database, auditSpec{action: "extension.decide", entityType: "loanextension", entityParam: "extensionID", snapshot: snapshotExtension}, adminOnly(database, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
 			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		users, err := database.getAllUserInfoForAdmin()
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to get all user info: %v", err), http.StatusInternalServerError)
+		extensionIDStr := r.URL.Query().Get("extensionID")
+		action := r.URL.Query().Get("action")
+		if extensionIDStr == "" || action == "" {
+			http.Error(w, "ExtensionID and action are required", http.StatusBadRequest)
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		// Return users data with UserID
-		json.NewEncoder(w).Encode(users)
-	})))
-
-	//ADMIN
-	// HTTP route for admin creation
-	http.Handle("/createAdmin", enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		extensionID, err := strconv.Atoi(extensionIDStr)
+		if err != nil {
+			http.Error(w, "Invalid ExtensionID format", http.StatusBadRequest)
 			return
 		}
 
-		var admin Admin
-		if err := json.NewDecoder(r.Body).Decode(&admin); err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+		if action != "approve" && action != "reject" {
+			http.Error(w, "Invalid action, must be either 'approve' or 'reject'", http.StatusBadRequest)
 			return
 		}
 
-		if err := database.CreateAdmin(admin); err != nil {
-			http.Error(w, fmt.Sprintf("CreateAdmin failed: %v", err), http.StatusInternalServerError)
+		if err := database.DecideLoanExtension(extensionID, action == "approve", r.URL.Query().Get("note")); err != nil {
+			http.Error(w, fmt.Sprintf("Extension decision failed: %v", err), http.StatusBadRequest)
 			return
 		}
 
-		response := map[string]string{"message": "Admin created successfully!"}
+		response := map[string]string{"message": fmt.Sprintf("Extension %s and status updated", action)}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
-	})))
+	})))))
 
-	//LOAN
-	// HTTP route to get total loan amount with pending status
-	http.Handle("/getTotalLoan", enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	// HTTP route to list the extension history of a loan
+	http.Handle("/getLoanExtensions", enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		totalLoan, err := database.GetTotalLoan()
+		loanIDStr := r.URL.Query().Get("loanID")
+		if loanIDStr == "" {
+			http.Error(w, "LoanID is required", http.StatusBadRequest)
+			return
+		}
+
+		loanID, err := strconv.Atoi(loanIDStr)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to get total loan: %v", err), http.StatusInternalServerError)
+			http.Error(w, "Invalid LoanID format", http.StatusBadRequest)
+			return
+		}
+
+		extensions, err := database.GetLoanExtensions(loanID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to get loan extensions: %v", err), http.StatusInternalServerError)
 			return
 		}
 
-		response := map[string]float64{"total_loan": totalLoan}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
+		json.NewEncoder(w).Encode(extensions)
 	})))
 
-	http.Handle("/getUserTotalLoan", enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
+	//PAYMENT
+	http.Handle("/confirmPaymentDetails", enableCORS(http.HandlerFunc(confirmPaymentDetails(database))))
+
+	// HTTP route to quote an early payoff with the interest rebate applied
+	http.Handle("/getPayoffQuote", enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
 			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		userIDStr := r.URL.Query().Get("userID")
-		if userIDStr == "" {
-			http.Error(w, "UserID is required", http.StatusBadRequest)
+		loanIDStr := r.URL.Query().Get("loanID")
+		payoffDate := r.URL.Query().Get("payoffDate")
+		if loanIDStr == "" || payoffDate == "" {
+			http.Error(w, "LoanID and payoffDate are required", http.StatusBadRequest)
 			return
 		}
 
-		userID, err := strconv.Atoi(userIDStr)
+		loanID, err := strconv.Atoi(loanIDStr)
 		if err != nil {
-			http.Error(w, "Invalid UserID format", http.StatusBadRequest)
+			http.Error(w, "Invalid LoanID format", http.StatusBadRequest)
 			return
 		}
 
-		totalLoan, err := database.GetUserTotalLoan(userID)
+		quote, err := database.CreatePayoffQuote(loanID, payoffDate)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to get total loan: %v", err), http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("Payoff quote failed: %v", err), http.StatusBadRequest)
 			return
 		}
 
-		response := map[string]float64{"total_loan": totalLoan}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
+		json.NewEncoder(w).Encode(quote)
 	})))
 
-	http.Handle("/getUserTotalLoanHistory", enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	// Register your handlers
+	http.Handle("/insertPayment", enableCORS(audited(database, auditSpec{action: "payment.submit", entityType: "loan", entityParam: "loanID"}, idempotent(database, "insertPayment", http.HandlerFunc(insertPayment(database, keyring))))))
+	http.Handle("/decryptReceipt", enableCORS(audited(database, auditSpec{action: "receipt.decrypt", entityType: "loan", entityParam: "loanID"}, adminOnly(database, http.HandlerFunc(decryptReceiptHandler(database, keyring))))))
+
+	// HTTP route to list a loan's receipts without their content
+	http.Handle("/getReceipts", enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		userIDStr := r.URL.Query().Get("userID")
-		if userIDStr == "" {
-			http.Error(w, "UserID is required", http.StatusBadRequest)
+		loanID, err := strconv.Atoi(r.URL.Query().Get("loanID"))
+		if err != nil {
+			http.Error(w, "Invalid LoanID format", http.StatusBadRequest)
 			return
 		}
-
-		userID, err := strconv.Atoi(userIDStr)
-		if err != nil {
-			http.Error(w, "Invalid UserID format", http.StatusBadRequest)
+		if _, ok := database.loanSession(w, r, loanID); !ok {
 			return
 		}
 
-		totalLoan, err := database.GetUserTotalLoanHistory(userID)
+		receipts, err := database.GetLoanReceipts(loanID)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to get total loan: %v", err), http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("Failed to get receipts: %v", err), http.StatusInternalServerError)
 			return
 		}
-		response := map[string]float64{"total_loan": totalLoan}
+
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
+		json.NewEncoder(w).Encode(receipts)
 	})))
 
-	http.Handle("/getUserLoans", enableCORS(http.HandlerFunc(getUserLoans(database))))
+	// HTTP route for the review queue's receipt thumbnails
+	http.Handle("/receiptThumbnail", enableCORS(audited(database, auditSpec{action: "receipt.thumbnail", entityType: "payment", entityParam: "paymentID"}, adminOnly(database, http.HandlerFunc(receiptThumbnailHandler(database, keyring))))))
 
-	http.Handle("/checkLoanDetails", enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
+	// HTTP route to download a single decrypted receipt
+	http.Handle("/receipt", enableCORS(audited(database, auditSpec{action: "receipt.download", entityType: "payment", entityParam: "paymentID"}, adminOnly(database, http.HandlerFunc(receiptDownloadHandler(database, keyring))))))
+
+	// HTTP route for admins to see the RSA keyring
+	http.Handle("/getRSAKeys", enableCORS(audited(database, auditSpec{action: "rsakey.list", entityType: "rsakey"}, adminOnly(database, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
 			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		var loanRequest LoanRequest
-		if err := json.NewDecoder(r.Body).Decode(&loanRequest); err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+		keys, err := database.GetRSAKeys()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to get keys: %v", err), http.StatusInternalServerError)
 			return
 		}
 
-		response, err := database.checkLoanDetails(loanRequest)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(keys)
+	})))))
+	// HTTP route for admins to see payment records that failed their integrity check
+	http.Handle("/getSecurityEvents", enableCORS(audited(database, auditSpec{action: "securityevent.list", entityType: "securityevent"}, adminOnly(database, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		limit := 100
+		if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+			var err error
+			if limit, err = strconv.Atoi(limitStr); err != nil || limit < 1 || limit > 1000 {
+				http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+				return
+			}
+		}
+
+		events, err := database.GetSecurityEvents(limit)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Loan info calculation failed: %v", err), http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("Failed to get security events: %v", err), http.StatusInternalServerError)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
-	})))
+		json.NewEncoder(w).Encode(events)
+	})))))
 
-	// / HTTP route for applying for a loan
-	http.Handle("/applyForLoan", enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	// HTTP routes for PDPA data subject access requests
+	http.Handle("/requestDataExport", enableCORS(audited(database, auditSpec{action: "dataexport.request", entityType: "user", entityParam: "userID", recordResponse: true}, http.HandlerFunc(requestDataExport(database, wakeExports)))))
+	http.Handle("/getDataExport", enableCORS(http.HandlerFunc(getDataExport(database))))
+	http.Handle("/downloadDataExport", enableCORS(audited(database, auditSpec{action: "dataexport.download", entityType: "dataexport"}, http.HandlerFunc(downloadDataExport(database, keyring)))))
 
-		if r.Method != http.MethodPost {
+	// HTTP routes for compliance review of the audit log
+	http.Handle("/getAuditLog", enableCORS(audited(database, auditSpec{action: "auditlog.view", entityType: "auditlog"}, adminOnly(database, http.HandlerFunc(getAuditLog(database))))))
+	http.Handle("/verifyAuditLog", enableCORS(adminOnly(database, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
 			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
 
-		var loanRequest LoanRequest
-		if err := json.NewDecoder(r.Body).Decode(&loanRequest); err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+		result, err := database.VerifyAuditLog()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to verify audit log: %v", err), http.StatusInternalServerError)
 			return
 		}
 
-		response, err := database.applyForLoan(loanRequest)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}))))
+
+	http.Handle("/handlePaymentApproval", enableCORS(audited(database, auditSpec{action: "payment.review", entityType: "payment", entityParam: "paymentID", snapshot: snapshotPayment}, adminOnly(database, http.HandlerFunc(handlePaymentApproval(database))))))
+
+	// HTTP route publishing the public key clients encrypt receipts with
+	http.Handle("/getReceiptEncryptionKey", enableCORS(http.HandlerFunc(receiptEncryptionKeyHandler(keyring))))
+
+	// HTTP route for a borrower to upload a new receipt for a rejected payment
+	http.Handle("/resubmitPayment", enableCORS(audited(database, auditSpec{action: "payment.resubmit", entityType: "payment", entityParam: "paymentID"}, idempotent(database, "resubmitPayment", http.HandlerFunc(resubmitPayment(database, keyring))))))
+
+	// HTTP route to list every payment attempt for a loan
+	http.Handle("/getPaymentHistory", enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		loanID, err := strconv.Atoi(r.URL.Query().Get("loanID"))
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Loan application failed: %v", err), http.StatusInternalServerError)
+			http.Error(w, "Invalid LoanID format", http.StatusBadRequest)
+			return
+		}
+		if _, ok := database.loanSession(w, r, loanID); !ok {
+			return
+		}
+
+		attempts, err := database.GetPaymentHistory(loanID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to get payment history: %v", err), http.StatusInternalServerError)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
+		json.NewEncoder(w).Encode(attempts)
 	})))
 
-	//PAYMENT
-	http.Handle("/confirmPaymentDetails", enableCORS(http.HandlerFunc(confirmPaymentDetails(database))))
-
-	// Register your handlers
-	http.Handle("/insertPayment", enableCORS(http.HandlerFunc(insertPayment(database, publicKey))))
-	http.Handle("/decryptReceipt", enableCORS(http.HandlerFunc(decryptReceiptHandler(database, privateKey))))
-	http.Handle("/testRSAKeys", enableCORS(http.HandlerFunc(testRSAKeys(privateKey, publicKey))))
-	http.Handle("/handlePaymentApproval", enableCORS(http.HandlerFunc(handlePaymentApproval(database))))
+	// HTTP route for the admin payment review queue
+	http.Handle("/getPaymentQueue", enableCORS(audited(database, auditSpec{action: "payment.queue.view", entityType: "payment"}, adminOnly(database, http.HandlerFunc(getPaymentQueue(database))))))
 
 	http.Handle("/checkPaymentDetails", enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
@@ -1791,7 +9626,7 @@ func main() {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
 	})))
-	http.Handle("/checkAdminPassword", enableCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	http.Handle("/checkAdminPassword", enableCORS(audited(database, auditSpec{action: "admin.password.check", entityType: "admin", recordResponse: true}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 			return
@@ -1814,14 +9649,14 @@ func main() {
 		response := map[string]bool{"is_valid": isValid}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
-	})))
+	}))))
 
 	http.Handle("/getPaymentStatus", enableCORS(http.HandlerFunc(getPaymentStatus(database))))
 
 	// Start the server
 
 	log.Println("Server starting on :8080")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
+	if err := http.ListenAndServe(":8080", withRequestID(http.DefaultServeMux)); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }